@@ -23,19 +23,36 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	k8sProwConfig "k8s.io/test-infra/prow/config"
 
 	"istio.io/test-infra/prow/config"
 )
 
 func exit(err error, context string) {
+	exitWith(1, err, context)
+}
+
+func exitWith(code int, err error, context string) {
 	if context == "" {
 		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
 	} else {
 		_, _ = fmt.Fprintf(os.Stderr, "%v: %v\n", context, err)
 	}
-	os.Exit(1)
+	os.Exit(code)
+}
+
+// failureExitCode returns the exit code of the failures to read, validate or generate the config,
+// 2 for check to tell them from drift, and 1 for the other commands.
+func failureExitCode(command string) int {
+	if command == "check" {
+		return 2
+	}
+	return 1
 }
 
 func GetFileName(repo string, org string, branch string) string {
@@ -46,6 +63,32 @@ func GetFileName(repo string, org string, branch string) string {
 var (
 	inputDir  = flag.String("input-dir", "../jobs", "directory of input jobs")
 	outputDir = flag.String("output-dir", "../../cluster/jobs", "directory of output jobs")
+
+	maxMatrixExpansion = flag.Int("max-matrix-expansion", 100,
+		"maximum number of jobs a single job's matrix may expand into, 0 to disable")
+	jobNameWarningLength = flag.Int("job-name-warning-length", 55,
+		"length of the longest generated job name above which a warning is emitted, 0 to disable")
+
+	strictVariables = flag.Bool("strict-variables", false,
+		"fail if a job references a variable that is neither a matrix dimension nor an env var of the job")
+
+	featureFlags = flag.String("feature-flags", "",
+		"comma separated list of name=true|false, overriding the feature flags declared in the global config")
+
+	prowConfig = flag.String("prow-config", "",
+		"path to the Prow config, if set the generated config is validated by the Prow config loader")
+
+	manifest = flag.String("manifest", "",
+		"path of a manifest in the sha256sum format listing the files written by write with their checksum")
+
+	groupByLabel = flag.String("group-by-label", "",
+		"label whose value splits the jobs of a repo and branch into one file per value, for write and check")
+
+	observabilityLabels = flag.Bool("observability-labels", false,
+		"label every job with a stable job id, its repo and its type for the tracing pipeline")
+
+	lintCPUThreshold    = flag.String("lint-cpu-threshold", "8", "cpu request above which an always run presubmit is flagged by lint")
+	lintMemoryThreshold = flag.String("lint-memory-threshold", "24Gi", "memory request above which an always run presubmit is flagged by lint")
 )
 
 func main() {
@@ -53,7 +96,7 @@ func main() {
 
 	// TODO: deserves a better CLI...
 	if len(flag.Args()) < 1 {
-		panic("must provide one of write, diff, print, branch")
+		panic("must provide one of write, diff, print, check, lint, markdown, branch")
 	} else if flag.Arg(0) == "branch" {
 		if len(flag.Args()) != 2 {
 			panic("must specify branch name")
@@ -64,26 +107,39 @@ func main() {
 
 	var settings config.GlobalConfig
 	if _, err := os.Stat(filepath.Join(*inputDir, ".global.yaml")); !os.IsNotExist(err) {
-		settings = config.ReadGlobalSettings(filepath.Join(*inputDir, ".global.yaml"))
+		if settings, err = config.LoadGlobalSettings(filepath.Join(*inputDir, ".global.yaml")); err != nil {
+			exitWith(failureExitCode(flag.Arg(0)), err, "")
+		}
+	}
+	flags, err := parseFeatureFlags(*featureFlags, settings.FeatureFlags)
+	if err != nil {
+		exitWith(failureExitCode(flag.Arg(0)), err, "invalid feature-flags")
+	}
+	cli := &config.Client{
+		GlobalConfig:         settings,
+		MaxMatrixExpansion:   *maxMatrixExpansion,
+		JobNameWarningLength: *jobNameWarningLength,
+		StrictVariables:      *strictVariables,
+		FeatureFlags:         flags,
+		ObservabilityLabels:  *observabilityLabels,
 	}
-	cli := &config.Client{GlobalConfig: settings}
 
 	if os.Args[1] == "branch" {
 		if err := filepath.Walk(*inputDir, func(src string, file os.FileInfo, err error) error {
 			if file.IsDir() {
 				return nil
 			}
-			if filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml" || file.Name() == ".global.yaml" {
+			if filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml" || strings.HasPrefix(file.Name(), ".") {
 				log.Println("skipping", file.Name())
 				return nil
 			}
 			jobs := cli.ReadJobsConfig(src)
-			jobs.Jobs = config.FilterReleaseBranchingJobs(jobs.Jobs)
+			branch := "release-" + flag.Arg(1)
+			jobs.Jobs = config.FilterReleaseBranchingJobs(jobs.Jobs, branch)
 
 			if jobs.SupportReleaseBranching {
 				tagRegex := regexp.MustCompile(`^(.+):(.+)-([0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}-[0-9]{2}-[0-9]{2})$`)
 				match := tagRegex.FindStringSubmatch(jobs.Image)
-				branch := "release-" + flag.Arg(1)
 				if len(match) == 4 {
 					newImage := fmt.Sprintf("%s:%s-%s", match[1], branch, match[3])
 					if err := exec.Command("gcloud", "container", "images", "add-tag", match[0], newImage).Run(); err != nil {
@@ -110,45 +166,65 @@ func main() {
 			exit(err, "walking through the meta config files failed")
 		}
 	} else {
-		type ref struct {
-			org    string
-			repo   string
-			branch string
-		}
-		// Store the job config generated from all meta-config files in a cache map, and combine the
-		// job configs before we generate the final config files.
-		// In this way we can have multiple meta-config files for the same org/repo:branch
-		cachedOutput := map[ref]k8sProwConfig.JobConfig{}
-		if err := filepath.Walk(*inputDir, func(src string, file os.FileInfo, err error) error {
-			if file.IsDir() {
-				return nil
+		var groupKey config.GroupKey
+		if *groupByLabel != "" {
+			groupKey = config.GroupByLabel(*groupByLabel)
+		}
+
+		if flag.Arg(0) == "check" {
+			os.Exit(check(cli, groupKey))
+		}
+
+		cachedOutput, err := generate(cli)
+		if err != nil {
+			exit(err, "")
+		}
+
+		if flag.Arg(0) == "lint" {
+			thresholds := config.LintThresholds{}
+			var err error
+			if thresholds.CPU, err = resource.ParseQuantity(*lintCPUThreshold); err != nil {
+				exit(err, "invalid lint-cpu-threshold")
 			}
-			if filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml" || file.Name() == ".global.yaml" {
-				log.Println("skipping", file.Name())
-				return nil
+			if thresholds.Memory, err = resource.ParseQuantity(*lintMemoryThreshold); err != nil {
+				exit(err, "invalid lint-memory-threshold")
 			}
-			jobs := cli.ReadJobsConfig(src)
-			for _, branch := range jobs.Branches {
-				cli.ValidateJobConfig(file.Name(), jobs)
-				output := cli.ConvertJobConfig(jobs, branch)
-				rf := ref{jobs.Org, jobs.Repo, branch}
-				if _, ok := cachedOutput[rf]; !ok {
-					cachedOutput[rf] = output
-				} else {
-					cachedOutput[rf] = combineJobConfigs(cachedOutput[rf], output,
-						fmt.Sprintf("%s/%s", jobs.Org, jobs.Repo))
-				}
+			var findings []string
+			for _, output := range cachedOutput {
+				findings = append(findings, config.LintExpensivePresubmits(output, thresholds)...)
 			}
-			return nil
-		}); err != nil {
-			exit(err, "walking through the meta config files failed")
+			sort.Strings(findings)
+			for _, f := range findings {
+				fmt.Println(f)
+			}
+			if len(findings) > 0 {
+				os.Exit(1)
+			}
+			return
 		}
 
+		if flag.Arg(0) == "markdown" {
+			outputs := make([]k8sProwConfig.JobConfig, 0, len(cachedOutput))
+			for _, output := range cachedOutput {
+				outputs = append(outputs, output)
+			}
+			fmt.Print(config.RenderJobsTable(outputs...))
+			return
+		}
+
+		var written []string
 		for r, output := range cachedOutput {
 			fname := GetFileName(r.repo, r.org, r.branch)
 			switch flag.Arg(0) {
 			case "write":
-				cli.WriteConfig(output, fname)
+				groups := config.GroupJobConfig(output, fname, groupKey)
+				for file, jobs := range groups {
+					cli.WriteConfig(jobs, file)
+					written = append(written, file)
+				}
+				if err := config.RemoveConfigs(config.RemovedFiles(groups, fname)); err != nil {
+					exit(err, "removing the ungrouped config failed")
+				}
 			case "diff":
 				existing := config.ReadProwJobConfig(fname)
 				cli.DiffConfig(output, existing)
@@ -156,7 +232,156 @@ func main() {
 				cli.PrintConfig(output)
 			}
 		}
+		if flag.Arg(0) == "write" && *manifest != "" {
+			if err := config.WriteManifest(written, *manifest); err != nil {
+				exit(err, "writing the manifest failed")
+			}
+		}
+	}
+}
+
+// ref is the org, repo and branch a job config is generated for.
+type ref struct {
+	org    string
+	repo   string
+	branch string
+}
+
+// generate reads, validates and converts the meta config files of the input directory, returning the
+// job config generated for each org, repo and branch. The generated config is also validated against
+// the testgrid dashboards, and the Prow config if set.
+func generate(cli *config.Client) (map[ref]k8sProwConfig.JobConfig, error) {
+	// Store the job config generated from all meta-config files in a cache map, and combine the
+	// job configs before we generate the final config files.
+	// In this way we can have multiple meta-config files for the same org/repo:branch
+	cachedOutput := map[ref]k8sProwConfig.JobConfig{}
+	if err := filepath.Walk(*inputDir, func(src string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file.IsDir() {
+			return nil
+		}
+		if filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml" || strings.HasPrefix(file.Name(), ".") {
+			log.Println("skipping", file.Name())
+			return nil
+		}
+		jobs, err := cli.LoadJobsConfig(src)
+		if err != nil {
+			return err
+		}
+		if err := cli.VerifyJobConfig(file.Name(), jobs); err != nil {
+			return fmt.Errorf("validation failed: %v", err)
+		}
+		for _, branch := range jobs.Branches {
+			output, err := cli.GenerateJobConfig(jobs, branch)
+			if err != nil {
+				return fmt.Errorf("%s: %v", file.Name(), err)
+			}
+			rf := ref{jobs.Org, jobs.Repo, branch}
+			if _, ok := cachedOutput[rf]; !ok {
+				cachedOutput[rf] = output
+			} else {
+				cachedOutput[rf] = combineJobConfigs(cachedOutput[rf], output,
+					fmt.Sprintf("%s/%s", jobs.Org, jobs.Repo))
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("walking through the meta config files failed: %v", err)
+	}
+
+	if len(cli.GlobalConfig.ConcurrencyPools) > 0 {
+		outputs := make([]k8sProwConfig.JobConfig, 0, len(cachedOutput))
+		for _, output := range cachedOutput {
+			outputs = append(outputs, output)
+		}
+		// The configs share their jobs with the cache, which is updated in place.
+		cli.DistributeConcurrencyPools(outputs)
+	}
+
+	if cli.GlobalConfig.TestgridConfig.Enabled {
+		repoBranches := make([]config.RepoBranch, 0, len(cachedOutput))
+		for r := range cachedOutput {
+			repoBranches = append(repoBranches, config.RepoBranch{Org: r.org, Repo: r.repo, Branch: r.branch})
+		}
+		if err := config.ValidateTestgridDashboards(repoBranches); err != nil {
+			return nil, fmt.Errorf("validating the testgrid dashboards failed: %v", err)
+		}
+	}
+
+	if *prowConfig != "" {
+		configs := map[string]k8sProwConfig.JobConfig{}
+		for r, output := range cachedOutput {
+			configs[GetFileName(r.repo, r.org, r.branch)] = output
+		}
+		if err := config.ValidateWithProw(*prowConfig, configs); err != nil {
+			return nil, fmt.Errorf("validating the generated config failed: %v", err)
+		}
+	}
+	return cachedOutput, nil
+}
+
+// check generates the config and compares it to the current files, printing the files that differ,
+// and returns the exit code of check: 0 if there are no differences, 1 if there are, and 2 if the
+// config could not be read, validated or generated, or the files could not be compared.
+func check(cli *config.Client, groupKey config.GroupKey) int {
+	cachedOutput, err := generate(cli)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 2
+	}
+	configs := map[string]k8sProwConfig.JobConfig{}
+	var removed []string
+	for r, output := range cachedOutput {
+		fname := GetFileName(r.repo, r.org, r.branch)
+		groups := config.GroupJobConfig(output, fname, groupKey)
+		for file, jobs := range groups {
+			configs[file] = jobs
+		}
+		removed = append(removed, config.RemovedFiles(groups, fname)...)
+	}
+	result, err := cli.CheckConfigs(configs, removed...)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "checking the generated config failed: %v\n", err)
+		return 2
+	}
+	for _, f := range result.Drifted {
+		fmt.Println(f)
+	}
+	for _, f := range result.Missing {
+		fmt.Printf("%s: missing\n", f)
+	}
+	for _, f := range result.Stale {
+		fmt.Printf("%s: all its jobs are grouped, it must be deleted\n", f)
+	}
+	if result.HasDrift() {
+		return 1
+	}
+	return 0
+}
+
+// parseFeatureFlags parses the name=value overrides of the declared feature flags.
+func parseFeatureFlags(flags string, declared map[string]bool) (map[string]bool, error) {
+	res := map[string]bool{}
+	if flags == "" {
+		return res, nil
+	}
+	for _, f := range strings.Split(flags, ",") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("feature flag %q must take the form name=true|false", f)
+		}
+		if _, ok := declared[kv[0]]; !ok {
+			return nil, fmt.Errorf("feature flag %v is not declared in the global config", kv[0])
+		}
+		v, err := strconv.ParseBool(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("feature flag %v: %v", kv[0], err)
+		}
+		res[kv[0]] = v
 	}
+	return res, nil
 }
 
 func combineJobConfigs(jc1, jc2 k8sProwConfig.JobConfig, orgRepo string) k8sProwConfig.JobConfig {
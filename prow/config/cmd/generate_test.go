@@ -0,0 +1,69 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"istio.io/test-infra/prow/config"
+)
+
+func TestCheckExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(in, out string) { *inputDir, *outputDir = in, out }(*inputDir, *outputDir)
+	*inputDir, *outputDir = filepath.Join(dir, "jobs"), filepath.Join(dir, "cluster")
+	if err := os.Mkdir(*inputDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	metaConfig := filepath.Join(*inputDir, "istio.yaml")
+	cli := &config.Client{}
+
+	for _, tc := range []struct {
+		name       string
+		metaConfig string
+		write      bool
+		expected   int
+	}{
+		{name: "malformed meta config", metaConfig: `{"org": "istio",`, expected: 2},
+		{name: "invalid meta config", metaConfig: `{"repo": "istio", "image": "image", "jobs": [{"name": "unit", "command": ["make"]}]}`, expected: 2},
+		{name: "missing file", metaConfig: `{"org": "istio", "repo": "istio", "image": "image", "jobs": [{"name": "unit", "command": ["make"]}]}`, expected: 1},
+		{name: "up to date", metaConfig: `{"org": "istio", "repo": "istio", "image": "image", "jobs": [{"name": "unit", "command": ["make"]}]}`, write: true, expected: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ioutil.WriteFile(metaConfig, []byte(tc.metaConfig), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tc.write {
+				outputs, err := generate(cli)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for r, output := range outputs {
+					cli.WriteConfig(output, GetFileName(r.repo, r.org, r.branch))
+				}
+			}
+			if code := check(cli, nil); code != tc.expected {
+				t.Errorf("expected the exit code %d, got %d", tc.expected, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+const (
+	csvNameColumn      = "name"
+	csvArgsColumn      = "args"
+	csvResourcesColumn = "resources"
+)
+
+// csvColumns are the columns of a jobs CSV, of which name and args are required.
+var csvColumns = []string{csvNameColumn, csvArgsColumn, csvResourcesColumn}
+
+// csvRow is a row of a jobs CSV, with the line of the file it is read from.
+type csvRow struct {
+	line   int
+	fields []string
+}
+
+// ReadJobsCSV reads the jobs of a CSV with a header row naming its columns, among name, args and
+// resources. The args, split on whitespace, are the command of the job, and resources is the name of
+// its resource preset. The jobs inherit all other settings from the file importing them. Errors
+// reference the lines of the file, so quoted fields must not span several lines.
+func ReadJobsCSV(file string, r io.Reader) ([]Job, error) {
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	// Each line is read on its own to know the line of every row. Like encoding/csv, empty lines are
+	// skipped.
+	var rows []csvRow
+	for i, text := range strings.Split(string(bs), "\n") {
+		text = strings.TrimSuffix(text, "\r")
+		if text == "" {
+			continue
+		}
+		reader := csv.NewReader(strings.NewReader(text))
+		reader.TrimLeadingSpace = true
+		// The number of fields is validated per row, against the header.
+		reader.FieldsPerRecord = -1
+		fields, e := reader.Read()
+		if pe, ok := e.(*csv.ParseError); ok {
+			e = pe.Err
+			if e == csv.ErrQuote {
+				e = fmt.Errorf("%v, quoted fields must not span several lines", e)
+			}
+		}
+		if e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s:%d: %v", file, i+1, e))
+			continue
+		}
+		rows = append(rows, csvRow{line: i + 1, fields: fields})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("%s: missing the header row", file)
+	}
+
+	header := rows[0]
+	columns := map[string]int{}
+	for i, column := range header.fields {
+		column = strings.TrimSpace(column)
+		if e := validate(column, csvColumns, "column"); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s:%d: %v", file, header.line, e))
+			continue
+		}
+		if _, f := columns[column]; f {
+			err = multierror.Append(err, fmt.Errorf("%s:%d: duplicate column %v", file, header.line, column))
+		}
+		columns[column] = i
+	}
+	for _, column := range []string{csvNameColumn, csvArgsColumn} {
+		if _, f := columns[column]; !f {
+			err = multierror.Append(err, fmt.Errorf("%s:%d: missing the required column %v", file, header.line, column))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []Job
+	for _, row := range rows[1:] {
+		record, line := row.fields, row.line
+		if len(record) != len(header.fields) {
+			err = multierror.Append(err, fmt.Errorf("%s:%d: expected %d fields, got %d", file, line, len(header.fields), len(record)))
+			continue
+		}
+		job := Job{
+			Name:    strings.TrimSpace(record[columns[csvNameColumn]]),
+			Command: strings.Fields(record[columns[csvArgsColumn]]),
+		}
+		if i, f := columns[csvResourcesColumn]; f {
+			job.Resource = strings.TrimSpace(record[i])
+		}
+		if job.Name == "" {
+			err = multierror.Append(err, fmt.Errorf("%s:%d: the name must be set", file, line))
+		}
+		if len(job.Command) == 0 {
+			err = multierror.Append(err, fmt.Errorf("%s:%d: the args must be set", file, line))
+		}
+		jobs = append(jobs, job)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadJobsCSV(t *testing.T) {
+	in := `name,args,resources
+unit-pilot,make test PKG=pilot,
+unit-mixer, make test PKG=mixer ,large
+`
+	jobs, err := ReadJobsCSV("jobs.csv", strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Job{
+		{Name: "unit-pilot", Command: []string{"make", "test", "PKG=pilot"}},
+		{Name: "unit-mixer", Command: []string{"make", "test", "PKG=mixer"}, Resource: "large"},
+	}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Errorf("expected jobs %+v, got %+v", expected, jobs)
+	}
+}
+
+func TestReadJobsCSVErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		in       string
+		expected []string
+	}{
+		{
+			name:     "missing column",
+			in:       "name,resources\nunit,large\n",
+			expected: []string{"jobs.csv:1: missing the required column args"},
+		},
+		{
+			name:     "unknown column",
+			in:       "name,args,image\nunit,make,image\n",
+			expected: []string{"jobs.csv:1: 'image' is not a valid column"},
+		},
+		{
+			name: "malformed rows",
+			in:   "name,args\nunit,make\nlint\n,make\nbuild,\n",
+			expected: []string{
+				"jobs.csv:3: expected 2 fields, got 1",
+				"jobs.csv:4: the name must be set",
+				"jobs.csv:5: the args must be set",
+			},
+		},
+		{
+			name: "blank lines",
+			in:   "\nname,args\n\nunit,make\n\n\nlint\n",
+			expected: []string{
+				"jobs.csv:7: expected 2 fields, got 1",
+			},
+		},
+		{
+			name:     "multi-line cell",
+			in:       "name,args\nunit,\"make\ntest\"\n",
+			expected: []string{"jobs.csv:2: extraneous or missing \" in quoted-field, quoted fields must not span several lines"},
+		},
+		{
+			name:     "empty",
+			in:       "",
+			expected: []string{"jobs.csv: missing the header row"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ReadJobsCSV("jobs.csv", strings.NewReader(tc.in))
+			if err == nil {
+				t.Fatalf("expected an error")
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("expected the error to contain %q, got %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+func TestReadJobsConfigCSV(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs-csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "jobs.csv"), []byte("name,args\nunit,make test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "istio.yaml")
+	content := `{"org": "istio", "repo": "istio", "image": "image", "jobs_csv": "jobs.csv", "jobs": [{"name": "lint", "command": ["make", "lint"]}]}`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &Client{}
+	jobsConfig := cli.ReadJobsConfig(file)
+	var names []string
+	for _, job := range jobsConfig.Jobs {
+		names = append(names, job.Name)
+	}
+	if expected := []string{"lint", "unit"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected jobs %v, got %v", expected, names)
+	}
+	cli.ValidateJobConfig(file, jobsConfig)
+	if presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]; len(presubmits) != 2 {
+		t.Errorf("expected the jobs of the CSV to be generated, got %d presubmits", len(presubmits))
+	}
+}
@@ -16,12 +16,20 @@ package config
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"net/mail"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -31,6 +39,7 @@ import (
 	"gopkg.in/robfig/cron.v2"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
 	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
 	"k8s.io/test-infra/prow/config"
 )
@@ -44,30 +53,224 @@ func exit(err error, context string) {
 	os.Exit(1)
 }
 
+func warn(msg string) {
+	_, _ = fmt.Fprintf(os.Stderr, "warning: %v\n", msg)
+}
+
 const (
 	TestGridDashboard   = "testgrid-dashboards"
 	TestGridAlertEmail  = "testgrid-alert-email"
 	TestGridNumFailures = "testgrid-num-failures-to-alert"
 
+	// ConcurrencyPoolAnnotation records the concurrency pool a job is a member of.
+	ConcurrencyPoolAnnotation = "prow.istio.io/concurrency-pool"
+
+	// OwnerAnnotation records the team owning a job.
+	OwnerAnnotation = "prow.istio.io/owner"
+
+	// LensHintsAnnotation records the Spyglass lenses that should render the artifacts of a job.
+	LensHintsAnnotation = "prow.istio.io/lens-hints"
+
+	// SpecHashAnnotation records the hash of the generated spec of a job, consumed by rehearsal.
+	SpecHashAnnotation = "prow.istio.io/spec-hash"
+
+	// BehaviorHashAnnotation records the hash of the behavior of a job, ignoring cosmetic settings.
+	BehaviorHashAnnotation = "prow.istio.io/behavior-hash"
+
+	// MatrixAnnotation records the matrix cell, as a JSON object of dimensions to values, a job is expanded from.
+	MatrixAnnotation = "prowgen.istio.io/matrix"
+
+	// ArtifactRetentionAnnotation records how long the GCS lifecycle tooling keeps the artifacts of a job.
+	ArtifactRetentionAnnotation = "prow.istio.io/artifact-retention"
+
+	// SkipDraftAnnotation marks the presubmits not to run on draft pull requests. Prow does not read
+	// it, the component triggering the jobs must honor it.
+	SkipDraftAnnotation = "prow.istio.io/skip-draft"
+
+	// MeshInjectAnnotation controls the injection of the Istio sidecar into the pod.
+	MeshInjectAnnotation = "sidecar.istio.io/inject"
+
+	// ObservabilityJobIDLabel, ObservabilityRepoLabel and ObservabilityTypeLabel are the labels the
+	// tracing pipeline correlates the runs of a job with.
+	ObservabilityJobIDLabel = "observability.istio.io/job-id"
+	ObservabilityRepoLabel  = "observability.istio.io/repo"
+	ObservabilityTypeLabel  = "observability.istio.io/type"
+
+	// ResultsEndpointAnnotation and ResultsAuthSecretAnnotation configure the Crier plugin reporting
+	// the results of a job to the internal results dashboard. The secret is recorded as <name>/<key>.
+	ResultsEndpointAnnotation   = "reporter.istio.io/results-endpoint"
+	ResultsAuthSecretAnnotation = "reporter.istio.io/results-auth-secret"
+
+	// RetryMaxRetriesAnnotation and RetryOnAnnotation configure the retry controller rerunning a job
+	// failing for one of the comma separated conditions, at most the given number of times.
+	RetryMaxRetriesAnnotation = "retry.istio.io/max-retries"
+	RetryOnAnnotation         = "retry.istio.io/retry-on"
+
+	// TideQueryLabel and TideQueryAnnotation record which Tide query (merge pool) a job participates
+	// in, the label to select the jobs of a merge pool and the annotation for tooling only reading
+	// annotations.
+	TideQueryLabel      = "prow.istio.io/tide-query"
+	TideQueryAnnotation = "prow.istio.io/tide-query"
+
 	DefaultAutogenHeader = "# THIS FILE IS AUTOGENERATED, DO NOT EDIT IT MANUALLY."
 
 	DefaultResource = "default"
 
+	// DefaultCluster is the alias Prow uses for the cluster of jobs not setting one.
+	DefaultCluster = "default"
+
+	// NodeSelectorMergeReplace makes the most specific node selector replace the others wholesale.
+	NodeSelectorMergeReplace = "replace"
+	// NodeSelectorMergeMerge merges the global, file and job node selectors, the most specific winning.
+	NodeSelectorMergeMerge = "merge"
+
+	// ResourceModeBoth, ResourceModeRequests and ResourceModeLimits select which of the requests and
+	// limits of a resource preset are set on the test container. With limits only, Kubernetes defaults
+	// the requests to the limits, giving the pod the Guaranteed QoS class.
+	ResourceModeBoth     = "both"
+	ResourceModeRequests = "requests"
+	ResourceModeLimits   = "limits"
+
 	ModifierHidden   = "hidden"
 	ModifierOptional = "optional"
 	ModifierSkipped  = "skipped"
+	// ModifierReportOnFailureOnly skips the GitHub status of postsubmits, only reporting their failures
+	// to Slack.
+	ModifierReportOnFailureOnly = "report-on-failure-only"
 
 	TypePostsubmit = "postsubmit"
 	TypePresubmit  = "presubmit"
 	TypePeriodic   = "periodic"
 
+	// decorationCodeMountPath is the GOPATH Prow decoration checks the repos out to.
+	decorationCodeMountPath = "/home/prow/go"
+
+	ArchAMD64 = "amd64"
+	ArchARM64 = "arm64"
+
+	OSLinux   = "linux"
+	OSWindows = "windows"
+
+	// archNodeLabel and osNodeLabel are the well known node labels the platform of a job is selected with.
+	archNodeLabel = "kubernetes.io/arch"
+	osNodeLabel   = "kubernetes.io/os"
+	// windowsNodeTaint is the taint of Windows node pools, keeping Linux pods off them.
+	windowsNodeTaint = "node.kubernetes.io/os"
+
+	// projectedTokenVolume is the volume the projected service account token is mounted from.
+	projectedTokenVolume    = "projected-token"
+	projectedTokenMountPath = "/var/run/secrets/tokens"
+	projectedTokenPath      = "token"
+
+	// RequiredImageAnnotation records the image a job waits for before running.
+	RequiredImageAnnotation = "prow.istio.io/required-image"
+	// DefaultImagePoller is the image of the init container waiting for the required image. It must
+	// provide a shell and crane.
+	DefaultImagePoller   = "gcr.io/go-containerregistry/crane:debug"
+	waitForImageInterval = 10
+
+	// DefaultPreStopGracePeriodSeconds is the termination grace period of jobs with a preStop hook not
+	// setting one, longer than the Kubernetes default of 30s to give the hook time to run.
+	DefaultPreStopGracePeriodSeconds int64 = 120
+
+	// KubernetesVersionEnv is the env the Kubernetes version of a job expanded from its
+	// kubernetes_versions is set in.
+	KubernetesVersionEnv = "KUBERNETES_VERSION"
+
+	// ShardIndexEnv and ShardCountEnv are the env the shard of a job expanded from its shards is set in.
+	ShardIndexEnv = "SHARD_INDEX"
+	ShardCountEnv = "SHARD_COUNT"
+
+	// LockfileRef is the branch of repos whose branch and SHA are resolved from the lockfile.
+	LockfileRef = "lockfile"
+
+	// DefaultMinPeriodicInterval is the shortest interval periodics may run at unless configured
+	// otherwise, guarding against typos like 5s.
+	DefaultMinPeriodicInterval = 5 * time.Minute
+	// longPeriodicInterval is the interval above which a warning is emitted, as it likely indicates a
+	// units mistake.
+	longPeriodicInterval = 30 * 24 * time.Hour
+
+	// maxRetries bounds the retries of a job, so a broken job cannot hog the clusters.
+	maxRetries = 5
+
+	// maxJobNameLength is the maximum length of a generated job name, as it is used as a label value.
+	maxJobNameLength = 63
+
 	variableSubstitutionFormat = `\$\([_a-zA-Z0-9.-]+(\.[_a-zA-Z0-9.-]+)*\)`
+
+	kubernetesVersionFormat = `^[0-9]+\.[0-9]+(\.[0-9]+)?$`
+
+	tideQueryLabelFormat = `^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	releaseBranchFormat  = `^release-[0-9]+\.[0-9]+$`
+	gcsBucketFormat      = `^[a-z0-9][-_.a-z0-9]{1,61}[a-z0-9]$`
+	// imageReferenceFormat matches [registry[:port]/]path[:tag][@digest].
+	imageReferenceFormat = `^[a-zA-Z0-9][-.a-zA-Z0-9]*(:[0-9]+)?(/[a-z0-9]+([._-][a-z0-9]+)*)+(:[\w][\w.-]{0,127})?(@sha256:[a-f0-9]{64})?$`
+	// importPathFormat matches Go import paths of repos, i.e. a domain followed by at least one path element.
+	importPathFormat = `^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)+(/[A-Za-z0-9_.~-]+)+$`
 )
 
-var variableSubstitutionRegex = regexp.MustCompile(variableSubstitutionFormat)
+var (
+	variableSubstitutionRegex = regexp.MustCompile(variableSubstitutionFormat)
+	tideQueryLabelRegex       = regexp.MustCompile(tideQueryLabelFormat)
+	kubernetesVersionRegex    = regexp.MustCompile(kubernetesVersionFormat)
+	releaseBranchRegex        = regexp.MustCompile(releaseBranchFormat)
+	gcsBucketRegex            = regexp.MustCompile(gcsBucketFormat)
+	imageReferenceRegex       = regexp.MustCompile(imageReferenceFormat)
+	importPathRegex           = regexp.MustCompile(importPathFormat)
+
+	// defaultKnownLenses are the lenses built into Spyglass.
+	defaultKnownLenses = []string{"buildlog", "coverage", "html", "junit", "links", "metadata", "podinfo", "restcoverage"}
+
+	// retryConditions are the failures the retry controller can rerun a job on.
+	retryConditions = []string{"evicted", "image-pull", "node-lost", "scheduling-timeout"}
+
+	// imagePullPolicies are the valid image pull policies of the containers of a job.
+	imagePullPolicies = []string{string(v1.PullAlways), string(v1.PullIfNotPresent), string(v1.PullNever)}
+
+	// artifactRetentions are the retentions of artifacts the GCS lifecycle tooling implements.
+	artifactRetentions = []string{"7d", "30d", "90d", "365d", "forever"}
+
+	// defaultRunWindows are the named windows periodics may run in, mapped to their cron expressions. Times are UTC.
+	defaultRunWindows = map[string]string{
+		"nightly":        "0 2 * * *",
+		"weekday-nights": "0 2 * * 1-5",
+		"weekends":       "0 6 * * 0,6",
+	}
+
+	// supportedPlatforms are the os/arch combinations node pools are available for.
+	supportedPlatforms = sets.NewString(OSLinux+"/"+ArchAMD64, OSLinux+"/"+ArchARM64, OSWindows+"/"+ArchAMD64)
+
+	// prowEnv are the env vars Prow sets in the test container of decorated jobs.
+	prowEnv = sets.NewString("ARTIFACTS", "BUILD_ID", "BUILD_NUMBER", "CI", "GOPATH", "JOB_NAME", "JOB_SPEC", "JOB_TYPE",
+		"PROW_JOB_ID", "PULL_BASE_REF", "PULL_BASE_SHA", "PULL_NUMBER", "PULL_PULL_SHA", "PULL_REFS", "REPO_NAME", "REPO_OWNER")
+)
 
 type Client struct {
 	GlobalConfig GlobalConfig
+
+	// MaxMatrixExpansion is the maximum number of jobs a single job's matrix may expand into.
+	// A value of 0 disables the limit. It can be overridden per file with max_matrix_expansion.
+	MaxMatrixExpansion int
+
+	// JobNameWarningLength is the length of the longest generated name of a job above which a warning
+	// is emitted, before the name reaches the hard limit. A value of 0 disables the warning.
+	JobNameWarningLength int
+
+	// StrictVariables makes generation fail if a job references a variable that is neither a matrix
+	// dimension nor an env var of the job once expanded.
+	StrictVariables bool
+
+	// FeatureFlags overrides the values of the feature flags declared in the global config.
+	FeatureFlags map[string]bool
+
+	// RequirementHandlers registers custom requirements by name, for tools embedding the generator to
+	// add requirements that cannot be expressed as presets. Presets of the same name are rejected.
+	RequirementHandlers map[string]RequirementHandler
+
+	// ObservabilityLabels labels every job with a stable job id, its repo and its type, for the tracing
+	// pipeline to correlate its runs.
+	ObservabilityLabels bool
 }
 
 type GlobalConfig struct {
@@ -75,9 +278,85 @@ type GlobalConfig struct {
 
 	PathAliases map[string]string `json:"path_aliases,omitempty"`
 
+	// DefaultBranches maps orgs to the branch the jobs of their repos are generated for when a file
+	// does not set branches, defaulting to master.
+	DefaultBranches map[string]string `json:"default_branches,omitempty"`
+
+	// BootstrappingRepos flags the repos, keyed by <org>/<repo>, whose presubmits are all generated as
+	// optional until branch protection is configured for them.
+	BootstrappingRepos map[string]bool `json:"bootstrapping_repos,omitempty"`
+
+	// Lockfile is the path, relative to the global config, of the lockfile pinning the repos that jobs
+	// clone with <org>/<repo>@lockfile to a branch and SHA, so all of them are bumped at once.
+	Lockfile string `json:"lockfile,omitempty"`
+	// LockedRefs are the refs of the lockfile, keyed by <org>/<repo>.
+	LockedRefs map[string]LockedRef `json:"-"`
+
 	Cluster      string            `json:"cluster,omitempty"`
 	NodeSelector map[string]string `json:"node_selector,omitempty"`
 
+	// ClusterPool is the set of clusters cluster agnostic jobs are spread across.
+	ClusterPool []string `json:"cluster_pool,omitempty"`
+	// ClusterWeights are the relative capacities of the clusters of the pool, cluster agnostic jobs
+	// being spread across them proportionally. Clusters without a weight have a weight of 1.
+	ClusterWeights map[string]int `json:"cluster_weights,omitempty"`
+
+	// MaxDecorationResources caps the requests and limits of the decoration containers of the jobs, so
+	// they stay schedulable on the nodes of the clusters.
+	MaxDecorationResources v1.ResourceList `json:"max_decoration_resources,omitempty"`
+
+	// AutomountServiceAccountToken sets automountServiceAccountToken on the pods of the jobs, per
+	// cluster. Once set, jobs on clusters without an entry do not mount the token.
+	AutomountServiceAccountToken map[string]bool `json:"automount_service_account_token,omitempty"`
+
+	// ImagePoller overrides the image of the init container waiting for the required_image of jobs.
+	ImagePoller string `json:"image_poller,omitempty"`
+
+	// SpecHash annotates every job with the hash of its generated spec, for rehearsal tooling.
+	SpecHash bool `json:"spec_hash,omitempty"`
+
+	// BehaviorHash annotates every job with the hash of what it runs and when, for CI selection tooling
+	// to find the jobs whose behavior changed.
+	BehaviorHash bool `json:"behavior_hash,omitempty"`
+
+	// ConcurrencyPools maps the names of concurrency pools to their budget, the total max_concurrency
+	// divided between the jobs of the pool, e.g. for jobs sharing an external quota.
+	ConcurrencyPools map[string]int `json:"concurrency_pools,omitempty"`
+
+	// RunWindows adds named windows periodics may run in, mapped to their cron expressions, to the
+	// default ones. They take precedence over default windows of the same name.
+	RunWindows map[string]string `json:"run_windows,omitempty"`
+
+	// KnownLenses are the Spyglass lenses jobs may hint, defaulting to the lenses built into Spyglass.
+	KnownLenses []string `json:"known_lenses,omitempty"`
+
+	// FeatureFlags declares the feature flags jobs can reference, with their default values.
+	FeatureFlags map[string]bool `json:"feature_flags,omitempty"`
+
+	// MaxTerminationGracePeriodSeconds caps the termination grace period of the jobs, as long grace
+	// periods delay the scale down of the clusters. A value of 0 disables the cap.
+	MaxTerminationGracePeriodSeconds int64 `json:"max_termination_grace_period_seconds,omitempty"`
+
+	// MinPeriodicInterval is the shortest interval periodics may run at, defaulting to
+	// DefaultMinPeriodicInterval. A value of 0s disables the guard.
+	MinPeriodicInterval string `json:"min_periodic_interval,omitempty"`
+
+	// NodeSizes maps node sizes jobs can request with node_size to the node selector and tolerations
+	// scheduling them onto nodes of that capacity, abstracting the label scheme of the clusters.
+	NodeSizes map[string]NodeSize `json:"node_sizes,omitempty"`
+
+	// HostNetworkClusters restricts the jobs using the host network to the given clusters. If unset,
+	// jobs on any cluster may use it.
+	HostNetworkClusters []string `json:"host_network_clusters,omitempty"`
+
+	// RuntimeClassOverheads maps runtime classes to the pod overhead of jobs using them, unless the
+	// jobs set their own overhead.
+	RuntimeClassOverheads map[string]v1.ResourceList `json:"runtime_class_overheads,omitempty"`
+
+	// QuotaScopeLabel is the label every job is stamped with to select its ResourceQuota.
+	// Its value is the quota_scope of the file, defaulting to <org>-<repo>.
+	QuotaScopeLabel string `json:"quota_scope_label,omitempty"`
+
 	TestgridConfig TestgridConfig `json:"testgrid_config,omitempty"`
 
 	Annotations map[string]string `json:"annotations,omitempty"`
@@ -86,23 +365,38 @@ type GlobalConfig struct {
 	ResourcePresets    map[string]v1.ResourceRequirements `json:"resources,omitempty"`
 	BaseRequirements   []string                           `json:"base_requirements,omitempty"`
 	RequirementPresets map[string]RequirementPreset       `json:"requirement_presets,omitempty"`
+	EnvPresets         map[string][]v1.EnvVar             `json:"env_presets,omitempty"`
+
+	// ImagePullSecretsPresets maps preset names to the image pull secrets of private registries,
+	// referenced by jobs with image_pull_secrets_presets.
+	ImagePullSecretsPresets map[string][]string `json:"image_pull_secrets_presets,omitempty"`
 }
 
 type TestgridConfig struct {
 	Enabled            bool   `json:"enabled,omitempty"`
 	AlertEmail         string `json:"alert_email,omitempty"`
 	NumFailuresToAlert string `json:"num_failures_to_alert,omitempty"`
+	// TeamAlertEmails maps the owners of jobs to the email their postsubmit and periodic alerts
+	// are sent to, instead of AlertEmail.
+	TeamAlertEmails map[string]string `json:"team_alert_emails,omitempty"`
 }
 
 type JobsConfig struct {
 	Jobs []Job `json:"jobs,omitempty"`
+	// JobsCSV is the path, relative to this file, of a CSV of simple jobs appended to Jobs. See
+	// ReadJobsCSV for its format.
+	JobsCSV string `json:"jobs_csv,omitempty"`
 
 	Repo     string   `json:"repo,omitempty"`
 	Org      string   `json:"org,omitempty"`
 	Branches []string `json:"branches,omitempty"`
 	CloneURI string   `json:"clone_uri,omitempty"`
 
-	Matrix map[string][]string `json:"matrix,omitempty"`
+	Matrix             map[string][]string `json:"matrix,omitempty"`
+	MaxMatrixExpansion int                 `json:"max_matrix_expansion,omitempty"`
+	// MatrixFile is the path, relative to this file, of a shared matrix definition. The dimensions
+	// of Matrix take precedence over the ones of the shared matrix.
+	MatrixFile string `json:"matrix_file,omitempty"`
 
 	Env                     []v1.EnvVar `json:"env,omitempty"`
 	Image                   string      `json:"image,omitempty"`
@@ -112,8 +406,22 @@ type JobsConfig struct {
 	Interval string `json:"interval,omitempty"`
 	Cron     string `json:"cron,omitempty"`
 
+	// ContextPrefix prefixes the GitHub status contexts of all the presubmits of the file, so that
+	// they are grouped together in the pull request checks.
+	ContextPrefix string `json:"context_prefix,omitempty"`
+
+	// Namespace is the namespace the pods of the jobs run in, e.g. a team namespace of a multi-tenant
+	// cluster. Defaults to the pod namespace of the Prow config. Can be overridden per job.
+	Namespace string `json:"namespace,omitempty"`
+
 	Cluster      string            `json:"cluster,omitempty"`
 	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	// NodeSelectorMergeStrategy is either replace (the default) or merge.
+	NodeSelectorMergeStrategy string `json:"node_selector_merge_strategy,omitempty"`
+
+	// ResourceMode selects which of the requests and limits of the resource presets are set, one of
+	// both (the default), requests or limits. Can be overridden per job.
+	ResourceMode string `json:"resource_mode,omitempty"`
 
 	Annotations map[string]string `json:"annotations,omitempty"`
 	Labels      map[string]string `json:"labels,omitempty"`
@@ -121,67 +429,485 @@ type JobsConfig struct {
 	ResourcePresets    map[string]v1.ResourceRequirements `json:"resources,omitempty"`
 	Requirements       []string                           `json:"requirements,omitempty"`
 	RequirementPresets map[string]RequirementPreset       `json:"requirement_presets,omitempty"`
+	EnvPresets         map[string][]v1.EnvVar             `json:"env_presets,omitempty"`
+
+	RerunAuthConfig *prowjob.RerunAuthConfig `json:"rerun_auth_config,omitempty"`
+
+	Privileged   *bool  `json:"privileged,omitempty"`
+	RunAsUser    *int64 `json:"run_as_user,omitempty"`
+	RunAsGroup   *int64 `json:"run_as_group,omitempty"`
+	RunAsNonRoot *bool  `json:"run_as_non_root,omitempty"`
+	FSGroup      *int64 `json:"fs_group,omitempty"`
+
+	GCSLogBucket string `json:"gcs_log_bucket,omitempty"`
+
+	UtilityImages *prowjob.UtilityImages `json:"utility_images,omitempty"`
+
+	Upload *UploadSettings `json:"upload,omitempty"`
+
+	// DecorationResources are the resources of the clonerefs, initupload, place_entrypoint and sidecar
+	// containers added by decoration, e.g. for the sidecar of jobs uploading large artifacts.
+	DecorationResources *prowjob.Resources `json:"decoration_resources,omitempty"`
+
+	ResultsReporter *ResultsReporter `json:"results_reporter,omitempty"`
+
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty"`
+
+	RestartPolicy string `json:"restart_policy,omitempty"`
+
+	TerminationMessagePolicy string `json:"termination_message_policy,omitempty"`
+
+	// ArtifactRetention maps job types to the retention of the artifacts of the jobs of that type, e.g.
+	// for presubmit artifacts to expire quickly. Jobs can override it with their own retention.
+	ArtifactRetention map[string]string `json:"artifact_retention,omitempty"`
+
+	// PresubmitPriorityClass, PostsubmitPriorityClass and PeriodicPriorityClass are the priority
+	// classes of the pods of the jobs of each type, e.g. for presubmits to be scheduled before periodics.
+	PresubmitPriorityClass  *string `json:"presubmit_priority_class,omitempty"`
+	PostsubmitPriorityClass *string `json:"postsubmit_priority_class,omitempty"`
+	PeriodicPriorityClass   *string `json:"periodic_priority_class,omitempty"`
+
+	ReadinessGates []string `json:"readiness_gates,omitempty"`
+
+	ShareProcessNamespace *bool `json:"share_process_namespace,omitempty"`
+
+	EnableServiceLinks *bool `json:"enable_service_links,omitempty"`
+
+	TerminationGracePeriodSeconds *int64 `json:"termination_grace_period_seconds,omitempty"`
+
+	// ActiveDeadlineBuffer is added to the timeout of the jobs, and their upload grace period, to
+	// derive the active deadline of their pods. If unset, no deadline is derived.
+	ActiveDeadlineBuffer *prowjob.Duration `json:"active_deadline_buffer,omitempty"`
+
+	// CloneDepth and SkipSubmodules are the default clone options of the jobs.
+	CloneDepth     *int  `json:"clone_depth,omitempty"`
+	SkipSubmodules *bool `json:"skip_submodules,omitempty"`
+
+	Owner string `json:"owner,omitempty"`
+
+	// PathAlias is the import path the repo is cloned to, overriding the path alias of the org for
+	// repos whose module path does not follow the org convention.
+	PathAlias string `json:"path_alias,omitempty"`
+
+	ServiceAccountName string `json:"service_account_name,omitempty"`
+
+	MeshInject *bool `json:"mesh_inject,omitempty"`
+
+	// QuotaScope overrides the default <org>-<repo> quota scope, e.g. for repos sharing a quota.
+	QuotaScope string `json:"quota_scope,omitempty"`
 }
 
 type Job struct {
-	Name           string            `json:"name,omitempty"`
-	Command        []string          `json:"command,omitempty"`
-	Types          []string          `json:"types,omitempty"`
-	Timeout        *prowjob.Duration `json:"timeout,omitempty"`
-	Repos          []string          `json:"repos,omitempty"`
-	Regex          string            `json:"regex,omitempty"`
-	MaxConcurrency int               `json:"max_concurrency,omitempty"`
+	Name    string            `json:"name,omitempty"`
+	Command []string          `json:"command,omitempty"`
+	Types   []string          `json:"types,omitempty"`
+	Timeout *prowjob.Duration `json:"timeout,omitempty"`
+	// PresubmitTimeout, PostsubmitTimeout and PeriodicTimeout override Timeout for the jobs of the
+	// respective type.
+	PresubmitTimeout  *prowjob.Duration `json:"presubmit_timeout,omitempty"`
+	PostsubmitTimeout *prowjob.Duration `json:"postsubmit_timeout,omitempty"`
+	PeriodicTimeout   *prowjob.Duration `json:"periodic_timeout,omitempty"`
+	Repos             []string          `json:"repos,omitempty"`
+	Regex             string            `json:"regex,omitempty"`
+	// Paths are the files and directories, relative to the root of the repo, the job runs on changes
+	// of. They are compiled into the run_if_changed regex, and cannot be set along Regex.
+	Paths []string `json:"paths,omitempty"`
+	// PresubmitRegex and PostsubmitRegex override Regex for the jobs of the respective type.
+	PresubmitRegex  string `json:"presubmit_regex,omitempty"`
+	PostsubmitRegex string `json:"postsubmit_regex,omitempty"`
+	// PostsubmitName overrides Name for the postsubmit of the job, e.g. for a postsubmit doing
+	// something else with the results of the presubmit.
+	PostsubmitName string `json:"postsubmit_name,omitempty"`
+	MaxConcurrency int    `json:"max_concurrency,omitempty"`
+	// ConcurrencyPool is the concurrency pool of the global config the max_concurrency of the job is
+	// derived from.
+	ConcurrencyPool string `json:"concurrency_pool,omitempty"`
+	WorkingDir      string `json:"working_dir,omitempty"`
+	TideQueryLabel  string `json:"tide_query_label,omitempty"`
+	// TTY and Stdin allocate a TTY and keep stdin open for the test container, e.g. for debugging jobs.
+	TTY   bool `json:"tty,omitempty"`
+	Stdin bool `json:"stdin,omitempty"`
+
+	// SkipDraft marks the presubmit of the job not to run on draft pull requests, e.g. for expensive
+	// jobs, with SkipDraftAnnotation. It does not apply to the other types of the job.
+	SkipDraft bool `json:"skip_draft,omitempty"`
+	// Context is the GitHub status context reported for the presubmit, defaulting to the job name.
+	Context string `json:"context,omitempty"`
 
 	Env                     []v1.EnvVar `json:"env,omitempty"`
 	Image                   string      `json:"image,omitempty"`
 	ImagePullPolicy         string      `json:"image_pull_policy,omitempty"`
 	DisableReleaseBranching bool        `json:"disable_release_branching,omitempty"`
+	// BranchImages overrides the image of the job for the given branches.
+	BranchImages            map[string]string `json:"branch_images,omitempty"`
+	ReleaseBranchExclusions []string          `json:"release_branch_exclusions,omitempty"`
 
 	Interval string `json:"interval,omitempty"`
 	Cron     string `json:"cron,omitempty"`
 
+	// Namespace overrides the namespace of the file for the pod of the job.
+	Namespace string `json:"namespace,omitempty"`
+
 	Cluster      string            `json:"cluster,omitempty"`
 	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	// NodeSize is the node size of the global config the job is scheduled onto, merged into its node selector.
+	NodeSize string `json:"node_size,omitempty"`
+	// NodeSelectorMergeStrategy overrides the strategy of the file for this job.
+	NodeSelectorMergeStrategy string `json:"node_selector_merge_strategy,omitempty"`
+	// ClusterAgnostic jobs are assigned a cluster from the global cluster pool based on their name,
+	// taking precedence over Cluster.
+	ClusterAgnostic bool `json:"cluster_agnostic,omitempty"`
 
 	Annotations map[string]string `json:"annotations,omitempty"`
 	Labels      map[string]string `json:"labels,omitempty"`
+	// PresubmitLabels and PostsubmitLabels are added on top of Labels to the jobs of the respective type.
+	PresubmitLabels  map[string]string `json:"presubmit_labels,omitempty"`
+	PostsubmitLabels map[string]string `json:"postsubmit_labels,omitempty"`
 
-	Resource     string   `json:"resources,omitempty"`
+	Resource string `json:"resources,omitempty"`
+	// ResourceMode overrides the resource mode of the file for this job.
+	ResourceMode string   `json:"resource_mode,omitempty"`
 	Modifiers    []string `json:"modifiers,omitempty"`
 	Requirements []string `json:"requirements,omitempty"`
+	// EnvPresets are merged into the env of the job, below the env of the job and above the env of the file.
+	EnvPresets []string `json:"env_presets,omitempty"`
+
+	// KubernetesVersions expand the job into one job per Kubernetes version, e.g. for e2e tests against
+	// several clusters. Each job is suffixed with -k8s-<version> and has the version in its
+	// KUBERNETES_VERSION env.
+	KubernetesVersions []string `json:"kubernetes_versions,omitempty"`
+
+	// Shards expands the job into the given number of jobs suffixed with -shard-<index>, each running
+	// the shard of the test suite given by its SHARD_INDEX and SHARD_COUNT env. Only postsubmits and
+	// periodics can be sharded.
+	Shards int `json:"shards,omitempty"`
+
+	// Architectures and OperatingSystems expand the job into one job per combination of them, suffixed
+	// with the architecture and operating system unless they are the amd64 and linux defaults.
+	Architectures    []string `json:"architectures,omitempty"`
+	OperatingSystems []string `json:"operating_systems,omitempty"`
+	// ArchResources overrides Resource for the jobs expanded for the given architectures.
+	ArchResources map[string]string `json:"arch_resources,omitempty"`
+	// Arch and OS are the platform of a job expanded from Architectures and OperatingSystems.
+	Arch string `json:"-"`
+	OS   string `json:"-"`
+
+	// OptionalIfFlag makes the presubmit optional if the named feature flag is enabled.
+	OptionalIfFlag string `json:"optional_if_flag,omitempty"`
+
+	// OptionalMatrix maps matrix dimensions to values that make the jobs expanded with them optional.
+	OptionalMatrix map[string][]string `json:"optional_matrix,omitempty"`
+
+	// Schedules fans a periodic job out into one periodic per schedule.
+	// If set, the cron and interval of the job are ignored.
+	Schedules []Schedule `json:"schedules,omitempty"`
+	// RunWindow is the name of a run window the periodic is scheduled in, instead of setting cron.
+	RunWindow string `json:"run_window,omitempty"`
+
+	RerunAuthConfig *prowjob.RerunAuthConfig `json:"rerun_auth_config,omitempty"`
+
+	// Privileged defaults to true if unset.
+	Privileged   *bool  `json:"privileged,omitempty"`
+	RunAsUser    *int64 `json:"run_as_user,omitempty"`
+	RunAsGroup   *int64 `json:"run_as_group,omitempty"`
+	RunAsNonRoot *bool  `json:"run_as_non_root,omitempty"`
+	FSGroup      *int64 `json:"fs_group,omitempty"`
+
+	// GCSLogBucket may contain {org}, {repo} and {branch} placeholders.
+	GCSLogBucket string `json:"gcs_log_bucket,omitempty"`
+
+	UtilityImages *prowjob.UtilityImages `json:"utility_images,omitempty"`
+
+	// Upload overrides the upload settings of the file for the job.
+	Upload *UploadSettings `json:"upload,omitempty"`
+
+	// DecorationResources overrides the resources of the decoration containers of the file for the job.
+	DecorationResources *prowjob.Resources `json:"decoration_resources,omitempty"`
+
+	// ResultsReporter opts the job into reporting its results to the internal results dashboard,
+	// overriding the reporter of the file.
+	ResultsReporter *ResultsReporter `json:"results_reporter,omitempty"`
+
+	// RetryPolicy has the retry controller rerun the job on infrastructure failures, overriding the
+	// retry policy of the file.
+	RetryPolicy *RetryPolicy `json:"retry_policy,omitempty"`
+
+	// OauthTokenSecret is the secret holding the GitHub OAuth token used by decoration, e.g. for jobs
+	// calling the GitHub API.
+	OauthTokenSecret *prowjob.OauthTokenSecret `json:"oauth_token_secret,omitempty"`
+
+	// ImagePullSecrets are the names of the secrets the images of the pod are pulled with.
+	ImagePullSecrets []string `json:"image_pull_secrets,omitempty"`
+	// ImagePullSecretsPresets are merged into the image pull secrets of the job, before its own.
+	ImagePullSecretsPresets []string `json:"image_pull_secrets_presets,omitempty"`
+
+	// RestartPolicy of the pod. If unset, Prow's default of Never is used.
+	RestartPolicy string `json:"restart_policy,omitempty"`
+
+	// TerminationMessagePolicy of the test container, e.g. FallbackToLogsOnError for the last lines of
+	// the logs of failed jobs to show in the pod status. If unset, the Kubernetes default of File is used.
+	TerminationMessagePolicy string `json:"termination_message_policy,omitempty"`
+
+	// ArtifactRetention is how long the artifacts of the jobs of all types are kept, overriding the
+	// retention of the file for the job types.
+	ArtifactRetention string `json:"artifact_retention,omitempty"`
+
+	// ReadinessGates are the condition types of the readiness gates of the pod, for clusters with
+	// controllers gating the readiness of pods.
+	ReadinessGates []string `json:"readiness_gates,omitempty"`
+
+	// ShareProcessNamespace makes the containers of the pod share a process namespace, e.g. for a
+	// sidecar to inspect the test process.
+	ShareProcessNamespace *bool `json:"share_process_namespace,omitempty"`
+
+	// EnableServiceLinks controls the injection of env vars for the services of the namespace into the
+	// pod. If unset, the Kubernetes default of injecting them is kept.
+	EnableServiceLinks *bool `json:"enable_service_links,omitempty"`
+
+	// TerminationGracePeriodSeconds of the pod. If unset, the Kubernetes default is used.
+	TerminationGracePeriodSeconds *int64 `json:"termination_grace_period_seconds,omitempty"`
+
+	// ActiveDeadlineSeconds of the pod. If unset, it is derived from the timeout of the job when the
+	// file sets active_deadline_buffer, so that the pod is reaped even if decoration fails to stop it.
+	ActiveDeadlineSeconds *int64 `json:"active_deadline_seconds,omitempty"`
+
+	// Lifecycle sets the lifecycle hooks of the test container, e.g. to release external resources
+	// on eviction.
+	Lifecycle *Lifecycle `json:"lifecycle,omitempty"`
+
+	// PriorityClassName of the pod, overriding the priority class of the file for the job type.
+	PriorityClassName string `json:"priority_class_name,omitempty"`
+
+	// HostNetwork runs the pod in the network namespace of the node, e.g. for low level networking
+	// tests. Defaults to false.
+	HostNetwork *bool `json:"host_network,omitempty"`
+	// DNSPolicy of the pod. It defaults to ClusterFirstWithHostNet for jobs using the host network, for
+	// them to still resolve cluster services, and to the Kubernetes default otherwise.
+	DNSPolicy string `json:"dns_policy,omitempty"`
+
+	// RuntimeClassName of the pod, e.g. for sandboxed runtimes.
+	RuntimeClassName string `json:"runtime_class_name,omitempty"`
+	// Overhead is the pod overhead of the runtime class, accounted for by the scheduler. It defaults
+	// to the overhead of the runtime class in the global config.
+	Overhead v1.ResourceList `json:"overhead,omitempty"`
+
+	// SkipCloning skips cloning any repo, for jobs not operating on source.
+	SkipCloning bool `json:"skip_cloning,omitempty"`
+
+	// CloneDepth makes the repos of the job shallow clones of the given depth. 0 clones the full history.
+	CloneDepth     *int  `json:"clone_depth,omitempty"`
+	SkipSubmodules *bool `json:"skip_submodules,omitempty"`
+
+	// Owner is the team owning the job.
+	Owner string `json:"owner,omitempty"`
+
+	// Aliases are former names of the job. Their /test commands keep triggering the job after a rename.
+	Aliases []string `json:"aliases,omitempty"`
+	// RequiredImage is an image, e.g. built by a postsubmit, the job waits for before running.
+	RequiredImage string `json:"required_image,omitempty"`
+
+	// LensHints lists the Spyglass lenses that should render the artifacts of the job.
+	LensHints []string `json:"lens_hints,omitempty"`
+
+	// CensorSecrets makes Prow decoration censor the values of the secrets mounted into the test
+	// container from the job logs and artifacts.
+	CensorSecrets bool `json:"censor_secrets,omitempty"`
+
+	ServiceAccountName string `json:"service_account_name,omitempty"`
+	// PathAlias overrides the path_alias of the file for the job.
+	PathAlias string `json:"path_alias,omitempty"`
+	// MeshInject sets the sidecar.istio.io/inject annotation, for jobs running on mesh enabled clusters.
+	MeshInject *bool `json:"mesh_inject,omitempty"`
+	// ProjectedToken requests a projected service account token, e.g. for OIDC authentication.
+	ProjectedToken *ProjectedToken `json:"projected_token,omitempty"`
+}
+
+// ResultsReporter configures the reporting of the results of a job to the internal results dashboard.
+type ResultsReporter struct {
+	// Endpoint is the URL the results are reported to.
+	Endpoint string `json:"endpoint,omitempty"`
+	// AuthSecret is the key of the secret holding the credentials of the endpoint.
+	AuthSecret *v1.SecretKeySelector `json:"auth_secret,omitempty"`
+}
+
+// RetryPolicy configures the reruns of a job by the retry controller.
+type RetryPolicy struct {
+	// MaxRetries is the number of times the job is rerun, at most 5.
+	MaxRetries int `json:"max_retries,omitempty"`
+	// RetryOn are the failures the job is rerun on, among evicted, image-pull, node-lost and
+	// scheduling-timeout.
+	RetryOn []string `json:"retry_on,omitempty"`
+}
+
+// UploadSettings configures how Prow decoration uploads the logs and artifacts of a job.
+type UploadSettings struct {
+	// GracePeriod is how long the test is given to terminate after the timeout, before uploading.
+	GracePeriod *prowjob.Duration `json:"grace_period,omitempty"`
+	// PathStrategy is the GCS path strategy, one of explicit, legacy or single. legacy and single
+	// require DefaultOrg and DefaultRepo.
+	PathStrategy string `json:"path_strategy,omitempty"`
+	DefaultOrg   string `json:"default_org,omitempty"`
+	DefaultRepo  string `json:"default_repo,omitempty"`
+	// MediaTypes maps artifact extensions to the media type they are uploaded with.
+	MediaTypes map[string]string `json:"media_types,omitempty"`
+}
+
+// ProjectedToken defines a service account token projected into the test container.
+type ProjectedToken struct {
+	Audience          string `json:"audience,omitempty"`
+	ExpirationSeconds *int64 `json:"expiration_seconds,omitempty"`
+	// MountPath defaults to /var/run/secrets/tokens. The token is the file "token" in it.
+	MountPath string `json:"mount_path,omitempty"`
+}
+
+// LockedRef pins a repo of the lockfile to a SHA of a branch.
+type LockedRef struct {
+	// Branch is the base ref of the repo, defaulting to the branch of the job.
+	Branch string `json:"branch,omitempty"`
+	SHA    string `json:"sha,omitempty"`
+}
+
+// NodeSize schedules the jobs requesting it onto nodes of a given capacity.
+type NodeSize struct {
+	NodeSelector map[string]string `json:"node_selector,omitempty"`
+	Tolerations  []v1.Toleration   `json:"tolerations,omitempty"`
+}
+
+// Lifecycle are the lifecycle hooks of the test container.
+type Lifecycle struct {
+	// PreStop is the command run in the test container before it is stopped. Unless the job sets
+	// termination_grace_period_seconds, the pod is given DefaultPreStopGracePeriodSeconds to run it.
+	PreStop []string `json:"pre_stop,omitempty"`
+}
+
+// Schedule defines one of the schedules a periodic job is generated for.
+type Schedule struct {
+	// Name is appended to the job name to keep the generated periodics unique.
+	Name     string `json:"name,omitempty"`
+	Cron     string `json:"cron,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	// Args are appended to the command of the job.
+	Args []string `json:"args,omitempty"`
 }
 
 func ReadGlobalSettings(file string) GlobalConfig {
+	globalSettings, err := LoadGlobalSettings(file)
+	if err != nil {
+		exit(err, "")
+	}
+	return globalSettings
+}
+
+// LoadGlobalSettings reads the global config like ReadGlobalSettings, returning an error instead of
+// exiting if it cannot be read.
+func LoadGlobalSettings(file string) (GlobalConfig, error) {
 	yamlFile, err := ioutil.ReadFile(file)
 	if err != nil {
-		exit(err, "failed to read "+file)
+		return GlobalConfig{}, fmt.Errorf("failed to read %v: %v", file, err)
 	}
 	globalSettings := GlobalConfig{
 		AutogenHeader: DefaultAutogenHeader,
 	}
 	if err := yaml.Unmarshal(yamlFile, &globalSettings); err != nil {
-		exit(err, "failed to unmarshal "+file)
+		return GlobalConfig{}, fmt.Errorf("failed to unmarshal %v: %v", file, err)
+	}
+	if globalSettings.Lockfile != "" {
+		lockfile := filepath.Join(filepath.Dir(file), globalSettings.Lockfile)
+		lockedRefs, err := readLockfile(lockfile)
+		if err != nil {
+			return GlobalConfig{}, fmt.Errorf("failed to read the lockfile %v: %v", lockfile, err)
+		}
+		globalSettings.LockedRefs = lockedRefs
 	}
 
-	return globalSettings
+	return globalSettings, nil
+}
+
+// readLockfile reads the refs of the lockfile, keyed by <org>/<repo>.
+func readLockfile(file string) (map[string]LockedRef, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]LockedRef{}
+	if err := yaml.Unmarshal(bs, &refs); err != nil {
+		return nil, err
+	}
+	return refs, nil
 }
 
 // Reads the jobs yaml
 func (cli *Client) ReadJobsConfig(file string) JobsConfig {
+	jobsConfig, err := cli.LoadJobsConfig(file)
+	if err != nil {
+		exit(err, "")
+	}
+	return jobsConfig
+}
+
+// LoadJobsConfig reads the jobs yaml like ReadJobsConfig, returning an error instead of exiting if
+// it cannot be read.
+func (cli *Client) LoadJobsConfig(file string) (JobsConfig, error) {
 	yamlFile, err := ioutil.ReadFile(file)
 	if err != nil {
-		exit(err, "failed to read "+file)
+		return JobsConfig{}, fmt.Errorf("failed to read %v: %v", file, err)
 	}
 	jobsConfig := JobsConfig{}
 	if err := yaml.Unmarshal(yamlFile, &jobsConfig); err != nil {
-		exit(err, "failed to unmarshal "+file)
+		return JobsConfig{}, fmt.Errorf("failed to unmarshal %v: %v", file, err)
 	}
 
 	if len(jobsConfig.Branches) == 0 {
-		jobsConfig.Branches = []string{"master"}
+		jobsConfig.Branches = []string{defaultBranch(cli.GlobalConfig, jobsConfig.Org)}
+	}
+
+	if jobsConfig.MatrixFile != "" {
+		matrix, err := resolveMatrixFile(filepath.Join(filepath.Dir(file), jobsConfig.MatrixFile), jobsConfig.Matrix)
+		if err != nil {
+			return JobsConfig{}, fmt.Errorf("failed to resolve the matrix of %v: %v", file, err)
+		}
+		jobsConfig.Matrix = matrix
+	}
+
+	if jobsConfig.JobsCSV != "" {
+		csvFile := filepath.Join(filepath.Dir(file), jobsConfig.JobsCSV)
+		f, err := os.Open(csvFile)
+		if err != nil {
+			return JobsConfig{}, fmt.Errorf("failed to read %v: %v", csvFile, err)
+		}
+		jobs, err := ReadJobsCSV(csvFile, f)
+		_ = f.Close()
+		if err != nil {
+			return JobsConfig{}, fmt.Errorf("failed to read the jobs of %v: %v", file, err)
+		}
+		jobsConfig.Jobs = append(jobsConfig.Jobs, jobs...)
+	}
+
+	return resolveOverwrites(cli.GlobalConfig, jobsConfig), nil
+}
+
+// defaultBranch returns the branch the jobs of the org are generated for when a file does not set branches.
+func defaultBranch(globalConfig GlobalConfig, org string) string {
+	if branch := globalConfig.DefaultBranches[org]; branch != "" {
+		return branch
 	}
+	return "master"
+}
 
-	return resolveOverwrites(cli.GlobalConfig, jobsConfig)
+// resolveMatrixFile reads the shared matrix file and overlays the given matrix on top of it.
+func resolveMatrixFile(file string, matrix map[string][]string) (map[string][]string, error) {
+	yamlFile, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read matrix file %v: %v", file, err)
+	}
+	shared := map[string][]string{}
+	if err := yaml.Unmarshal(yamlFile, &shared); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal matrix file %v: %v", file, err)
+	}
+	for dim, values := range matrix {
+		shared[dim] = values
+	}
+	return shared, nil
 }
 
 func resolveOverwrites(globalConfig GlobalConfig, jobsConfig JobsConfig) JobsConfig {
@@ -204,6 +930,15 @@ func resolveOverwrites(globalConfig GlobalConfig, jobsConfig JobsConfig) JobsCon
 	}
 	jobsConfig.RequirementPresets = requirementPresets
 
+	envPresets := map[string][]v1.EnvVar{}
+	for k, v := range globalConfig.EnvPresets {
+		envPresets[k] = v
+	}
+	for k, v := range jobsConfig.EnvPresets {
+		envPresets[k] = v
+	}
+	jobsConfig.EnvPresets = envPresets
+
 	// Resolve jobsConfig -> job overwriting
 	for i, job := range jobsConfig.Jobs {
 		job.Annotations = mergeMaps(globalConfig.Annotations, jobsConfig.Annotations, job.Annotations)
@@ -212,14 +947,15 @@ func resolveOverwrites(globalConfig GlobalConfig, jobsConfig JobsConfig) JobsCon
 
 		job.Requirements = mergeSlices(globalConfig.BaseRequirements, job.Requirements, jobsConfig.Requirements)
 
-		nodeSelector := globalConfig.NodeSelector
-		if jobsConfig.NodeSelector != nil {
-			nodeSelector = jobsConfig.NodeSelector
+		if job.ResourceMode == "" {
+			job.ResourceMode = jobsConfig.ResourceMode
 		}
-		if job.NodeSelector != nil {
-			nodeSelector = job.NodeSelector
+
+		if job.NodeSelectorMergeStrategy == "" {
+			job.NodeSelectorMergeStrategy = jobsConfig.NodeSelectorMergeStrategy
 		}
-		job.NodeSelector = nodeSelector
+		job.NodeSelector = resolveNodeSelector(job.NodeSelectorMergeStrategy,
+			globalConfig.NodeSelector, jobsConfig.NodeSelector, job.NodeSelector)
 
 		cluster := globalConfig.Cluster
 		if jobsConfig.Cluster != "" {
@@ -230,6 +966,10 @@ func resolveOverwrites(globalConfig GlobalConfig, jobsConfig JobsConfig) JobsCon
 		}
 		job.Cluster = cluster
 
+		if job.Namespace == "" {
+			job.Namespace = jobsConfig.Namespace
+		}
+
 		image := jobsConfig.Image
 		if job.Image != "" {
 			image = job.Image
@@ -243,7 +983,7 @@ func resolveOverwrites(globalConfig GlobalConfig, jobsConfig JobsConfig) JobsCon
 		job.ImagePullPolicy = imagePullPolicy
 
 		interval := jobsConfig.Interval
-		if job.Interval != "" {
+		if job.Interval != "" || job.RunWindow != "" {
 			interval = job.Interval
 		}
 		job.Interval = interval
@@ -251,15 +991,227 @@ func resolveOverwrites(globalConfig GlobalConfig, jobsConfig JobsConfig) JobsCon
 		cronStr := jobsConfig.Cron
 		if job.Cron != "" {
 			cronStr = job.Cron
+		} else if window, ok := runWindows(globalConfig)[job.RunWindow]; ok {
+			cronStr = window
 		}
 		job.Cron = cronStr
 
+		if job.RerunAuthConfig == nil {
+			job.RerunAuthConfig = jobsConfig.RerunAuthConfig
+		}
+
+		if job.Privileged == nil {
+			job.Privileged = jobsConfig.Privileged
+		}
+		if job.RunAsUser == nil {
+			job.RunAsUser = jobsConfig.RunAsUser
+		}
+		if job.RunAsGroup == nil {
+			job.RunAsGroup = jobsConfig.RunAsGroup
+		}
+		if job.RunAsNonRoot == nil {
+			job.RunAsNonRoot = jobsConfig.RunAsNonRoot
+		}
+		if job.FSGroup == nil {
+			job.FSGroup = jobsConfig.FSGroup
+		}
+
+		if job.GCSLogBucket == "" {
+			job.GCSLogBucket = jobsConfig.GCSLogBucket
+		}
+
+		if job.UtilityImages == nil {
+			job.UtilityImages = jobsConfig.UtilityImages
+		}
+
+		if job.Upload == nil {
+			job.Upload = jobsConfig.Upload
+		}
+
+		if job.DecorationResources == nil {
+			job.DecorationResources = jobsConfig.DecorationResources
+		}
+
+		if job.ResultsReporter == nil {
+			job.ResultsReporter = jobsConfig.ResultsReporter
+		}
+
+		if job.RetryPolicy == nil {
+			job.RetryPolicy = jobsConfig.RetryPolicy
+		}
+
+		if job.RestartPolicy == "" {
+			job.RestartPolicy = jobsConfig.RestartPolicy
+		}
+
+		if job.TerminationMessagePolicy == "" {
+			job.TerminationMessagePolicy = jobsConfig.TerminationMessagePolicy
+		}
+
+		if len(job.ReadinessGates) == 0 {
+			job.ReadinessGates = jobsConfig.ReadinessGates
+		}
+
+		if job.ShareProcessNamespace == nil {
+			job.ShareProcessNamespace = jobsConfig.ShareProcessNamespace
+		}
+
+		if job.EnableServiceLinks == nil {
+			job.EnableServiceLinks = jobsConfig.EnableServiceLinks
+		}
+
+		if job.TerminationGracePeriodSeconds == nil {
+			job.TerminationGracePeriodSeconds = jobsConfig.TerminationGracePeriodSeconds
+		}
+
+		if job.CloneDepth == nil {
+			job.CloneDepth = jobsConfig.CloneDepth
+		}
+		if job.SkipSubmodules == nil {
+			job.SkipSubmodules = jobsConfig.SkipSubmodules
+		}
+
+		if job.Owner == "" {
+			job.Owner = jobsConfig.Owner
+		}
+
+		if job.ServiceAccountName == "" {
+			job.ServiceAccountName = jobsConfig.ServiceAccountName
+		}
+
+		if job.PathAlias == "" {
+			job.PathAlias = jobsConfig.PathAlias
+		}
+
+		if job.MeshInject == nil {
+			job.MeshInject = jobsConfig.MeshInject
+		}
+
 		jobsConfig.Jobs[i] = job
 	}
 
 	return jobsConfig
 }
 
+// resolveNodeSelector resolves the node selectors, ordered from the least to the most specific,
+// according to the merge strategy.
+func resolveNodeSelector(strategy string, nodeSelectors ...map[string]string) map[string]string {
+	if strategy == NodeSelectorMergeMerge {
+		merged := mergeMaps(nodeSelectors...)
+		if len(merged) == 0 {
+			return nil
+		}
+		return merged
+	}
+	var nodeSelector map[string]string
+	for _, ns := range nodeSelectors {
+		if ns != nil {
+			nodeSelector = ns
+		}
+	}
+	return nodeSelector
+}
+
+// longestJobName returns the longest name generated for the job, once expanded with the longest
+// matrix values and suffixed with the platform, schedule, repo, branch and job type.
+func longestJobName(job Job, jobsConfig JobsConfig) string {
+	platforms := []string{}
+	for _, system := range platformOperatingSystems(job) {
+		for _, arch := range platformArchitectures(job) {
+			platforms = append(platforms, platformSuffix(system, arch))
+		}
+	}
+	versions := make([]string, 0, len(job.KubernetesVersions))
+	for _, version := range job.KubernetesVersions {
+		versions = append(versions, kubernetesVersionSuffix(version))
+	}
+	shard := ""
+	if job.Shards > 0 {
+		shard = shardSuffix(job.Shards - 1)
+	}
+	expand := func(base string) string {
+		for _, exp := range getVarSubstitutionExpressions(base) {
+			dim := strings.TrimPrefix(exp, "matrix.")
+			base = replace(base, dim, longestString(jobsConfig.Matrix[dim]))
+		}
+		return base + longestString(versions) + shard + longestString(platforms)
+	}
+	base := expand(job.Name)
+	branches := make([]string, 0, len(jobsConfig.Branches))
+	for _, branch := range jobsConfig.Branches {
+		if branch != "master" {
+			branches = append(branches, "_"+branch)
+		}
+	}
+	suffix := "_" + jobsConfig.Repo + longestString(branches)
+
+	types := sets.NewString(job.Types...)
+	names := []string{}
+	if len(job.Types) == 0 || types.Has(TypePresubmit) {
+		names = append(names, base+suffix)
+	}
+	if len(job.Types) == 0 || types.Has(TypePostsubmit) {
+		names = append(names, expand(postsubmitName(job))+suffix+"_postsubmit")
+	}
+	if types.Has(TypePeriodic) {
+		schedules := make([]string, 0, len(job.Schedules))
+		for _, schedule := range job.Schedules {
+			if schedule.Name != "" {
+				schedules = append(schedules, "-"+schedule.Name)
+			}
+		}
+		names = append(names, base+longestString(schedules)+suffix+"_periodic")
+	}
+	return longestString(names)
+}
+
+// checkJobNameLength checks the longest name generated for the job fits in a label value.
+func checkJobNameLength(job Job, jobsConfig JobsConfig) error {
+	if name := longestJobName(job, jobsConfig); len(name) > maxJobNameLength {
+		return fmt.Errorf("job %v generates the name %v of %d characters, exceeding the limit of %d",
+			job.Name, name, len(name), maxJobNameLength)
+	}
+	return nil
+}
+
+// postsubmitName returns the base name of the postsubmit generated for the job.
+func postsubmitName(job Job) string {
+	if job.PostsubmitName != "" {
+		return job.PostsubmitName
+	}
+	return job.Name
+}
+
+// longestString returns the first longest string of the list.
+func longestString(strs []string) string {
+	longest := ""
+	for _, str := range strs {
+		if len(str) > len(longest) {
+			longest = str
+		}
+	}
+	return longest
+}
+
+// conflictingLabels returns an error for each label of the overlay set to a different value in the shared labels.
+func conflictingLabels(shared, overlay map[string]string, description string) []error {
+	var errs []error
+	for _, k := range sets.StringKeySet(overlay).List() {
+		if v, f := shared[k]; f && v != overlay[k] {
+			errs = append(errs, fmt.Errorf("%v sets label %v to %q, conflicting with %q from labels", description, k, overlay[k], v))
+		}
+	}
+	return errs
+}
+
+// featureFlag returns the value of the feature flag, overridden by the client if set.
+func (cli *Client) featureFlag(name string) bool {
+	if v, f := cli.FeatureFlags[name]; f {
+		return v
+	}
+	return cli.GlobalConfig.FeatureFlags[name]
+}
+
 // Writes the job yaml
 func WriteJobConfig(jobsConfig JobsConfig, file string) error {
 	bytes, err := yaml.Marshal(jobsConfig)
@@ -271,6 +1223,14 @@ func WriteJobConfig(jobsConfig JobsConfig, file string) error {
 }
 
 func (cli *Client) ValidateJobConfig(fileName string, jobsConfig JobsConfig) {
+	if err := cli.VerifyJobConfig(fileName, jobsConfig); err != nil {
+		exit(err, "validation failed")
+	}
+}
+
+// VerifyJobConfig validates the job config like ValidateJobConfig, returning the validation errors
+// instead of exiting on them.
+func (cli *Client) VerifyJobConfig(fileName string, jobsConfig JobsConfig) error {
 	var err error
 	if jobsConfig.Org == "" {
 		err = multierror.Append(err, fmt.Errorf("%s: org must be set", fileName))
@@ -278,26 +1238,194 @@ func (cli *Client) ValidateJobConfig(fileName string, jobsConfig JobsConfig) {
 	if jobsConfig.Repo == "" {
 		err = multierror.Append(err, fmt.Errorf("%s: repo must be set", fileName))
 	}
-
-	requirements := make([]string, 0)
-	for name := range jobsConfig.RequirementPresets {
-		requirements = append(requirements, name)
+	for _, class := range []struct {
+		field string
+		value *string
+	}{
+		{"presubmit_priority_class", jobsConfig.PresubmitPriorityClass},
+		{"postsubmit_priority_class", jobsConfig.PostsubmitPriorityClass},
+		{"periodic_priority_class", jobsConfig.PeriodicPriorityClass},
+	} {
+		if class.value != nil && *class.value == "" {
+			err = multierror.Append(err, fmt.Errorf("%s: %v must not be empty", fileName, class.field))
+		}
+	}
+	// The file-level default is checked on its own, as jobs overriding it do not report it.
+	if jobsConfig.RerunAuthConfig != nil && !hasRerunAuthorization(jobsConfig.RerunAuthConfig) {
+		err = multierror.Append(err, fmt.Errorf("%s: rerun_auth_config must allow anyone or at least one user or team", fileName))
+	}
+	for _, jobType := range sets.StringKeySet(jobsConfig.ArtifactRetention).List() {
+		if e := validate(jobType, []string{TypePresubmit, TypePostsubmit, TypePeriodic}, "artifact_retention job type"); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s: %v", fileName, e))
+		}
+		if e := validate(jobsConfig.ArtifactRetention[jobType], artifactRetentions, "artifact_retention"); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s: %v", fileName, e))
+		}
+	}
+	minInterval, e := minPeriodicInterval(cli.GlobalConfig)
+	if e != nil {
+		err = multierror.Append(err, e)
+	}
+
+	for _, orgRepo := range sets.StringKeySet(cli.GlobalConfig.BootstrappingRepos).List() {
+		if parts := strings.Split(orgRepo, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			err = multierror.Append(err, fmt.Errorf("bootstrapping_repos entry %v must be of the form <org>/<repo>", orgRepo))
+		}
+	}
+	for _, team := range sets.StringKeySet(cli.GlobalConfig.TestgridConfig.TeamAlertEmails).List() {
+		email := cli.GlobalConfig.TestgridConfig.TeamAlertEmails[team]
+		if a, e := mail.ParseAddress(email); e != nil || a.Address != email {
+			err = multierror.Append(err, fmt.Errorf("team_alert_emails of team %v has the malformed email %q", team, email))
+		}
+	}
+	for _, cluster := range sets.StringKeySet(cli.GlobalConfig.ClusterWeights).List() {
+		if w := cli.GlobalConfig.ClusterWeights[cluster]; w <= 0 {
+			err = multierror.Append(err, fmt.Errorf("cluster_weights of cluster %v must be positive, got %d", cluster, w))
+		}
+		if !sets.NewString(cli.GlobalConfig.ClusterPool...).Has(cluster) {
+			err = multierror.Append(err, fmt.Errorf("cluster_weights sets the weight of cluster %v outside of the cluster_pool", cluster))
+		}
+	}
+	for _, org := range sets.StringKeySet(cli.GlobalConfig.DefaultBranches).List() {
+		if cli.GlobalConfig.DefaultBranches[org] == "" {
+			err = multierror.Append(err, fmt.Errorf("default_branches of org %v must not be empty", org))
+		}
+	}
+
+	if cli.GlobalConfig.QuotaScopeLabel != "" {
+		for _, e := range validation.IsQualifiedName(cli.GlobalConfig.QuotaScopeLabel) {
+			err = multierror.Append(err, fmt.Errorf("quota_scope_label %q is not a valid label: %v", cli.GlobalConfig.QuotaScopeLabel, e))
+		}
+		scope := quotaScope(jobsConfig)
+		for _, e := range validation.IsValidLabelValue(scope) {
+			err = multierror.Append(err, fmt.Errorf("%s: quota scope %q is not a valid label value: %v", fileName, scope, e))
+		}
+	}
+
+	if cli.ObservabilityLabels {
+		repo := observabilityRepo(jobsConfig.Org, jobsConfig.Repo)
+		for _, e := range validation.IsValidLabelValue(repo) {
+			err = multierror.Append(err, fmt.Errorf("%s: observability repo %q is not a valid label value: %v", fileName, repo, e))
+		}
+	}
+
+	requirements := make([]string, 0)
+	for name, req := range jobsConfig.RequirementPresets {
+		requirements = append(requirements, name)
+		if e := validateRequirementPreset(name, req); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s: %v", fileName, e))
+		}
+		if _, f := cli.RequirementHandlers[name]; f {
+			err = multierror.Append(err, fmt.Errorf("%s: requirement preset %v conflicts with a registered requirement handler", fileName, name))
+		}
+	}
+	for name := range cli.RequirementHandlers {
+		requirements = append(requirements, name)
+	}
+
+	knownLenses := defaultKnownLenses
+	if len(cli.GlobalConfig.KnownLenses) > 0 {
+		knownLenses = cli.GlobalConfig.KnownLenses
 	}
 
+	jobNames := sets.NewString()
 	for _, job := range jobsConfig.Jobs {
-		if job.Image == "" {
+		jobNames.Insert(job.Name)
+	}
+	postsubmitNames := sets.NewString()
+	for _, job := range jobsConfig.Jobs {
+		if job.PostsubmitName != "" {
+			if len(job.Types) > 0 && !sets.NewString(job.Types...).Has(TypePostsubmit) {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v sets postsubmit_name but does not generate a postsubmit", fileName, job.Name))
+			}
+		}
+		if e := checkJobNameLength(job, jobsConfig); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s: %v", fileName, e))
+		}
+		if len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePostsubmit) {
+			if name := postsubmitName(job); postsubmitNames.Has(name) {
+				err = multierror.Append(err, fmt.Errorf("%s: postsubmit name %v of job %v is not unique", fileName, name, job.Name))
+			} else {
+				postsubmitNames.Insert(name)
+			}
+		}
+	}
+	aliases := sets.NewString()
+	for _, job := range jobsConfig.Jobs {
+		for _, alias := range job.Aliases {
+			if jobNames.Has(alias) || aliases.Has(alias) {
+				err = multierror.Append(err, fmt.Errorf("%s: alias %v of job %v collides with the trigger of another job", fileName, alias, job.Name))
+			}
+			aliases.Insert(alias)
+		}
+	}
+	for _, job := range jobsConfig.Jobs {
+		branchSet := sets.NewString(jobsConfig.Branches...)
+		if job.Image == "" && !sets.StringKeySet(job.BranchImages).IsSuperset(branchSet) {
 			err = multierror.Append(err, fmt.Errorf("%s: image must be set for job %v", fileName, job.Name))
 		}
+		for _, branch := range sets.StringKeySet(job.BranchImages).Difference(branchSet).List() {
+			err = multierror.Append(err, fmt.Errorf("%s: branch_images of job %v references branch %v, which is not in branches",
+				fileName, job.Name, branch))
+		}
 		if job.Resource != "" {
 			if _, f := jobsConfig.ResourcePresets[job.Resource]; !f {
 				err = multierror.Append(err, fmt.Errorf("%s: job '%v' has nonexistant resource '%v'", fileName, job.Name, job.Resource))
 			}
 		}
+		if job.ResourceMode != "" {
+			if e := validate(job.ResourceMode, []string{ResourceModeBoth, ResourceModeRequests, ResourceModeLimits}, "resource_mode"); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			}
+		}
+		for _, preset := range jobResourcePresets(job) {
+			jobRequirements, f := jobsConfig.ResourcePresets[preset]
+			if !f {
+				continue
+			}
+			if e := validateResourceMode(modeResources(jobRequirements, job.ResourceMode), job.ResourceMode); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: resources %v of job %v: %v", fileName, preset, job.Name, e))
+			}
+		}
 		for _, mod := range job.Modifiers {
-			if e := validate(mod, []string{ModifierHidden, ModifierOptional, ModifierSkipped}, "status"); e != nil {
+			if e := validate(mod, []string{ModifierHidden, ModifierOptional, ModifierSkipped, ModifierReportOnFailureOnly}, "status"); e != nil {
 				err = multierror.Append(err, e)
 			}
 		}
+		if types := sets.NewString(job.Types...); types.Has(TypePostsubmit) && !types.Has(TypePresubmit) {
+			// Postsubmits are never required, so these modifiers would silently do nothing.
+			for _, mod := range []string{ModifierOptional, ModifierSkipped} {
+				if sets.NewString(job.Modifiers...).Has(mod) {
+					err = multierror.Append(err, fmt.Errorf("%s: modifier %v has no effect on postsubmit %v, use %v or %v to limit reporting instead",
+						fileName, mod, job.Name, ModifierHidden, ModifierReportOnFailureOnly))
+				}
+			}
+		} else if len(job.Types) > 0 && !types.Has(TypePostsubmit) && sets.NewString(job.Modifiers...).Has(ModifierReportOnFailureOnly) {
+			err = multierror.Append(err, fmt.Errorf("%s: modifier %v of job %v is only supported for postsubmits",
+				fileName, ModifierReportOnFailureOnly, job.Name))
+		}
+		for dim, values := range job.OptionalMatrix {
+			if _, f := jobsConfig.Matrix[dim]; !f {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v marks nonexistent matrix dimension %v optional", fileName, job.Name, dim))
+				continue
+			}
+			for _, value := range values {
+				if !sets.NewString(jobsConfig.Matrix[dim]...).Has(value) {
+					err = multierror.Append(err, fmt.Errorf("%s: job %v marks nonexistent value %v of matrix dimension %v optional",
+						fileName, job.Name, value, dim))
+				}
+			}
+		}
+		for _, preset := range job.EnvPresets {
+			if _, f := jobsConfig.EnvPresets[preset]; !f {
+				err = multierror.Append(err, fmt.Errorf("%s: job '%v' has nonexistent env preset '%v'", fileName, job.Name, preset))
+			}
+		}
+		for _, preset := range job.ImagePullSecretsPresets {
+			if _, f := cli.GlobalConfig.ImagePullSecretsPresets[preset]; !f {
+				err = multierror.Append(err, fmt.Errorf("%s: job '%v' has nonexistent image pull secrets preset '%v'", fileName, job.Name, preset))
+			}
+		}
 		for _, req := range job.Requirements {
 			if e := validate(
 				req,
@@ -307,17 +1435,30 @@ func (cli *Client) ValidateJobConfig(fileName string, jobsConfig JobsConfig) {
 			}
 		}
 		if sets.NewString(job.Types...).Has(TypePeriodic) {
-			if job.Cron != "" && job.Interval != "" {
-				err = multierror.Append(err, fmt.Errorf("%s: cron and interval cannot be both set in periodic %s", fileName, job.Name))
-			} else if job.Cron == "" && job.Interval == "" {
-				err = multierror.Append(err, fmt.Errorf("%s: cron and interval cannot be both empty in periodic %s", fileName, job.Name))
-			} else if job.Cron != "" {
-				if _, e := cron.Parse(job.Cron); e != nil {
-					err = multierror.Append(err, fmt.Errorf("%s: invalid cron string %s in periodic %s: %v", fileName, job.Cron, job.Name, e))
+			if job.RunWindow != "" {
+				if window, ok := runWindows(cli.GlobalConfig)[job.RunWindow]; !ok {
+					err = multierror.Append(err, fmt.Errorf("%s: unknown run_window %v in periodic %v, must be one of %v",
+						fileName, job.RunWindow, job.Name, strings.Join(sets.StringKeySet(runWindows(cli.GlobalConfig)).List(), ", ")))
+				} else if job.Cron != window {
+					err = multierror.Append(err, fmt.Errorf("%s: cron and run_window cannot be both set in periodic %v", fileName, job.Name))
+				}
+			}
+			if len(job.Schedules) == 0 {
+				if e := validateSchedule(job.Name, job.Cron, job.Interval, minInterval); e != nil {
+					err = multierror.Append(err, fmt.Errorf("%s: %v", fileName, e))
+				}
+			}
+			scheduleNames := sets.NewString()
+			for _, schedule := range job.Schedules {
+				name := job.Name + "-" + schedule.Name
+				if schedule.Name == "" {
+					err = multierror.Append(err, fmt.Errorf("%s: schedules of periodic %s must have a name", fileName, job.Name))
+				} else if scheduleNames.Has(schedule.Name) || jobNames.Has(name) {
+					err = multierror.Append(err, fmt.Errorf("%s: schedule %s of periodic %s does not result in a unique job name", fileName, schedule.Name, job.Name))
 				}
-			} else if job.Interval != "" {
-				if _, e := time.ParseDuration(job.Interval); e != nil {
-					err = multierror.Append(err, fmt.Errorf("%s: cannot parse duration %s in periodic %s: %v", fileName, job.Interval, job.Name, e))
+				scheduleNames.Insert(schedule.Name)
+				if e := validateSchedule(name, schedule.Cron, schedule.Interval, minInterval); e != nil {
+					err = multierror.Append(err, fmt.Errorf("%s: %v", fileName, e))
 				}
 			}
 		}
@@ -330,38 +1471,571 @@ func (cli *Client) ValidateJobConfig(fileName string, jobsConfig JobsConfig) {
 			if len(strings.Split(repo, "/")) != 2 {
 				err = multierror.Append(err, fmt.Errorf("%s: repo %v not valid, should take form org/repo", fileName, repo))
 			}
+			if orgRepo := strings.TrimSuffix(repo, "@"+LockfileRef); orgRepo != repo {
+				if locked, f := cli.GlobalConfig.LockedRefs[orgRepo]; !f || locked.SHA == "" {
+					err = multierror.Append(err, fmt.Errorf("%s: repo %v of job %v is pinned by the lockfile, which has no SHA for it", fileName, orgRepo, job.Name))
+				}
+			}
+		}
+		if job.SkipDraft && len(job.Types) > 0 && !sets.NewString(job.Types...).Has(TypePresubmit) {
+			err = multierror.Append(err, fmt.Errorf("%s: skip_draft of job %v requires the %v type", fileName, job.Name, TypePresubmit))
+		}
+		if job.TTY && !job.Stdin {
+			warn(fmt.Sprintf("%s: job %v allocates a tty without stdin, which usually has no effect as decorated jobs are not interactive",
+				fileName, job.Name))
+		}
+		if checkout := workingDirConflict(job, jobsConfig, cli.GlobalConfig.PathAliases); checkout != "" {
+			warn(fmt.Sprintf("%s: working_dir %v of job %v is overridden by Prow with the checkout path %v of the repo",
+				fileName, job.WorkingDir, job.Name, checkout))
+		}
+		if len(job.Paths) > 0 && job.Regex != "" {
+			err = multierror.Append(err, fmt.Errorf("%s: paths and regex cannot be both set for job %v", fileName, job.Name))
+		}
+		for _, p := range job.Paths {
+			if p == "" || strings.HasPrefix(p, "/") {
+				err = multierror.Append(err, fmt.Errorf("%s: path %q of job %v must be a non-empty path relative to the root of the repo",
+					fileName, p, job.Name))
+			}
+		}
+		for _, regex := range []struct{ field, value string }{
+			{"regex", job.Regex},
+			{"presubmit_regex", job.PresubmitRegex},
+			{"postsubmit_regex", job.PostsubmitRegex},
+		} {
+			if _, e := regexp.Compile(regex.value); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: %v of job %v is invalid: %v", fileName, regex.field, job.Name, e))
+			}
+		}
+		if cli.GlobalConfig.TestgridConfig.Enabled {
+			for _, annotation := range []string{TestGridDashboard, TestGridAlertEmail, TestGridNumFailures} {
+				if _, f := job.Annotations[annotation]; f {
+					warn(fmt.Sprintf("%s: job %v sets the %v annotation, overriding the one generated from testgrid_config", fileName, job.Name, annotation))
+				}
+			}
+		}
+		if v, f := job.Annotations[MeshInjectAnnotation]; f && job.MeshInject != nil && v != strconv.FormatBool(*job.MeshInject) {
+			err = multierror.Append(err, fmt.Errorf("%s: mesh_inject of job %v conflicts with its %v annotation %q",
+				fileName, job.Name, MeshInjectAnnotation, v))
+		}
+		for _, lens := range job.LensHints {
+			if e := validate(lens, knownLenses, "lens hint"); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			}
+		}
+		if job.OptionalIfFlag != "" {
+			if _, f := cli.GlobalConfig.FeatureFlags[job.OptionalIfFlag]; !f {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v references undeclared feature flag %v", fileName, job.Name, job.OptionalIfFlag))
+			}
+		}
+		if job.TideQueryLabel != "" && !tideQueryLabelRegex.MatchString(job.TideQueryLabel) {
+			err = multierror.Append(err, fmt.Errorf("%s: tide_query_label %q for job %v must match %s",
+				fileName, job.TideQueryLabel, job.Name, tideQueryLabelFormat))
+		}
+		for _, branch := range job.ReleaseBranchExclusions {
+			if !releaseBranchRegex.MatchString(branch) {
+				err = multierror.Append(err, fmt.Errorf("%s: release branch exclusion %q for job %v must match %s",
+					fileName, branch, job.Name, releaseBranchFormat))
+			}
+		}
+		if job.RunAsNonRoot != nil && *job.RunAsNonRoot {
+			if isPrivileged(job) {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v cannot set run_as_non_root while being privileged, set privileged: false", fileName, job.Name))
+			}
+			if job.RunAsUser != nil && *job.RunAsUser == 0 {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v cannot set run_as_non_root while running as user 0", fileName, job.Name))
+			}
+		}
+		if job.GCSLogBucket != "" {
+			for _, branch := range jobsConfig.Branches {
+				bucket := resolveGCSBucket(job.GCSLogBucket, jobsConfig.Org, jobsConfig.Repo, branch)
+				if !gcsBucketRegex.MatchString(bucket) {
+					err = multierror.Append(err, fmt.Errorf("%s: gcs_log_bucket %q for job %v is not a valid bucket name for branch %v",
+						fileName, bucket, job.Name, branch))
+				}
+			}
+		}
+		if job.UtilityImages != nil {
+			ui := job.UtilityImages
+			if ui.CloneRefs == "" || ui.InitUpload == "" || ui.Entrypoint == "" || ui.Sidecar == "" {
+				err = multierror.Append(err, fmt.Errorf("%s: utility_images for job %v must set all of clonerefs, initupload, entrypoint and sidecar",
+					fileName, job.Name))
+			}
+		}
+		for _, timeout := range []struct {
+			field string
+			value *prowjob.Duration
+		}{
+			{"timeout", job.Timeout},
+			{"presubmit_timeout", job.PresubmitTimeout},
+			{"postsubmit_timeout", job.PostsubmitTimeout},
+			{"periodic_timeout", job.PeriodicTimeout},
+		} {
+			if timeout.value != nil && timeout.value.Duration <= 0 {
+				err = multierror.Append(err, fmt.Errorf("%s: %v of job %v must be positive", fileName, timeout.field, job.Name))
+			}
+		}
+		if job.Upload != nil {
+			if e := validateUploadSettings(*job.Upload, job.Timeout); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: upload of job %v: %v", fileName, job.Name, e))
+			}
+		}
+		if job.DecorationResources != nil {
+			if e := validateDecorationResources(*job.DecorationResources, cli.GlobalConfig.MaxDecorationResources); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: decoration_resources of job %v: %v", fileName, job.Name, e))
+			}
+		}
+		if job.ConcurrencyPool != "" {
+			if budget, ok := cli.GlobalConfig.ConcurrencyPools[job.ConcurrencyPool]; !ok {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v references unknown concurrency_pool %v", fileName, job.Name, job.ConcurrencyPool))
+			} else if budget <= 0 {
+				err = multierror.Append(err, fmt.Errorf("%s: concurrency_pool %v of job %v must have a positive budget", fileName, job.ConcurrencyPool, job.Name))
+			}
+			if job.MaxConcurrency != 0 {
+				err = multierror.Append(err, fmt.Errorf("%s: max_concurrency and concurrency_pool cannot be both set for job %v", fileName, job.Name))
+			}
+		}
+		for _, gate := range job.ReadinessGates {
+			if gate == "" {
+				err = multierror.Append(err, fmt.Errorf("%s: readiness_gates of job %v must not be empty", fileName, job.Name))
+			}
+		}
+		timeouts := typeTimeouts(job)
+		for _, jobType := range sets.StringKeySet(timeouts).List() {
+			typeJob := withTimeout(job, timeouts[jobType])
+			if deadline := activeDeadlineSeconds(typeJob, jobsConfig.ActiveDeadlineBuffer); deadline != nil && *deadline <= 0 {
+				err = multierror.Append(err, fmt.Errorf("%s: active deadline %ds of the %v of job %v must be positive", fileName, *deadline, jobType, job.Name))
+			} else if job.ActiveDeadlineSeconds != nil && typeJob.Timeout != nil && time.Duration(*job.ActiveDeadlineSeconds)*time.Second < typeJob.Timeout.Duration {
+				warn(fmt.Sprintf("%s: active_deadline_seconds %d of job %v is shorter than its %v timeout %v, the pod is reaped before it times out",
+					fileName, *job.ActiveDeadlineSeconds, job.Name, jobType, typeJob.Timeout.Duration))
+			}
+		}
+		if job.Namespace != "" {
+			for _, e := range validation.IsDNS1123Label(job.Namespace) {
+				err = multierror.Append(err, fmt.Errorf("%s: namespace %q of job %v is not a valid DNS label: %v", fileName, job.Namespace, job.Name, e))
+			}
+		}
+		if job.NodeSize != "" {
+			if size, ok := cli.GlobalConfig.NodeSizes[job.NodeSize]; !ok {
+				err = multierror.Append(err, fmt.Errorf("%s: unknown node_size %v of job %v, must be one of %v",
+					fileName, job.NodeSize, job.Name, strings.Join(sets.StringKeySet(cli.GlobalConfig.NodeSizes).List(), ", ")))
+			} else {
+				for _, k := range sets.StringKeySet(size.NodeSelector).List() {
+					if v, f := job.NodeSelector[k]; f && v != size.NodeSelector[k] {
+						err = multierror.Append(err, fmt.Errorf("%s: node_selector of job %v sets %v to %q, conflicting with %q from node_size %v",
+							fileName, job.Name, k, v, size.NodeSelector[k], job.NodeSize))
+					}
+				}
+			}
+		}
+		if job.Lifecycle != nil && len(job.Lifecycle.PreStop) == 0 {
+			err = multierror.Append(err, fmt.Errorf("%s: lifecycle of job %v must set a pre_stop command", fileName, job.Name))
+		}
+		if job.TerminationGracePeriodSeconds != nil {
+			if e := checkTerminationGracePeriod(*job.TerminationGracePeriodSeconds, cli.GlobalConfig.MaxTerminationGracePeriodSeconds); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			}
+		}
+		if job.SkipCloning && len(job.Repos) > 0 {
+			warn(fmt.Sprintf("%s: job %v skips cloning, its repos are ignored", fileName, job.Name))
+		}
+		if job.CloneDepth != nil && *job.CloneDepth < 0 {
+			err = multierror.Append(err, fmt.Errorf("%s: clone_depth of job %v must not be negative", fileName, job.Name))
+		}
+		if job.RequiredImage != "" && !imageReferenceRegex.MatchString(job.RequiredImage) {
+			err = multierror.Append(err, fmt.Errorf("%s: required_image %q of job %v is not a valid image reference", fileName, job.RequiredImage, job.Name))
+		}
+		// All generated jobs are decorated, so the secret only needs to be complete.
+		if ots := job.OauthTokenSecret; ots != nil && (ots.Name == "" || ots.Key == "") {
+			err = multierror.Append(err, fmt.Errorf("%s: oauth_token_secret of job %v must set both name and key", fileName, job.Name))
+		}
+		if job.ResultsReporter != nil {
+			if e := validateResultsReporter(*job.ResultsReporter); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: results_reporter of job %v is invalid: %v", fileName, job.Name, e))
+			}
+		}
+		if job.RetryPolicy != nil {
+			if e := validateRetryPolicy(*job.RetryPolicy); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: retry_policy of job %v is invalid: %v", fileName, job.Name, e))
+			}
+		}
+		if job.ClusterAgnostic && len(cli.GlobalConfig.ClusterPool) == 0 {
+			err = multierror.Append(err, fmt.Errorf("%s: job %v is cluster agnostic but no cluster_pool is configured", fileName, job.Name))
+		}
+		if len(cli.GlobalConfig.AutomountServiceAccountToken) > 0 {
+			clusters := []string{job.Cluster}
+			if job.ClusterAgnostic {
+				clusters = cli.GlobalConfig.ClusterPool
+			}
+			for _, cluster := range clusters {
+				if _, ok := cli.GlobalConfig.AutomountServiceAccountToken[clusterAlias(cluster)]; !ok {
+					warn(fmt.Sprintf("%s: cluster %v of job %v has no automount_service_account_token default, the token is not mounted",
+						fileName, clusterAlias(cluster), job.Name))
+				}
+			}
+		}
+		if job.HostNetwork != nil && *job.HostNetwork {
+			warn(fmt.Sprintf("%s: job %v uses the host network, exposing the network of the node and bypassing network policies",
+				fileName, job.Name))
+			if len(cli.GlobalConfig.HostNetworkClusters) > 0 {
+				clusters := []string{job.Cluster}
+				if job.ClusterAgnostic {
+					clusters = cli.GlobalConfig.ClusterPool
+				}
+				for _, cluster := range clusters {
+					if !sets.NewString(cli.GlobalConfig.HostNetworkClusters...).Has(clusterAlias(cluster)) {
+						err = multierror.Append(err, fmt.Errorf("%s: job %v uses the host network on cluster %v, which is not in the host_network_clusters %v",
+							fileName, job.Name, clusterAlias(cluster), cli.GlobalConfig.HostNetworkClusters))
+					}
+				}
+			}
+		}
+		if job.DNSPolicy != "" {
+			if e := validate(job.DNSPolicy, []string{string(v1.DNSClusterFirst), string(v1.DNSClusterFirstWithHostNet), string(v1.DNSDefault)},
+				"dns_policy"); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			}
+		}
+		if job.RuntimeClassName != "" && len(podOverhead(job, cli.GlobalConfig.RuntimeClassOverheads)) == 0 {
+			warn(fmt.Sprintf("%s: job %v sets runtime_class_name %v without overhead, the scheduler will not account for the runtime",
+				fileName, job.Name, job.RuntimeClassName))
+		} else if job.RuntimeClassName == "" && len(job.Overhead) > 0 {
+			err = multierror.Append(err, fmt.Errorf("%s: job %v sets overhead without runtime_class_name", fileName, job.Name))
+		}
+		if job.PathAlias != "" && !importPathRegex.MatchString(job.PathAlias) {
+			err = multierror.Append(err, fmt.Errorf("%s: path_alias %v of job %v is not a valid import path", fileName, job.PathAlias, job.Name))
+		}
+		if e := validateCheckoutPaths(jobsConfig.Org, jobsConfig.Repo, job.PathAlias, job.Repos, cli.GlobalConfig.PathAliases); e != nil {
+			err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+		}
+		for _, e := range conflictingLabels(job.Labels, job.PresubmitLabels, "presubmit_labels") {
+			err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+		}
+		for _, e := range conflictingLabels(job.Labels, job.PostsubmitLabels, "postsubmit_labels") {
+			err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+		}
+		if job.Shards < 0 {
+			err = multierror.Append(err, fmt.Errorf("%s: shards of job %v must be positive, got %d", fileName, job.Name, job.Shards))
+		}
+		if job.Shards > 0 && (len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePresubmit)) {
+			err = multierror.Append(err, fmt.Errorf("%s: job %v sets shards but generates a presubmit, only postsubmits and periodics can be sharded",
+				fileName, job.Name))
+		}
+		versions := sets.NewString()
+		for _, version := range job.KubernetesVersions {
+			if !kubernetesVersionRegex.MatchString(version) {
+				err = multierror.Append(err, fmt.Errorf("%s: kubernetes version %q of job %v must be of the form <major>.<minor>[.<patch>]",
+					fileName, version, job.Name))
+			}
+			if versions.Has(version) {
+				err = multierror.Append(err, fmt.Errorf("%s: kubernetes version %v of job %v is listed more than once", fileName, version, job.Name))
+			}
+			versions.Insert(version)
+		}
+		for _, system := range platformOperatingSystems(job) {
+			for _, arch := range platformArchitectures(job) {
+				if !supportedPlatforms.Has(system + "/" + arch) {
+					err = multierror.Append(err, fmt.Errorf("%s: job %v targets unsupported platform %v/%v, must be one of %v",
+						fileName, job.Name, system, arch, strings.Join(supportedPlatforms.List(), ", ")))
+				}
+			}
+		}
+		for _, arch := range sets.StringKeySet(job.ArchResources).List() {
+			if !sets.NewString(platformArchitectures(job)...).Has(arch) {
+				err = multierror.Append(err, fmt.Errorf("%s: arch_resources of job %v references architecture %v, which is not in architectures",
+					fileName, job.Name, arch))
+			}
+			if _, f := jobsConfig.ResourcePresets[job.ArchResources[arch]]; !f {
+				err = multierror.Append(err, fmt.Errorf("%s: job '%v' has nonexistant resource '%v' for architecture %v",
+					fileName, job.Name, job.ArchResources[arch], arch))
+			}
+		}
+		if sets.NewString(job.OperatingSystems...).Has(OSWindows) &&
+			(job.Privileged != nil && *job.Privileged || job.RunAsUser != nil || job.RunAsGroup != nil || job.RunAsNonRoot != nil || job.FSGroup != nil) {
+			err = multierror.Append(err, fmt.Errorf("%s: job %v targets windows, which does not support privileged, run_as_user, run_as_group, run_as_non_root or fs_group",
+				fileName, job.Name))
+		}
+		if job.CensorSecrets && len(secretVolumes(job.Requirements, jobsConfig.RequirementPresets)) == 0 {
+			warn(fmt.Sprintf("%s: job %v censors secrets but mounts no secret volume, censor_secrets is a no-op", fileName, job.Name))
+		}
+		if cli.JobNameWarningLength > 0 {
+			if name := longestJobName(job, jobsConfig); len(name) > cli.JobNameWarningLength && len(name) <= maxJobNameLength {
+				warn(fmt.Sprintf("%s: job %v generates the name %v of %d characters, close to the limit of %d, consider shortening it",
+					fileName, job.Name, name, len(name), maxJobNameLength))
+			}
+		}
+		requirementAccounts := requirementServiceAccounts(job.Requirements, jobsConfig.RequirementPresets)
+		accounts := sets.NewString()
+		for _, req := range sets.StringKeySet(requirementAccounts).List() {
+			sa := requirementAccounts[req]
+			if job.ServiceAccountName != "" && job.ServiceAccountName != sa {
+				err = multierror.Append(err, fmt.Errorf("%s: requirement %v of job %v sets service account %v, conflicting with service_account_name %v",
+					fileName, req, job.Name, sa, job.ServiceAccountName))
+			}
+			accounts.Insert(sa)
+		}
+		if accounts.Len() > 1 {
+			err = multierror.Append(err, fmt.Errorf("%s: requirements of job %v set conflicting service accounts %v",
+				fileName, job.Name, strings.Join(accounts.List(), ", ")))
+		}
+		if job.ProjectedToken != nil {
+			if job.ServiceAccountName == "" && len(requirementAccounts) == 0 {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v requests a projected token but sets no service_account_name", fileName, job.Name))
+			}
+			if job.ProjectedToken.Audience == "" {
+				err = multierror.Append(err, fmt.Errorf("%s: projected_token of job %v must set an audience", fileName, job.Name))
+			}
+			if exp := job.ProjectedToken.ExpirationSeconds; exp != nil && *exp < 600 {
+				err = multierror.Append(err, fmt.Errorf("%s: projected_token expiration_seconds of job %v must be at least 600", fileName, job.Name))
+			}
+		}
+		if job.NodeSelectorMergeStrategy != "" {
+			if e := validate(job.NodeSelectorMergeStrategy, []string{NodeSelectorMergeReplace, NodeSelectorMergeMerge}, "node_selector_merge_strategy"); e != nil {
+				err = multierror.Append(err, e)
+			}
+		}
+		if job.RestartPolicy != "" {
+			if e := validate(job.RestartPolicy, []string{string(v1.RestartPolicyNever), string(v1.RestartPolicyOnFailure)}, "restart_policy"); e != nil {
+				// Always would never let the pod complete, so the decoration sidecar would never report.
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			} else if job.RestartPolicy == string(v1.RestartPolicyOnFailure) {
+				warn(fmt.Sprintf("%s: job %v restarts on failure, the decoration sidecar only reports the result of the final run", fileName, job.Name))
+			}
+		}
+		if job.ImagePullPolicy != "" {
+			if e := validate(job.ImagePullPolicy, imagePullPolicies, "image_pull_policy"); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			}
 		}
+		if job.ArtifactRetention != "" {
+			if e := validate(job.ArtifactRetention, artifactRetentions, "artifact_retention"); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			}
+		}
+		if job.TerminationMessagePolicy != "" {
+			if e := validate(job.TerminationMessagePolicy, []string{string(v1.TerminationMessageReadFile),
+				string(v1.TerminationMessageFallbackToLogsOnError)}, "termination_message_policy"); e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: job %v: %v", fileName, job.Name, e))
+			}
+		}
+		if job.RerunAuthConfig != nil && !hasRerunAuthorization(job.RerunAuthConfig) {
+			err = multierror.Append(err, fmt.Errorf("%s: rerun_auth_config for job %v must allow anyone or at least one user or team", fileName, job.Name))
+		}
+	}
+	if err == nil {
+		// The contexts depend on the expansion of the jobs and on the branch, so they are checked on
+		// the generated presubmits, once the jobs are known to be valid.
+		for _, branch := range jobsConfig.Branches {
+			output, e := cli.GenerateJobConfig(jobsConfig, branch)
+			if e != nil {
+				err = multierror.Append(err, fmt.Errorf("%s: %v", fileName, e))
+				continue
+			}
+			if e := validateContexts(fileName, output); e != nil {
+				err = multierror.Append(err, e)
+			}
+		}
+	}
+	return err
+}
+
+// runWindows returns the named run windows of the global config, including the default ones.
+func runWindows(globalConfig GlobalConfig) map[string]string {
+	return mergeMaps(defaultRunWindows, globalConfig.RunWindows)
+}
+
+// minPeriodicInterval returns the shortest interval periodics may run at.
+func minPeriodicInterval(globalConfig GlobalConfig) (time.Duration, error) {
+	if globalConfig.MinPeriodicInterval == "" {
+		return DefaultMinPeriodicInterval, nil
 	}
+	d, err := time.ParseDuration(globalConfig.MinPeriodicInterval)
 	if err != nil {
-		exit(err, "validation failed")
+		return 0, fmt.Errorf("cannot parse min_periodic_interval %s: %v", globalConfig.MinPeriodicInterval, err)
+	}
+	return d, nil
+}
+
+// validateSchedule validates that exactly one of cron and interval is set for the periodic, and that it
+// parses. The interval must not be below minInterval, and a warning is emitted if it is suspiciously long.
+func validateSchedule(name, cronStr, interval string, minInterval time.Duration) error {
+	if cronStr != "" && interval != "" {
+		return fmt.Errorf("cron and interval cannot be both set in periodic %s", name)
+	} else if cronStr == "" && interval == "" {
+		return fmt.Errorf("cron and interval cannot be both empty in periodic %s", name)
+	} else if cronStr != "" {
+		if _, e := cron.Parse(cronStr); e != nil {
+			return fmt.Errorf("invalid cron string %s in periodic %s: %v", cronStr, name, e)
+		}
+	} else if interval != "" {
+		d, e := time.ParseDuration(interval)
+		if e != nil {
+			return fmt.Errorf("cannot parse duration %s in periodic %s: %v", interval, name, e)
+		}
+		if d < minInterval {
+			return fmt.Errorf("interval %s (%v) in periodic %s is below the minimum of %v", interval, d, name, minInterval)
+		}
+		if d > longPeriodicInterval {
+			warn(fmt.Sprintf("interval %s (%v) in periodic %s is longer than %v, check its units", interval, d, name, longPeriodicInterval))
+		}
+	}
+	return nil
+}
+
+// PreviewSchedule returns the next n times the periodic job fires at, computed from its cron or interval.
+// Crons are evaluated in UTC like Prow does, unless prefixed with CRON_TZ= or TZ=. The job is expected
+// to be resolved, so that it carries the schedule of its file and run window. Jobs fanned out into
+// schedules fire at the merged times of their schedules.
+func PreviewSchedule(job Job, n int) ([]time.Time, error) {
+	return previewSchedule(job, n, time.Now())
+}
+
+func previewSchedule(job Job, n int, now time.Time) ([]time.Time, error) {
+	if !sets.NewString(job.Types...).Has(TypePeriodic) {
+		return nil, fmt.Errorf("job %s is not a periodic", job.Name)
+	}
+	if len(job.Schedules) == 0 {
+		return nextFireTimes(job.Name, job.Cron, job.Interval, n, now)
+	}
+	var times []time.Time
+	for _, schedule := range job.Schedules {
+		next, err := nextFireTimes(job.Name+"-"+schedule.Name, schedule.Cron, schedule.Interval, n, now)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, next...)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	if len(times) > n {
+		times = times[:n]
+	}
+	return times, nil
+}
+
+// nextFireTimes returns the next n times after now a periodic with the cron or interval fires at. As
+// Prow does not persist the last run of interval periodics, they are assumed to run now.
+func nextFireTimes(name, cronStr, interval string, n int, now time.Time) ([]time.Time, error) {
+	if (cronStr == "") == (interval == "") {
+		return nil, fmt.Errorf("exactly one of cron and interval must be set in periodic %s", name)
+	}
+	var schedule cron.Schedule
+	if cronStr != "" {
+		var err error
+		if schedule, err = parseCron(cronStr); err != nil {
+			return nil, fmt.Errorf("invalid cron string %s in periodic %s: %v", cronStr, name, err)
+		}
+	} else {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse duration %s in periodic %s: %v", interval, name, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("interval %s in periodic %s must be positive", interval, name)
+		}
+		schedule = cron.Every(d)
+	}
+	times := make([]time.Time, 0, n)
+	for next := now; len(times) < n; {
+		next = schedule.Next(next)
+		times = append(times, next)
+	}
+	return times, nil
+}
+
+// parseCron parses a standard five fields cron, optionally prefixed with CRON_TZ= or TZ=, which
+// robfig/cron otherwise reads as starting with a seconds field.
+func parseCron(cronStr string) (cron.Schedule, error) {
+	fields := strings.Fields(cronStr)
+	tz := "UTC"
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		tz = fields[0][strings.Index(fields[0], "=")+1:]
+		fields = fields[1:]
+	}
+	if len(fields) == 5 {
+		fields = append([]string{"0"}, fields...)
+	}
+	return cron.Parse("TZ=" + tz + " " + strings.Join(fields, " "))
+}
+
+// aliasNames returns the full names of the aliases of a job, carrying over the suffixes the generated
+// name adds to the job name.
+func aliasNames(aliases []string, name, jobName string) []string {
+	suffix := strings.TrimPrefix(name, jobName)
+	names := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		names = append(names, alias+suffix)
+	}
+	return names
+}
+
+// triggerFor returns the trigger regex matching /test commands for the job name and any of the aliases.
+func triggerFor(name string, aliases []string) string {
+	names := []string{regexp.QuoteMeta(name)}
+	for _, alias := range aliases {
+		names = append(names, regexp.QuoteMeta(alias))
 	}
+	return fmt.Sprintf(`(?m)^/test( | .* )(%s),?($|\s.*)`, strings.Join(names, "|"))
+}
+
+// hasRerunAuthorization returns whether the rerun auth config grants rerun permissions to anyone.
+// An empty config is a no-op which would mislead authors into thinking reruns are locked down.
+func hasRerunAuthorization(rc *prowjob.RerunAuthConfig) bool {
+	return rc.AllowAnyone || len(rc.GitHubUsers) > 0 || len(rc.GitHubTeamIDs) > 0 || len(rc.GitHubTeamSlugs) > 0
 }
 
 func (cli *Client) ConvertJobConfig(jobsConfig JobsConfig, branch string) config.JobConfig {
+	output, err := cli.GenerateJobConfig(jobsConfig, branch)
+	if err != nil {
+		exit(err, "")
+	}
+	return output
+}
+
+// GenerateJobConfig converts the job config like ConvertJobConfig, returning an error instead of
+// exiting if it cannot be generated.
+func (cli *Client) GenerateJobConfig(jobsConfig JobsConfig, branch string) (config.JobConfig, error) {
+	output, _, err := cli.generateJobConfig(jobsConfig, branch)
+	return output, err
+}
+
+// generateJobConfig converts the job config like GenerateJobConfig, also returning the name of the
+// parent job in the meta config of each generated job, per job type in the order of the generated jobs.
+func (cli *Client) generateJobConfig(jobsConfig JobsConfig, branch string) (config.JobConfig, map[string][]string, error) {
 	globalConfig := cli.GlobalConfig
 	testgridConfig := globalConfig.TestgridConfig
 
 	var presubmits []config.Presubmit
 	var postsubmits []config.Postsubmit
 	var periodics []config.Periodic
+	parents := map[string][]string{}
 
 	output := config.JobConfig{
 		PresubmitsStatic:  map[string][]config.Presubmit{},
 		PostsubmitsStatic: map[string][]config.Postsubmit{},
 		Periodics:         []config.Periodic{},
 	}
+	maxMatrixExpansion := cli.MaxMatrixExpansion
+	if jobsConfig.MaxMatrixExpansion > 0 {
+		maxMatrixExpansion = jobsConfig.MaxMatrixExpansion
+	}
 	for _, parentJob := range jobsConfig.Jobs {
-		expandedJobs := applyMatrixJob(parentJob, jobsConfig.Matrix)
+		matrixJobs, err := applyMatrixJob(parentJob, jobsConfig.Matrix, maxMatrixExpansion)
+		if err != nil {
+			return config.JobConfig{}, nil, fmt.Errorf("job %v: %v", parentJob.Name, err)
+		}
+		expandedJobs := applyPlatforms(applyShards(applyKubernetesVersions(matrixJobs)))
+		if cli.StrictVariables {
+			for _, job := range expandedJobs {
+				if err := checkVariables(job, jobsConfig, globalConfig); err != nil {
+					return config.JobConfig{}, nil, fmt.Errorf("job %v: %v", parentJob.Name, err)
+				}
+			}
+		}
 		for _, job := range expandedJobs {
 			brancher := config.Brancher{
 				Branches: []string{fmt.Sprintf("^%s$", branch)},
 			}
 
-			testgridJobPrefix := jobsConfig.Org
-			if branch != "master" {
-				testgridJobPrefix += "_" + branch
-			}
-			testgridJobPrefix += "_" + jobsConfig.Repo
+			testgridJobPrefix := testgridDashboardPrefix(jobsConfig.Org, jobsConfig.Repo, branch)
 
 			if len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePresubmit) {
 				name := fmt.Sprintf("%s_%s", job.Name, jobsConfig.Repo)
@@ -370,84 +2044,131 @@ func (cli *Client) ConvertJobConfig(jobsConfig JobsConfig, branch string) config
 				}
 
 				presubmit := config.Presubmit{
-					JobBase:   createJobBase(globalConfig, jobsConfig, job, name, branch, jobsConfig.ResourcePresets),
+					JobBase:   createJobBase(globalConfig, jobsConfig, withPriorityClass(withTimeout(job, job.PresubmitTimeout), jobsConfig.PresubmitPriorityClass), name, branch, jobsConfig.ResourcePresets),
 					AlwaysRun: true,
 					Brancher:  brancher,
 				}
-				if pa, ok := globalConfig.PathAliases[jobsConfig.Org]; ok {
-					presubmit.UtilityConfig.PathAlias = fmt.Sprintf("%s/%s", pa, jobsConfig.Repo)
-				}
-				if job.Regex != "" {
+				presubmit.UtilityConfig.PathAlias = pathAlias(jobsConfig.Org, jobsConfig.Repo, job.PathAlias, globalConfig.PathAliases)
+				if regex := typeRegex(changedFilesRegex(job), job.PresubmitRegex); regex != "" {
 					presubmit.RegexpChangeMatcher = config.RegexpChangeMatcher{
-						RunIfChanged: job.Regex,
+						RunIfChanged: regex,
 					}
 					presubmit.AlwaysRun = false
 				}
+				if context := presubmitContext(jobsConfig.ContextPrefix, job, name); context != "" {
+					presubmit.Context = context
+				}
+				if len(job.Aliases) > 0 {
+					presubmit.Trigger = triggerFor(name, aliasNames(job.Aliases, name, job.Name))
+					presubmit.RerunCommand = "/test " + name
+				}
 				if testgridConfig.Enabled {
-					presubmit.JobBase.Annotations = mergeMaps(presubmit.JobBase.Annotations, map[string]string{
+					// Testgrid annotations set by the author take precedence over the generated ones.
+					presubmit.JobBase.Annotations = mergeMaps(map[string]string{
 						TestGridDashboard: testgridJobPrefix,
+					}, presubmit.JobBase.Annotations)
+				}
+				if job.SkipDraft {
+					presubmit.JobBase.Annotations = mergeMaps(presubmit.JobBase.Annotations, map[string]string{
+						SkipDraftAnnotation: "true",
 					})
 				}
+				presubmit.JobBase.Annotations = withArtifactRetention(presubmit.JobBase.Annotations, job, jobsConfig, TypePresubmit)
+				if len(job.PresubmitLabels) > 0 {
+					presubmit.JobBase.Labels = mergeMaps(presubmit.JobBase.Labels, job.PresubmitLabels)
+				}
 				applyModifiersPresubmit(&presubmit, job.Modifiers)
-				applyRequirements(&presubmit.JobBase, job.Requirements, jobsConfig.RequirementPresets)
+				if job.OptionalIfFlag != "" && cli.featureFlag(job.OptionalIfFlag) {
+					presubmit.Optional = true
+				}
+				if globalConfig.BootstrappingRepos[jobsConfig.Org+"/"+jobsConfig.Repo] {
+					// Required presubmits would block merges until branch protection is configured.
+					presubmit.Optional = true
+				}
+				applyRequirements(&presubmit.JobBase, job.Requirements, jobsConfig.RequirementPresets, cli.RequirementHandlers)
 				presubmits = append(presubmits, presubmit)
+				parents[TypePresubmit] = append(parents[TypePresubmit], parentJob.Name)
 			}
 
 			if len(job.Types) == 0 || sets.NewString(job.Types...).Has(TypePostsubmit) {
-				name := fmt.Sprintf("%s_%s", job.Name, jobsConfig.Repo)
+				name := fmt.Sprintf("%s_%s", postsubmitName(job), jobsConfig.Repo)
 				if branch != "master" {
 					name += "_" + branch
 				}
 				name += "_postsubmit"
 
 				postsubmit := config.Postsubmit{
-					JobBase:  createJobBase(globalConfig, jobsConfig, job, name, branch, jobsConfig.ResourcePresets),
+					JobBase:  createJobBase(globalConfig, jobsConfig, withPriorityClass(withTimeout(job, job.PostsubmitTimeout), jobsConfig.PostsubmitPriorityClass), name, branch, jobsConfig.ResourcePresets),
 					Brancher: brancher,
 				}
-				if pa, ok := globalConfig.PathAliases[jobsConfig.Org]; ok {
-					postsubmit.UtilityConfig.PathAlias = fmt.Sprintf("%s/%s", pa, jobsConfig.Repo)
-				}
-				if job.Regex != "" {
+				postsubmit.UtilityConfig.PathAlias = pathAlias(jobsConfig.Org, jobsConfig.Repo, job.PathAlias, globalConfig.PathAliases)
+				if regex := typeRegex(changedFilesRegex(job), job.PostsubmitRegex); regex != "" {
 					postsubmit.RegexpChangeMatcher = config.RegexpChangeMatcher{
-						RunIfChanged: job.Regex,
+						RunIfChanged: regex,
 					}
 				}
 				if testgridConfig.Enabled {
-					postsubmit.JobBase.Annotations = mergeMaps(postsubmit.JobBase.Annotations, map[string]string{
+					postsubmit.JobBase.Annotations = mergeMaps(map[string]string{
 						TestGridDashboard:   testgridJobPrefix + "_postsubmit",
-						TestGridAlertEmail:  testgridConfig.AlertEmail,
+						TestGridAlertEmail:  alertEmail(testgridConfig, job.Owner),
 						TestGridNumFailures: testgridConfig.NumFailuresToAlert,
-					})
+					}, postsubmit.JobBase.Annotations)
+				}
+				postsubmit.JobBase.Annotations = withArtifactRetention(postsubmit.JobBase.Annotations, job, jobsConfig, TypePostsubmit)
+				if len(job.PostsubmitLabels) > 0 {
+					postsubmit.JobBase.Labels = mergeMaps(postsubmit.JobBase.Labels, job.PostsubmitLabels)
 				}
 				applyModifiersPostsubmit(&postsubmit, job.Modifiers)
-				applyRequirements(&postsubmit.JobBase, job.Requirements, jobsConfig.RequirementPresets)
+				applyRequirements(&postsubmit.JobBase, job.Requirements, jobsConfig.RequirementPresets, cli.RequirementHandlers)
 				postsubmits = append(postsubmits, postsubmit)
+				parents[TypePostsubmit] = append(parents[TypePostsubmit], parentJob.Name)
 			}
 
 			if sets.NewString(job.Types...).Has(TypePeriodic) {
-				name := fmt.Sprintf("%s_%s", job.Name, jobsConfig.Repo)
-				if branch != "master" {
-					name += "_" + branch
-				}
-				name += "_periodic"
-
 				// For periodic jobs, the repo needs to be added to the clonerefs and its root directory
 				// should be set as the working directory, so add itself to the repo list here.
 				job.Repos = append([]string{jobsConfig.Org + "/" + jobsConfig.Repo}, job.Repos...)
-				periodic := config.Periodic{
-					JobBase:  createJobBase(globalConfig, jobsConfig, job, name, branch, jobsConfig.ResourcePresets),
-					Interval: job.Interval,
-					Cron:     job.Cron,
+
+				schedules := job.Schedules
+				if len(schedules) == 0 {
+					schedules = []Schedule{{Cron: job.Cron, Interval: job.Interval}}
 				}
-				if testgridConfig.Enabled {
-					periodic.JobBase.Annotations = mergeMaps(periodic.JobBase.Annotations, map[string]string{
-						TestGridDashboard:   testgridJobPrefix + "_periodic",
-						TestGridAlertEmail:  testgridConfig.AlertEmail,
-						TestGridNumFailures: testgridConfig.NumFailuresToAlert,
-					})
+				for _, schedule := range schedules {
+					scheduledJob := job
+					if schedule.Name != "" {
+						scheduledJob.Name += "-" + schedule.Name
+					}
+					if len(schedule.Args) > 0 {
+						scheduledJob.Command = append(append([]string{}, job.Command...), schedule.Args...)
+					}
+
+					name := fmt.Sprintf("%s_%s", scheduledJob.Name, jobsConfig.Repo)
+					if branch != "master" {
+						name += "_" + branch
+					}
+					name += "_periodic"
+
+					periodic := config.Periodic{
+						JobBase:  createJobBase(globalConfig, jobsConfig, withPriorityClass(withTimeout(scheduledJob, job.PeriodicTimeout), jobsConfig.PeriodicPriorityClass), name, branch, jobsConfig.ResourcePresets),
+						Interval: schedule.Interval,
+						Cron:     schedule.Cron,
+					}
+					if testgridConfig.Enabled {
+						periodic.JobBase.Annotations = mergeMaps(map[string]string{
+							TestGridDashboard:   testgridJobPrefix + "_periodic",
+							TestGridAlertEmail:  alertEmail(testgridConfig, job.Owner),
+							TestGridNumFailures: testgridConfig.NumFailuresToAlert,
+						}, periodic.JobBase.Annotations)
+					}
+					periodic.JobBase.Annotations = withArtifactRetention(periodic.JobBase.Annotations, job, jobsConfig, TypePeriodic)
+					// The primary repo is the first of the extra refs of periodics, unless they skip cloning.
+					if len(periodic.ExtraRefs) > 0 {
+						periodic.ExtraRefs[0].PathAlias = pathAlias(jobsConfig.Org, jobsConfig.Repo, job.PathAlias, globalConfig.PathAliases)
+					}
+					applyRequirements(&periodic.JobBase, scheduledJob.Requirements, jobsConfig.RequirementPresets, cli.RequirementHandlers)
+					periodics = append(periodics, periodic)
+					parents[TypePeriodic] = append(parents[TypePeriodic], parentJob.Name)
 				}
-				applyRequirements(&periodic.JobBase, job.Requirements, jobsConfig.RequirementPresets)
-				periodics = append(periodics, periodic)
 			}
 		}
 
@@ -461,28 +2182,386 @@ func (cli *Client) ConvertJobConfig(jobsConfig JobsConfig, branch string) config
 			output.Periodics = periodics
 		}
 	}
-	return output
+	if cli.ObservabilityLabels {
+		stampObservabilityLabels(&output, jobsConfig.Org, jobsConfig.Repo)
+	}
+	if globalConfig.BehaviorHash {
+		stampBehaviorHashes(&output)
+	}
+	if globalConfig.SpecHash {
+		stampSpecHashes(&output)
+	}
+	return output, parents, nil
 }
 
-func (cli *Client) CheckConfig(jobs config.JobConfig, currentConfigFile string) error {
-	current, err := ioutil.ReadFile(currentConfigFile)
-	if err != nil {
-		return fmt.Errorf("failed to read current config for %s: %v", currentConfigFile, err)
+// stampObservabilityLabels labels every job of the org/repo with its observability labels.
+func stampObservabilityLabels(jc *config.JobConfig, org, repo string) {
+	for _, presubmits := range jc.PresubmitsStatic {
+		for i := range presubmits {
+			presubmits[i].Labels = mergeMaps(presubmits[i].Labels, observabilityLabels(TypePresubmit, org, repo, presubmits[i].Name))
+		}
+	}
+	for _, postsubmits := range jc.PostsubmitsStatic {
+		for i := range postsubmits {
+			postsubmits[i].Labels = mergeMaps(postsubmits[i].Labels, observabilityLabels(TypePostsubmit, org, repo, postsubmits[i].Name))
+		}
+	}
+	for i := range jc.Periodics {
+		jc.Periodics[i].Labels = mergeMaps(jc.Periodics[i].Labels, observabilityLabels(TypePeriodic, org, repo, jc.Periodics[i].Name))
 	}
+}
 
-	newConfig, err := yaml.Marshal(jobs)
+// observabilityLabels returns the observability labels of a job. The job id is derived from the type,
+// repo and name of the job only, so it is stable across runs and changes of the spec.
+func observabilityLabels(jobType, org, repo, name string) map[string]string {
+	id := sha256.Sum256([]byte(jobType + "/" + org + "/" + repo + "/" + name))
+	return map[string]string{
+		ObservabilityJobIDLabel: fmt.Sprintf("%x", id)[:16],
+		ObservabilityRepoLabel:  observabilityRepo(org, repo),
+		ObservabilityTypeLabel:  jobType,
+	}
+}
+
+// observabilityRepo returns the repo label value, as a label value cannot contain the / of org/repo.
+func observabilityRepo(org, repo string) string {
+	return org + "." + repo
+}
+
+// testgridDashboardPrefix returns the name of the testgrid dashboard of the presubmits of the repo on
+// the branch, which the dashboards of the postsubmits and periodics are suffixed from.
+func testgridDashboardPrefix(org, repo, branch string) string {
+	prefix := org
+	if branch != "master" {
+		prefix += "_" + branch
+	}
+	return prefix + "_" + repo
+}
+
+// RepoBranch identifies the jobs generated for a repo on a branch.
+type RepoBranch struct {
+	Org    string
+	Repo   string
+	Branch string
+}
+
+// ValidateTestgridDashboards returns an error if the testgrid dashboards generated for different
+// repos and branches collide, e.g. when branch names contain separators, as testgrid requires
+// globally unique dashboard names.
+func ValidateTestgridDashboards(repoBranches []RepoBranch) error {
+	sources := map[string]sets.String{}
+	for _, rb := range repoBranches {
+		prefix := testgridDashboardPrefix(rb.Org, rb.Repo, rb.Branch)
+		for _, dashboard := range []string{prefix, prefix + "_postsubmit", prefix + "_periodic"} {
+			if _, ok := sources[dashboard]; !ok {
+				sources[dashboard] = sets.NewString()
+			}
+			sources[dashboard].Insert(fmt.Sprintf("%s/%s@%s", rb.Org, rb.Repo, rb.Branch))
+		}
+	}
+
+	var err error
+	for _, dashboard := range sets.StringKeySet(sources).List() {
+		if sources[dashboard].Len() > 1 {
+			err = multierror.Append(err, fmt.Errorf("testgrid dashboard %v is generated for %v",
+				dashboard, strings.Join(sources[dashboard].List(), ", ")))
+		}
+	}
+	return err
+}
+
+// poolMember is a job of a concurrency pool.
+type poolMember struct {
+	key string
+	jb  *config.JobBase
+	// job is the job the JobBase is embedded in, to recompute its spec hash.
+	job interface{}
+}
+
+// DistributeConcurrencyPools divides the budget of every concurrency pool between its jobs across
+// the configs, setting their max_concurrency. The jobs are ordered by type, repo and name, and the
+// first ones receive the remainder of the division. Every job gets a max_concurrency of at least 1,
+// exceeding the budget of pools with more jobs than their budget, for which a warning is emitted.
+func (cli *Client) DistributeConcurrencyPools(configs []config.JobConfig) {
+	pools := map[string][]poolMember{}
+	add := func(key string, jb *config.JobBase, job interface{}) {
+		if pool := jb.Annotations[ConcurrencyPoolAnnotation]; pool != "" {
+			pools[pool] = append(pools[pool], poolMember{key: key, jb: jb, job: job})
+		}
+	}
+	for _, jc := range configs {
+		for orgRepo, presubmits := range jc.PresubmitsStatic {
+			for i := range presubmits {
+				add(TypePresubmit+"/"+orgRepo+"/"+presubmits[i].Name, &presubmits[i].JobBase, &presubmits[i])
+			}
+		}
+		for orgRepo, postsubmits := range jc.PostsubmitsStatic {
+			for i := range postsubmits {
+				add(TypePostsubmit+"/"+orgRepo+"/"+postsubmits[i].Name, &postsubmits[i].JobBase, &postsubmits[i])
+			}
+		}
+		for i := range jc.Periodics {
+			add(TypePeriodic+"/"+jc.Periodics[i].Name, &jc.Periodics[i].JobBase, &jc.Periodics[i])
+		}
+	}
+
+	for _, pool := range sets.StringKeySet(pools).List() {
+		members := pools[pool]
+		sort.Slice(members, func(i, j int) bool { return members[i].key < members[j].key })
+		budget := cli.GlobalConfig.ConcurrencyPools[pool]
+		if budget < len(members) {
+			warn(fmt.Sprintf("concurrency pool %v has %d jobs for a budget of %d, each job gets a max_concurrency of 1",
+				pool, len(members), budget))
+		}
+		for i, member := range members {
+			concurrency := budget / len(members)
+			if i < budget%len(members) {
+				concurrency++
+			}
+			if concurrency < 1 {
+				concurrency = 1
+			}
+			member.jb.MaxConcurrency = concurrency
+			if _, ok := member.jb.Annotations[SpecHashAnnotation]; ok {
+				delete(member.jb.Annotations, SpecHashAnnotation)
+				member.jb.Annotations[SpecHashAnnotation] = specHash(member.job)
+			}
+		}
+	}
+}
+
+// stampSpecHashes annotates every job with the hash of its generated spec, so rehearsal tooling can
+// identify the jobs that changed.
+func stampSpecHashes(jc *config.JobConfig) {
+	for _, presubmits := range jc.PresubmitsStatic {
+		for i := range presubmits {
+			presubmits[i].Annotations = mergeMaps(presubmits[i].Annotations, map[string]string{SpecHashAnnotation: specHash(presubmits[i])})
+		}
+	}
+	for _, postsubmits := range jc.PostsubmitsStatic {
+		for i := range postsubmits {
+			postsubmits[i].Annotations = mergeMaps(postsubmits[i].Annotations, map[string]string{SpecHashAnnotation: specHash(postsubmits[i])})
+		}
+	}
+	for i := range jc.Periodics {
+		jc.Periodics[i].Annotations = mergeMaps(jc.Periodics[i].Annotations, map[string]string{SpecHashAnnotation: specHash(jc.Periodics[i])})
+	}
+}
+
+// behaviorAnnotations are the annotations read by the components running, triggering, retrying or
+// reporting a job, which change its behavior unlike the other annotations.
+var behaviorAnnotations = []string{
+	MeshInjectAnnotation,
+	ResultsEndpointAnnotation,
+	ResultsAuthSecretAnnotation,
+	RetryMaxRetriesAnnotation,
+	RetryOnAnnotation,
+	SkipDraftAnnotation,
+}
+
+// jobBehavior is what a job runs and when, the hash of which changes with its behavior. The name, the
+// labels other than presets and the annotations other than behaviorAnnotations are cosmetic, and so
+// left out.
+type jobBehavior struct {
+	Cluster          string                    `json:"cluster,omitempty"`
+	Spec             *v1.PodSpec               `json:"spec,omitempty"`
+	Presets          []string                  `json:"presets,omitempty"`
+	Annotations      map[string]string         `json:"annotations,omitempty"`
+	ExtraRefs        []prowjob.Refs            `json:"extra_refs,omitempty"`
+	PathAlias        string                    `json:"path_alias,omitempty"`
+	CloneDepth       int                       `json:"clone_depth,omitempty"`
+	SkipSubmodules   bool                      `json:"skip_submodules,omitempty"`
+	DecorationConfig *prowjob.DecorationConfig `json:"decoration_config,omitempty"`
+
+	Branches     []string `json:"branches,omitempty"`
+	RunIfChanged string   `json:"run_if_changed,omitempty"`
+	AlwaysRun    bool     `json:"always_run,omitempty"`
+	Cron         string   `json:"cron,omitempty"`
+	Interval     string   `json:"interval,omitempty"`
+}
+
+func newJobBehavior(jb config.JobBase) jobBehavior {
+	var presets []string
+	for label, value := range jb.Labels {
+		// Prow injects the presets selected by the preset- labels into the pod.
+		if strings.HasPrefix(label, "preset-") {
+			presets = append(presets, label+"="+value)
+		}
+	}
+	sort.Strings(presets)
+	annotations := map[string]string{}
+	for _, key := range behaviorAnnotations {
+		if value, ok := jb.Annotations[key]; ok {
+			annotations[key] = value
+		}
+	}
+	return jobBehavior{
+		Cluster:          jb.Cluster,
+		Spec:             jb.Spec,
+		Presets:          presets,
+		Annotations:      annotations,
+		ExtraRefs:        jb.ExtraRefs,
+		PathAlias:        jb.PathAlias,
+		CloneDepth:       jb.CloneDepth,
+		SkipSubmodules:   jb.SkipSubmodules,
+		DecorationConfig: jb.DecorationConfig,
+	}
+}
+
+// stampBehaviorHashes annotates every job with the hash of its behavior.
+func stampBehaviorHashes(jc *config.JobConfig) {
+	for _, presubmits := range jc.PresubmitsStatic {
+		for i := range presubmits {
+			b := newJobBehavior(presubmits[i].JobBase)
+			b.Branches, b.RunIfChanged, b.AlwaysRun = presubmits[i].Branches, presubmits[i].RunIfChanged, presubmits[i].AlwaysRun
+			presubmits[i].Annotations = mergeMaps(presubmits[i].Annotations, map[string]string{BehaviorHashAnnotation: specHash(b)})
+		}
+	}
+	for _, postsubmits := range jc.PostsubmitsStatic {
+		for i := range postsubmits {
+			b := newJobBehavior(postsubmits[i].JobBase)
+			b.Branches, b.RunIfChanged = postsubmits[i].Branches, postsubmits[i].RunIfChanged
+			postsubmits[i].Annotations = mergeMaps(postsubmits[i].Annotations, map[string]string{BehaviorHashAnnotation: specHash(b)})
+		}
+	}
+	for i := range jc.Periodics {
+		b := newJobBehavior(jc.Periodics[i].JobBase)
+		b.Cron, b.Interval = jc.Periodics[i].Cron, jc.Periodics[i].Interval
+		jc.Periodics[i].Annotations = mergeMaps(jc.Periodics[i].Annotations, map[string]string{BehaviorHashAnnotation: specHash(b)})
+	}
+}
+
+// specHash returns the sha256 of the canonical JSON of the job. Maps are marshaled with sorted keys,
+// and the job must not carry a hash yet, which would otherwise change it.
+func specHash(job interface{}) string {
+	bs, err := json.Marshal(job)
 	if err != nil {
-		return fmt.Errorf("failed to marshal result: %v", err)
+		exit(err, "failed to marshal the job to hash")
 	}
+	return fmt.Sprintf("%x", sha256.Sum256(bs))
+}
+
+// Version is the version of the generator, stamped into the generated files below the autogen header
+// to record their provenance. It is set at build time with
+// -ldflags "-X istio.io/test-infra/prow/config.Version=<version>", and no stamp is written if unset.
+var Version = ""
+
+const versionStampPrefix = "# Generated by prowgen version "
+
+var versionStampRegex = regexp.MustCompile("(?m)^" + versionStampPrefix + "(.*)\n")
+
+// generatedContent returns the content of a generated file, the autogen header followed by the
+// version stamp, if set, on its own line, and then the config.
+func (cli *Client) generatedContent(bs []byte, version string) []byte {
 	output := []byte(cli.GlobalConfig.AutogenHeader)
-	output = append(output, newConfig...)
+	if version != "" {
+		if len(output) > 0 && output[len(output)-1] != '\n' {
+			output = append(output, '\n')
+		}
+		output = append(output, versionStampPrefix+version+"\n"...)
+	}
+	return append(output, bs...)
+}
 
-	if !bytes.Equal(current, output) {
+func (cli *Client) CheckConfig(jobs config.JobConfig, currentConfigFile string) error {
+	drifted, err := cli.checkConfig(jobs, currentConfigFile)
+	if err != nil {
+		return err
+	}
+	if drifted {
 		return fmt.Errorf("generated config is different than file %v", currentConfigFile)
 	}
 	return nil
 }
 
+// CheckResult is the result of comparing the generated config to the current config files.
+type CheckResult struct {
+	// Drifted lists the files that differ from the generated config, sorted.
+	Drifted []string
+	// Missing lists the files of the generated config that do not exist, sorted.
+	Missing []string
+	// Stale lists the files that still exist while no jobs are generated for them anymore, sorted.
+	Stale []string
+}
+
+// HasDrift returns true if any file differs from the generated config, is missing or is stale.
+func (r CheckResult) HasDrift() bool {
+	return len(r.Drifted) > 0 || len(r.Missing) > 0 || len(r.Stale) > 0
+}
+
+// CheckConfigs compares the generated configs, keyed by the file they are written to, to the current
+// files, and checks that the removed files, e.g. the ones left without jobs by grouping, do not exist.
+// Drift is reported in the result, while an error is only returned if a file cannot be compared.
+func (cli *Client) CheckConfigs(configs map[string]config.JobConfig, removed ...string) (CheckResult, error) {
+	result := CheckResult{}
+	for file, jobs := range configs {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			result.Missing = append(result.Missing, file)
+			continue
+		}
+		drifted, err := cli.checkConfig(jobs, file)
+		if err != nil {
+			return CheckResult{}, err
+		}
+		if drifted {
+			result.Drifted = append(result.Drifted, file)
+		}
+	}
+	for _, file := range removed {
+		if _, err := os.Stat(file); err == nil {
+			result.Stale = append(result.Stale, file)
+		} else if !os.IsNotExist(err) {
+			return CheckResult{}, fmt.Errorf("failed to stat %s: %v", file, err)
+		}
+	}
+	sort.Strings(result.Drifted)
+	sort.Strings(result.Missing)
+	sort.Strings(result.Stale)
+	return result, nil
+}
+
+// ValidateWithProw runs the generated configs, keyed by the file they are written to, through the Prow
+// config loader along with the Prow config, surfacing the errors of the Prow validation.
+func ValidateWithProw(prowConfig string, configs map[string]config.JobConfig) error {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		return fmt.Errorf("failed to create the job config directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for file, jobs := range configs {
+		bs, err := yaml.Marshal(jobs)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %v", file, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(file)), bs, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", file, err)
+		}
+	}
+	if _, err := config.Load(prowConfig, dir); err != nil {
+		return fmt.Errorf("prow config validation failed: %v", err)
+	}
+	return nil
+}
+
+// checkConfig returns true if the current config file differs from the generated config.
+func (cli *Client) checkConfig(jobs config.JobConfig, currentConfigFile string) (bool, error) {
+	current, err := ioutil.ReadFile(currentConfigFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read current config for %s: %v", currentConfigFile, err)
+	}
+
+	newConfig, err := yaml.Marshal(jobs)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal result: %v", err)
+	}
+	// The version stamp differs between builds, so it is not considered drift: the generated config
+	// is compared with the stamp of the current file.
+	version := ""
+	if m := versionStampRegex.FindSubmatch(current); m != nil {
+		version = string(m[1])
+	}
+	return !bytes.Equal(current, cli.generatedContent(newConfig, version)), nil
+}
+
 func (cli *Client) WriteConfig(jobs config.JobConfig, fname string) {
 	bs, err := yaml.Marshal(jobs)
 	if err != nil {
@@ -492,14 +2571,143 @@ func (cli *Client) WriteConfig(jobs config.JobConfig, fname string) {
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		exit(err, "failed to create directory: "+dir)
 	}
-	output := []byte(cli.GlobalConfig.AutogenHeader)
-	output = append(output, bs...)
-	err = ioutil.WriteFile(fname, output, 0644)
+	err = ioutil.WriteFile(fname, cli.generatedContent(bs, Version), 0644)
 	if err != nil {
 		exit(err, "failed to write result")
 	}
 }
 
+// WriteManifest writes a manifest in the sha256sum format listing the files with their checksum, so
+// tampering after generation can be detected. The checksums leave out the version stamp line, which
+// changes with every generator version, so the manifest is not verifiable with sha256sum -c on the
+// files as written. Paths are relative to the directory of the manifest and sorted.
+func WriteManifest(files []string, manifest string) error {
+	dir := filepath.Dir(manifest)
+	files = append([]string{}, files...)
+	sort.Strings(files)
+	lines := make([]string, 0, len(files))
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return fmt.Errorf("failed to make %s relative to %s: %v", file, dir, err)
+		}
+		sum := sha256.Sum256(versionStampRegex.ReplaceAll(content, nil))
+		lines = append(lines, fmt.Sprintf("%x  %s\n", sum, filepath.ToSlash(rel)))
+	}
+	if err := ioutil.WriteFile(manifest, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %v", manifest, err)
+	}
+	return nil
+}
+
+// GroupKey returns the group a job is written to. Jobs of the empty group are written to the
+// original file.
+type GroupKey func(job config.JobBase) string
+
+// GroupByLabel groups the jobs by the value of the label.
+func GroupByLabel(label string) GroupKey {
+	return func(job config.JobBase) string {
+		return job.Labels[label]
+	}
+}
+
+// GroupJobConfig partitions the jobs by the key, returning the job config of every group keyed by
+// the file it is written to. The file of a group is fname with the group inserted before the
+// .gen.yaml extension, e.g. istio.istio.master.team-a.gen.yaml. A nil key keeps all jobs in fname.
+// fname is left out if all its jobs are grouped, see RemovedFiles.
+func GroupJobConfig(jobs config.JobConfig, fname string, key GroupKey) map[string]config.JobConfig {
+	if key == nil {
+		return map[string]config.JobConfig{fname: jobs}
+	}
+	groups := map[string]*config.JobConfig{}
+	group := func(jb config.JobBase) *config.JobConfig {
+		file := fname
+		if g := key(jb); g != "" {
+			file = strings.TrimSuffix(fname, ".gen.yaml") + "." + g + ".gen.yaml"
+		}
+		if _, ok := groups[file]; !ok {
+			groups[file] = &config.JobConfig{
+				PresubmitsStatic:  map[string][]config.Presubmit{},
+				PostsubmitsStatic: map[string][]config.Postsubmit{},
+				Periodics:         []config.Periodic{},
+			}
+		}
+		return groups[file]
+	}
+	for orgRepo, presubmits := range jobs.PresubmitsStatic {
+		for _, presubmit := range presubmits {
+			jc := group(presubmit.JobBase)
+			jc.PresubmitsStatic[orgRepo] = append(jc.PresubmitsStatic[orgRepo], presubmit)
+		}
+	}
+	for orgRepo, postsubmits := range jobs.PostsubmitsStatic {
+		for _, postsubmit := range postsubmits {
+			jc := group(postsubmit.JobBase)
+			jc.PostsubmitsStatic[orgRepo] = append(jc.PostsubmitsStatic[orgRepo], postsubmit)
+		}
+	}
+	for _, periodic := range jobs.Periodics {
+		jc := group(periodic.JobBase)
+		jc.Periodics = append(jc.Periodics, periodic)
+	}
+
+	res := make(map[string]config.JobConfig, len(groups))
+	for file, jc := range groups {
+		res[file] = *jc
+	}
+	return res
+}
+
+// RemovedFiles returns fname if the groups leave it without jobs, as Prow would otherwise keep
+// loading its jobs along with the ones of the groups, resulting in duplicate jobs.
+func RemovedFiles(groups map[string]config.JobConfig, fname string) []string {
+	if _, ok := groups[fname]; ok {
+		return nil
+	}
+	return []string{fname}
+}
+
+// RemoveConfigs deletes the files, ignoring the ones that do not exist.
+func RemoveConfigs(files []string) error {
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// WriteConfigGrouped writes the jobs partitioned by the key, one file per group, deleting fname if
+// all its jobs are grouped.
+func (cli *Client) WriteConfigGrouped(jobs config.JobConfig, fname string, key GroupKey) {
+	groups := GroupJobConfig(jobs, fname, key)
+	for file, jc := range groups {
+		cli.WriteConfig(jc, file)
+	}
+	if err := RemoveConfigs(RemovedFiles(groups, fname)); err != nil {
+		exit(err, "failed to remove the ungrouped config")
+	}
+}
+
+// CheckConfigGrouped compares the jobs partitioned by the key to the files of the groups, and
+// checks that fname does not exist if all its jobs are grouped.
+func (cli *Client) CheckConfigGrouped(jobs config.JobConfig, fname string, key GroupKey) error {
+	groups := GroupJobConfig(jobs, fname, key)
+	result, err := cli.CheckConfigs(groups, RemovedFiles(groups, fname)...)
+	if err != nil {
+		return err
+	}
+	if result.HasDrift() {
+		files := append(append(append([]string{}, result.Drifted...), result.Missing...), result.Stale...)
+		return fmt.Errorf("generated config is different than files %v", strings.Join(files, ", "))
+	}
+	return nil
+}
+
 func (cli *Client) PrintConfig(c interface{}) {
 	bs, err := yaml.Marshal(c)
 	if err != nil {
@@ -528,11 +2736,11 @@ func (cli *Client) DiffConfig(result config.JobConfig, existing config.JobConfig
 	diffConfigPostsubmit(result, existing)
 }
 
-// FilterReleaseBranchingJobs filters then returns jobs with release branching enabled.
-func FilterReleaseBranchingJobs(jobs []Job) []Job {
+// FilterReleaseBranchingJobs filters then returns jobs with release branching enabled for the given branch.
+func FilterReleaseBranchingJobs(jobs []Job, branch string) []Job {
 	jobsF := make([]Job, 0)
 	for _, j := range jobs {
-		if j.DisableReleaseBranching {
+		if j.DisableReleaseBranching || sets.NewString(j.ReleaseBranchExclusions...).Has(branch) {
 			continue
 		}
 		jobsF = append(jobsF, j)
@@ -566,122 +2774,657 @@ func diffConfigPresubmit(result config.JobConfig, pj config.JobConfig) {
 			if len(diff) > 0 {
 				fmt.Println("\nDiff for", job.Name)
 			}
-			for _, d := range diff {
-				fmt.Println(d)
+			for _, d := range diff {
+				fmt.Println(d)
+			}
+		}
+	}
+	for _, jobs := range pj.PresubmitsStatic {
+		for _, job := range jobs {
+			if _, f := known[job.Name]; !f {
+				fmt.Println("Missing", job.Name)
+			}
+		}
+	}
+}
+
+func diffConfigPostsubmit(result config.JobConfig, pj config.JobConfig) {
+	known := make(map[string]struct{})
+	var allCurrentPostsubmits []config.Postsubmit
+	for _, jobs := range pj.PostsubmitsStatic {
+		allCurrentPostsubmits = append(allCurrentPostsubmits, jobs...)
+	}
+	for _, jobs := range result.PostsubmitsStatic {
+		for _, job := range jobs {
+			known[job.Name] = struct{}{}
+			var current *config.Postsubmit
+			for _, ps := range allCurrentPostsubmits {
+				if ps.Name == job.Name {
+					current = &ps
+					break
+				}
+			}
+			if current == nil {
+				fmt.Println("\nCreated unknown job:", job.Name)
+				continue
+
+			}
+			diff := pretty.Diff(current, &job)
+			if len(diff) > 0 {
+				fmt.Println("\nDiff for", job.Name)
+			}
+			for _, d := range diff {
+				fmt.Println(d)
+			}
+		}
+	}
+
+	for _, job := range allCurrentPostsubmits {
+		if _, f := known[job.Name]; !f {
+			fmt.Println("Missing", job.Name)
+		}
+	}
+}
+
+func createContainer(jobConfig JobsConfig, job Job, branch string, resources map[string]v1.ResourceRequirements) []v1.Container {
+	envs := [][]v1.EnvVar{job.Env}
+	for _, preset := range job.EnvPresets {
+		envs = append(envs, jobConfig.EnvPresets[preset])
+	}
+	envs = append(envs, jobConfig.Env)
+
+	image := job.Image
+	if branchImage, f := job.BranchImages[branch]; f {
+		image = branchImage
+	}
+	c := v1.Container{
+		Image: image,
+		SecurityContext: &v1.SecurityContext{
+			Privileged:   newBool(isPrivileged(job)),
+			RunAsUser:    job.RunAsUser,
+			RunAsGroup:   job.RunAsGroup,
+			RunAsNonRoot: job.RunAsNonRoot,
+		},
+		Command:    job.Command,
+		Env:        joinEnv(envs...),
+		WorkingDir: job.WorkingDir,
+		TTY:        job.TTY,
+		Stdin:      job.Stdin,
+	}
+	if job.OS == OSWindows {
+		// Privileged containers and Linux users do not exist on Windows.
+		c.SecurityContext = nil
+	}
+	if job.ImagePullPolicy != "" {
+		c.ImagePullPolicy = v1.PullPolicy(job.ImagePullPolicy)
+	}
+	if job.TerminationMessagePolicy != "" {
+		c.TerminationMessagePolicy = v1.TerminationMessagePolicy(job.TerminationMessagePolicy)
+	}
+	if job.Lifecycle != nil {
+		c.Lifecycle = &v1.Lifecycle{PreStop: &v1.Handler{Exec: &v1.ExecAction{Command: job.Lifecycle.PreStop}}}
+	}
+	jobResource := DefaultResource
+	if job.Resource != "" {
+		jobResource = job.Resource
+	}
+	if _, ok := resources[jobResource]; ok {
+		c.Resources = modeResources(resources[jobResource], job.ResourceMode)
+	}
+
+	return []v1.Container{c}
+}
+
+// joinEnv joins the env vars, the first variable of each name taking precedence.
+func joinEnv(envs ...[]v1.EnvVar) []v1.EnvVar {
+	var res []v1.EnvVar
+	names := sets.NewString()
+	for _, env := range envs {
+		for _, e := range env {
+			if !names.Has(e.Name) {
+				res = append(res, e)
+				names.Insert(e.Name)
+			}
+		}
+	}
+	return res
+}
+
+func createJobBase(globalConfig GlobalConfig, jobConfig JobsConfig, job Job,
+	name string, branch string, resources map[string]v1.ResourceRequirements) config.JobBase {
+	yes := true
+	jb := config.JobBase{
+		Name:           name,
+		MaxConcurrency: job.MaxConcurrency,
+		Spec: &v1.PodSpec{
+			Containers:   createContainer(jobConfig, job, branch, resources),
+			NodeSelector: job.NodeSelector,
+		},
+		UtilityConfig: config.UtilityConfig{
+			Decorate:  &yes,
+			ExtraRefs: createExtraRefs(job.Repos, branch, globalConfig.PathAliases, globalConfig.LockedRefs),
+		},
+		Labels:          job.Labels,
+		Annotations:     job.Annotations,
+		Cluster:         job.Cluster,
+		RerunAuthConfig: job.RerunAuthConfig,
+	}
+	if job.Namespace != "" {
+		jb.Namespace = &job.Namespace
+	}
+	if job.ClusterAgnostic {
+		jb.Cluster = assignCluster(name, globalConfig.ClusterPool, globalConfig.ClusterWeights)
+	}
+	if job.CloneDepth != nil {
+		jb.UtilityConfig.CloneDepth = *job.CloneDepth
+		for i := range jb.ExtraRefs {
+			jb.ExtraRefs[i].CloneDepth = *job.CloneDepth
+		}
+	}
+	if job.SkipSubmodules != nil {
+		jb.UtilityConfig.SkipSubmodules = *job.SkipSubmodules
+		for i := range jb.ExtraRefs {
+			jb.ExtraRefs[i].SkipSubmodules = *job.SkipSubmodules
+		}
+	}
+	// The service account token, process namespace and fs group settings only apply to Linux pods.
+	linux := job.OS != OSWindows
+	if len(globalConfig.AutomountServiceAccountToken) > 0 && linux {
+		automount := globalConfig.AutomountServiceAccountToken[clusterAlias(jb.Cluster)]
+		jb.Spec.AutomountServiceAccountToken = &automount
+	}
+	if tolerations := platformTolerations(job); len(tolerations) > 0 {
+		jb.Spec.Tolerations = tolerations
+	}
+	if size, ok := globalConfig.NodeSizes[job.NodeSize]; ok && job.NodeSize != "" {
+		jb.Spec.NodeSelector = mergeMaps(jb.Spec.NodeSelector, size.NodeSelector)
+		jb.Spec.Tolerations = append(jb.Spec.Tolerations, size.Tolerations...)
+	}
+	if job.RestartPolicy != "" {
+		jb.Spec.RestartPolicy = v1.RestartPolicy(job.RestartPolicy)
+	}
+	jb.Spec.ImagePullSecrets = imagePullSecrets(job, globalConfig.ImagePullSecretsPresets)
+	if linux {
+		jb.Spec.ShareProcessNamespace = job.ShareProcessNamespace
+	}
+	jb.Spec.EnableServiceLinks = job.EnableServiceLinks
+	for _, gate := range job.ReadinessGates {
+		jb.Spec.ReadinessGates = append(jb.Spec.ReadinessGates, v1.PodReadinessGate{ConditionType: v1.PodConditionType(gate)})
+	}
+	if job.TerminationGracePeriodSeconds == nil && job.Lifecycle != nil {
+		job.TerminationGracePeriodSeconds = preStopGracePeriod(globalConfig.MaxTerminationGracePeriodSeconds)
+	}
+	if job.TerminationGracePeriodSeconds != nil {
+		jb.Spec.TerminationGracePeriodSeconds = job.TerminationGracePeriodSeconds
+	}
+	if job.PriorityClassName != "" {
+		jb.Spec.PriorityClassName = job.PriorityClassName
+	}
+	if job.HostNetwork != nil && *job.HostNetwork {
+		jb.Spec.HostNetwork = true
+		jb.Spec.DNSPolicy = v1.DNSClusterFirstWithHostNet
+	}
+	if job.DNSPolicy != "" {
+		jb.Spec.DNSPolicy = v1.DNSPolicy(job.DNSPolicy)
+	}
+	if job.RuntimeClassName != "" {
+		jb.Spec.RuntimeClassName = &job.RuntimeClassName
+		jb.Spec.Overhead = podOverhead(job, globalConfig.RuntimeClassOverheads)
+	}
+	if job.FSGroup != nil && linux {
+		jb.Spec.SecurityContext = &v1.PodSecurityContext{FSGroup: job.FSGroup}
+	}
+	if job.ServiceAccountName != "" {
+		jb.Spec.ServiceAccountName = job.ServiceAccountName
+	}
+	if job.ProjectedToken != nil && linux {
+		addProjectedToken(jb.Spec, *job.ProjectedToken)
+	}
+	if job.RequiredImage != "" {
+		jb.Spec.InitContainers = append(jb.Spec.InitContainers, waitForImageContainer(globalConfig, job.RequiredImage))
+	}
+	if jb.Labels == nil {
+		jb.Labels = map[string]string{}
+	}
+	if jb.Annotations == nil {
+		jb.Annotations = map[string]string{}
+	}
+	if job.TideQueryLabel != "" {
+		jb.Labels[TideQueryLabel] = job.TideQueryLabel
+		jb.Annotations[TideQueryAnnotation] = job.TideQueryLabel
+	}
+	if globalConfig.QuotaScopeLabel != "" {
+		jb.Labels[globalConfig.QuotaScopeLabel] = quotaScope(jobConfig)
+	}
+	if job.Owner != "" {
+		jb.Annotations[OwnerAnnotation] = job.Owner
+	}
+	if job.RequiredImage != "" {
+		jb.Annotations[RequiredImageAnnotation] = job.RequiredImage
+	}
+	if job.ConcurrencyPool != "" {
+		jb.Annotations[ConcurrencyPoolAnnotation] = job.ConcurrencyPool
+	}
+	if len(job.LensHints) > 0 {
+		jb.Annotations[LensHintsAnnotation] = strings.Join(job.LensHints, ",")
+	}
+	if rr := job.ResultsReporter; rr != nil {
+		jb.Annotations[ResultsEndpointAnnotation] = rr.Endpoint
+		// Validated to be set, unless the job config is converted without being validated.
+		if rr.AuthSecret != nil {
+			jb.Annotations[ResultsAuthSecretAnnotation] = rr.AuthSecret.Name + "/" + rr.AuthSecret.Key
+		}
+	}
+	if rp := job.RetryPolicy; rp != nil {
+		jb.Annotations[RetryMaxRetriesAnnotation] = strconv.Itoa(rp.MaxRetries)
+		jb.Annotations[RetryOnAnnotation] = strings.Join(rp.RetryOn, ",")
+	}
+	if job.MeshInject != nil {
+		jb.Annotations[MeshInjectAnnotation] = strconv.FormatBool(*job.MeshInject)
+	}
+
+	if job.Timeout != nil {
+		decorationConfig(&jb).Timeout = job.Timeout
+	}
+	jb.Spec.ActiveDeadlineSeconds = activeDeadlineSeconds(job, jobConfig.ActiveDeadlineBuffer)
+	if job.UtilityImages != nil {
+		decorationConfig(&jb).UtilityImages = job.UtilityImages
+	}
+	if job.CensorSecrets {
+		decorationConfig(&jb).CensorSecrets = newBool(true)
+	}
+	if job.SkipCloning {
+		decorationConfig(&jb).SkipCloning = newBool(true)
+		jb.ExtraRefs = nil
+	}
+	if job.OauthTokenSecret != nil {
+		decorationConfig(&jb).OauthTokenSecret = job.OauthTokenSecret
+	}
+	if job.GCSLogBucket != "" {
+		decorationConfig(&jb).GCSConfiguration = &prowjob.GCSConfiguration{
+			Bucket: resolveGCSBucket(job.GCSLogBucket, jobConfig.Org, jobConfig.Repo, branch),
+		}
+	}
+	if job.Upload != nil {
+		applyUploadSettings(decorationConfig(&jb), *job.Upload)
+	}
+	if job.DecorationResources != nil {
+		decorationConfig(&jb).Resources = job.DecorationResources
+	}
+
+	return jb
+}
+
+// waitForImageContainer returns an init container polling the registry until the image exists.
+func waitForImageContainer(globalConfig GlobalConfig, image string) v1.Container {
+	poller := DefaultImagePoller
+	if globalConfig.ImagePoller != "" {
+		poller = globalConfig.ImagePoller
+	}
+	return v1.Container{
+		Name:  "wait-for-image",
+		Image: poller,
+		Command: []string{"sh", "-c",
+			fmt.Sprintf("until crane digest %s; do echo waiting for %s; sleep %d; done", image, image, waitForImageInterval)},
+	}
+}
+
+// addProjectedToken adds a projected service account token volume to the pod and mounts it
+// into the test container.
+func addProjectedToken(spec *v1.PodSpec, token ProjectedToken) {
+	mountPath := token.MountPath
+	if mountPath == "" {
+		mountPath = projectedTokenMountPath
+	}
+	spec.Volumes = append(spec.Volumes, v1.Volume{
+		Name: projectedTokenVolume,
+		VolumeSource: v1.VolumeSource{
+			Projected: &v1.ProjectedVolumeSource{
+				Sources: []v1.VolumeProjection{{
+					ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+						Audience:          token.Audience,
+						ExpirationSeconds: token.ExpirationSeconds,
+						Path:              projectedTokenPath,
+					},
+				}},
+			},
+		},
+	})
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, v1.VolumeMount{
+		Name:      projectedTokenVolume,
+		MountPath: mountPath,
+		ReadOnly:  true,
+	})
+}
+
+// checkTerminationGracePeriod returns an error if the grace period is negative or exceeds the cap.
+// A cap of 0 means no limit.
+func checkTerminationGracePeriod(seconds, max int64) error {
+	if seconds < 0 {
+		return fmt.Errorf("termination_grace_period_seconds %d must not be negative", seconds)
+	}
+	if max > 0 && seconds > max {
+		return fmt.Errorf("termination_grace_period_seconds %d exceeds the maximum of %d", seconds, max)
+	}
+	return nil
+}
+
+// activeDeadlineSeconds returns the active deadline of the pod of the job, the explicit one if set, or
+// its timeout, upload grace period and the buffer, if it has a timeout and the buffer is set.
+func activeDeadlineSeconds(job Job, buffer *prowjob.Duration) *int64 {
+	if job.ActiveDeadlineSeconds != nil {
+		return job.ActiveDeadlineSeconds
+	}
+	if job.Timeout == nil || buffer == nil {
+		return nil
+	}
+	deadline := job.Timeout.Duration + buffer.Duration
+	if job.Upload != nil && job.Upload.GracePeriod != nil {
+		deadline += job.Upload.GracePeriod.Duration
+	}
+	seconds := int64(deadline / time.Second)
+	return &seconds
+}
+
+// preStopGracePeriod returns the termination grace period of jobs with a preStop hook not setting one,
+// within the maximum.
+func preStopGracePeriod(max int64) *int64 {
+	seconds := DefaultPreStopGracePeriodSeconds
+	if max > 0 && seconds > max {
+		seconds = max
+	}
+	return &seconds
+}
+
+// quotaScope returns the value of the quota scope label of the jobs of the file.
+func quotaScope(jobConfig JobsConfig) string {
+	if jobConfig.QuotaScope != "" {
+		return jobConfig.QuotaScope
+	}
+	return jobConfig.Org + "-" + jobConfig.Repo
+}
+
+// assignCluster deterministically picks a cluster from the pool by hashing the job name,
+// so the assignment is stable across generations.
+func assignCluster(name string, pool []string, weights map[string]int) string {
+	if len(pool) == 0 {
+		return ""
+	}
+	total := uint32(0)
+	for _, cluster := range pool {
+		total += uint32(clusterWeight(cluster, weights))
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	n := h.Sum32() % total
+	for _, cluster := range pool {
+		w := uint32(clusterWeight(cluster, weights))
+		if n < w {
+			return cluster
+		}
+		n -= w
+	}
+	return pool[len(pool)-1]
+}
+
+// presubmitContext returns the GitHub status context of the presubmit of the given name, prefixed
+// with the context prefix of the file. Returns empty if nothing overrides the default context.
+func presubmitContext(prefix string, job Job, name string) string {
+	if prefix == "" {
+		return job.Context
+	}
+	if job.Context != "" {
+		return prefix + job.Context
+	}
+	return prefix + name
+}
+
+// validateContexts validates that the GitHub status contexts of the presubmits of each repo are
+// unique, the context of a presubmit defaulting to its name.
+func validateContexts(fileName string, jobs config.JobConfig) error {
+	var err error
+	for _, orgRepo := range sets.StringKeySet(jobs.PresubmitsStatic).List() {
+		contexts := map[string]string{}
+		for _, presubmit := range jobs.PresubmitsStatic[orgRepo] {
+			context := presubmit.Context
+			if context == "" {
+				context = presubmit.Name
+			}
+			if other, f := contexts[context]; f {
+				err = multierror.Append(err, fmt.Errorf("%s: context %v of presubmit %v is also the context of presubmit %v",
+					fileName, context, presubmit.Name, other))
 			}
+			contexts[context] = presubmit.Name
 		}
 	}
-	for _, jobs := range pj.PresubmitsStatic {
-		for _, job := range jobs {
-			if _, f := known[job.Name]; !f {
-				fmt.Println("Missing", job.Name)
-			}
-		}
+	return err
+}
+
+// clusterWeight returns the weight of the cluster of the pool, defaulting to 1. Weights are validated
+// to be positive, and clamped to 1 for the job configs converted without being validated.
+func clusterWeight(cluster string, weights map[string]int) int {
+	if w, ok := weights[cluster]; ok && w > 0 {
+		return w
 	}
+	return 1
 }
 
-func diffConfigPostsubmit(result config.JobConfig, pj config.JobConfig) {
-	known := make(map[string]struct{})
-	var allCurrentPostsubmits []config.Postsubmit
-	for _, jobs := range pj.PostsubmitsStatic {
-		allCurrentPostsubmits = append(allCurrentPostsubmits, jobs...)
+// podOverhead returns the pod overhead of the job, defaulting to the overhead of its runtime class.
+func podOverhead(job Job, overheads map[string]v1.ResourceList) v1.ResourceList {
+	if len(job.Overhead) > 0 {
+		return job.Overhead
 	}
-	for _, jobs := range result.PostsubmitsStatic {
-		for _, job := range jobs {
-			known[job.Name] = struct{}{}
-			var current *config.Postsubmit
-			for _, ps := range allCurrentPostsubmits {
-				if ps.Name == job.Name {
-					current = &ps
-					break
-				}
-			}
-			if current == nil {
-				fmt.Println("\nCreated unknown job:", job.Name)
-				continue
+	return overheads[job.RuntimeClassName]
+}
 
-			}
-			diff := pretty.Diff(current, &job)
-			if len(diff) > 0 {
-				fmt.Println("\nDiff for", job.Name)
-			}
-			for _, d := range diff {
-				fmt.Println(d)
+// imagePullSecrets returns the image pull secrets of the presets of the job followed by its own,
+// without duplicates.
+func imagePullSecrets(job Job, presets map[string][]string) []v1.LocalObjectReference {
+	var names []string
+	for _, preset := range job.ImagePullSecretsPresets {
+		names = append(names, presets[preset]...)
+	}
+	var secrets []v1.LocalObjectReference
+	for _, name := range mergeSlices(names, job.ImagePullSecrets) {
+		secrets = append(secrets, v1.LocalObjectReference{Name: name})
+	}
+	return secrets
+}
+
+// clusterAlias returns the alias of the cluster, Prow running jobs not setting one on the default cluster.
+func clusterAlias(cluster string) string {
+	if cluster == "" {
+		return DefaultCluster
+	}
+	return cluster
+}
+
+// decorationConfig returns the decoration config of the job, creating it if needed.
+func decorationConfig(jb *config.JobBase) *prowjob.DecorationConfig {
+	if jb.DecorationConfig == nil {
+		jb.DecorationConfig = &prowjob.DecorationConfig{}
+	}
+	return jb.DecorationConfig
+}
+
+// applyUploadSettings applies the upload settings to the decoration config.
+func applyUploadSettings(dc *prowjob.DecorationConfig, upload UploadSettings) {
+	if upload.GracePeriod != nil {
+		dc.GracePeriod = upload.GracePeriod
+	}
+	if upload.PathStrategy == "" && len(upload.MediaTypes) == 0 {
+		return
+	}
+	if dc.GCSConfiguration == nil {
+		dc.GCSConfiguration = &prowjob.GCSConfiguration{}
+	}
+	dc.GCSConfiguration.PathStrategy = upload.PathStrategy
+	dc.GCSConfiguration.DefaultOrg = upload.DefaultOrg
+	dc.GCSConfiguration.DefaultRepo = upload.DefaultRepo
+	dc.GCSConfiguration.MediaTypes = upload.MediaTypes
+}
+
+// validateDecorationResources validates that the requests of the decoration containers do not exceed
+// their limits, and that neither exceeds the maximum.
+func validateDecorationResources(resources prowjob.Resources, max v1.ResourceList) error {
+	var err error
+	for _, c := range []struct {
+		name         string
+		requirements *v1.ResourceRequirements
+	}{
+		{"clonerefs", resources.CloneRefs},
+		{"initupload", resources.InitUpload},
+		{"place_entrypoint", resources.PlaceEntrypoint},
+		{"sidecar", resources.Sidecar},
+	} {
+		if c.requirements == nil {
+			continue
+		}
+		for _, e := range requestsAboveLimits(*c.requirements) {
+			err = multierror.Append(err, fmt.Errorf("%v: %v", c.name, e))
+		}
+		for _, list := range []v1.ResourceList{c.requirements.Requests, c.requirements.Limits} {
+			for _, name := range resourceNames(list) {
+				quantity := list[name]
+				if m, ok := max[name]; ok && quantity.Cmp(m) > 0 {
+					err = multierror.Append(err, fmt.Errorf("%s of %v %v exceeds the max_decoration_resources %v", name, c.name, quantity.String(), m.String()))
+				}
 			}
 		}
 	}
+	return err
+}
 
-	for _, job := range allCurrentPostsubmits {
-		if _, f := known[job.Name]; !f {
-			fmt.Println("Missing", job.Name)
+// requestsAboveLimits returns an error for each request exceeding its limit.
+func requestsAboveLimits(requirements v1.ResourceRequirements) []error {
+	var errs []error
+	for _, name := range resourceNames(requirements.Requests) {
+		request := requirements.Requests[name]
+		if limit, ok := requirements.Limits[name]; ok && request.Cmp(limit) > 0 {
+			errs = append(errs, fmt.Errorf("%s request %v exceeds its limit %v", name, request.String(), limit.String()))
 		}
 	}
+	return errs
 }
 
-func createContainer(jobConfig JobsConfig, job Job, resources map[string]v1.ResourceRequirements) []v1.Container {
-	envs := job.Env
-	if len(envs) == 0 {
-		envs = jobConfig.Env
-	} else {
-		// TODO: overwrite the env with the same name
-		envs = append(envs, jobConfig.Env...)
+// jobResourcePresets returns the names of the resource presets the jobs expanded from the job use.
+func jobResourcePresets(job Job) []string {
+	presets := sets.NewString(DefaultResource)
+	if job.Resource != "" {
+		presets = sets.NewString(job.Resource)
+	}
+	for _, preset := range job.ArchResources {
+		presets.Insert(preset)
 	}
+	return presets.List()
+}
 
-	c := v1.Container{
-		Image:           job.Image,
-		SecurityContext: &v1.SecurityContext{Privileged: newTrue()},
-		Command:         job.Command,
-		Env:             envs,
+// modeResources returns the requests and limits of the resources selected by the resource mode.
+func modeResources(resources v1.ResourceRequirements, mode string) v1.ResourceRequirements {
+	switch mode {
+	case ResourceModeRequests:
+		return v1.ResourceRequirements{Requests: resources.Requests}
+	case ResourceModeLimits:
+		return v1.ResourceRequirements{Limits: resources.Limits}
+	default:
+		return resources
 	}
-	if job.ImagePullPolicy != "" {
-		c.ImagePullPolicy = v1.PullPolicy(job.ImagePullPolicy)
+}
+
+// validateResourceMode validates that the resources selected by the resource mode are set, and that
+// the requests do not exceed the limits.
+func validateResourceMode(resources v1.ResourceRequirements, mode string) error {
+	var err error
+	if mode == ResourceModeRequests && len(resources.Requests) == 0 {
+		err = multierror.Append(err, fmt.Errorf("resource_mode %v requires the preset to set requests", mode))
 	}
-	jobResource := DefaultResource
-	if job.Resource != "" {
-		jobResource = job.Resource
+	if mode == ResourceModeLimits && len(resources.Limits) == 0 {
+		err = multierror.Append(err, fmt.Errorf("resource_mode %v requires the preset to set limits", mode))
 	}
-	if _, ok := resources[jobResource]; ok {
-		c.Resources = resources[jobResource]
+	for _, e := range requestsAboveLimits(resources) {
+		err = multierror.Append(err, e)
 	}
+	return err
+}
 
-	return []v1.Container{c}
+// resourceNames returns the sorted names of the resources of the list.
+func resourceNames(list v1.ResourceList) []v1.ResourceName {
+	var names []v1.ResourceName
+	for name := range list {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
 }
 
-func createJobBase(globalConfig GlobalConfig, jobConfig JobsConfig, job Job,
-	name string, branch string, resources map[string]v1.ResourceRequirements) config.JobBase {
-	yes := true
-	jb := config.JobBase{
-		Name:           name,
-		MaxConcurrency: job.MaxConcurrency,
-		Spec: &v1.PodSpec{
-			Containers:   createContainer(jobConfig, job, resources),
-			NodeSelector: job.NodeSelector,
-		},
-		UtilityConfig: config.UtilityConfig{
-			Decorate:  &yes,
-			ExtraRefs: createExtraRefs(job.Repos, branch, globalConfig.PathAliases),
-		},
-		Labels:      job.Labels,
-		Annotations: job.Annotations,
-		Cluster:     job.Cluster,
+// validateRetryPolicy validates that the number of retries is bounded and the conditions are known.
+func validateRetryPolicy(rp RetryPolicy) error {
+	var err error
+	if rp.MaxRetries <= 0 || rp.MaxRetries > maxRetries {
+		err = multierror.Append(err, fmt.Errorf("max_retries %d must be between 1 and %d", rp.MaxRetries, maxRetries))
 	}
-	if jb.Labels == nil {
-		jb.Labels = map[string]string{}
+	if len(rp.RetryOn) == 0 {
+		err = multierror.Append(err, errors.New("retry_on must list at least one condition"))
 	}
-	if jb.Annotations == nil {
-		jb.Annotations = map[string]string{}
+	for _, condition := range rp.RetryOn {
+		if e := validate(condition, retryConditions, "retry_on condition"); e != nil {
+			err = multierror.Append(err, e)
+		}
 	}
+	return err
+}
 
-	if job.Timeout != nil {
-		jb.DecorationConfig = &prowjob.DecorationConfig{
-			Timeout: job.Timeout,
+// validateResultsReporter validates that the endpoint is an absolute URL and the auth secret is set.
+func validateResultsReporter(rr ResultsReporter) error {
+	var err error
+	if u, e := url.Parse(rr.Endpoint); e != nil {
+		err = multierror.Append(err, fmt.Errorf("endpoint %q does not parse: %v", rr.Endpoint, e))
+	} else if u.Scheme == "" || u.Host == "" {
+		err = multierror.Append(err, fmt.Errorf("endpoint %q must be an absolute URL", rr.Endpoint))
+	}
+	if rr.AuthSecret == nil || rr.AuthSecret.Name == "" || rr.AuthSecret.Key == "" {
+		err = multierror.Append(err, errors.New("auth_secret must set both name and key"))
+	}
+	return err
+}
+
+// validateUploadSettings validates that the path strategy is known and has the defaults it requires,
+// and that the grace period is positive and shorter than the timeout of the job.
+func validateUploadSettings(upload UploadSettings, timeout *prowjob.Duration) error {
+	var err error
+	switch upload.PathStrategy {
+	case "":
+		if upload.DefaultOrg != "" || upload.DefaultRepo != "" {
+			err = multierror.Append(err, errors.New("default_org and default_repo require a path_strategy"))
+		}
+	case prowjob.PathStrategyExplicit:
+		if upload.DefaultOrg != "" || upload.DefaultRepo != "" {
+			err = multierror.Append(err, errors.New("default_org and default_repo are not used by the explicit path_strategy"))
+		}
+	case prowjob.PathStrategyLegacy, prowjob.PathStrategySingle:
+		if upload.DefaultOrg == "" || upload.DefaultRepo == "" {
+			err = multierror.Append(err, fmt.Errorf("path_strategy %v requires default_org and default_repo", upload.PathStrategy))
+		}
+	default:
+		err = multierror.Append(err, fmt.Errorf("unknown path_strategy %v, must be one of %v, %v or %v", upload.PathStrategy,
+			prowjob.PathStrategyExplicit, prowjob.PathStrategyLegacy, prowjob.PathStrategySingle))
+	}
+	if gp := upload.GracePeriod; gp != nil {
+		if gp.Duration <= 0 {
+			err = multierror.Append(err, errors.New("grace_period must be positive"))
+		} else if timeout != nil && gp.Duration >= timeout.Duration {
+			err = multierror.Append(err, fmt.Errorf("grace_period %v must be shorter than the timeout %v", gp.Duration, timeout.Duration))
 		}
 	}
+	return err
+}
 
-	return jb
+// resolveGCSBucket substitutes the {org}, {repo} and {branch} placeholders in the bucket.
+func resolveGCSBucket(bucket, org, repo, branch string) string {
+	return strings.NewReplacer("{org}", org, "{repo}", repo, "{branch}", branch).Replace(bucket)
 }
 
-func createExtraRefs(extraRepos []string, defaultBranch string, pathAliases map[string]string) []prowjob.Refs {
+func createExtraRefs(extraRepos []string, defaultBranch string, pathAliases map[string]string, lockedRefs map[string]LockedRef) []prowjob.Refs {
 	refs := make([]prowjob.Refs, 0)
 	for _, extraRepo := range extraRepos {
 		branch := defaultBranch
@@ -690,12 +3433,21 @@ func createExtraRefs(extraRepos []string, defaultBranch string, pathAliases map[
 			branch = repobranch[1]
 		}
 		orgrepo := repobranch[0]
+		sha := ""
+		if branch == LockfileRef {
+			locked := lockedRefs[orgrepo]
+			branch, sha = defaultBranch, locked.SHA
+			if locked.Branch != "" {
+				branch = locked.Branch
+			}
+		}
 		repo := orgrepo[strings.LastIndex(orgrepo, "/")+1:]
 		org := strings.TrimSuffix(orgrepo, "/"+repo)
 		ref := prowjob.Refs{
 			Org:     org,
 			Repo:    repo,
 			BaseRef: branch,
+			BaseSHA: sha,
 		}
 		if pa, ok := pathAliases[org]; ok {
 			ref.PathAlias = fmt.Sprintf("%s/%s", pa, repo)
@@ -709,12 +3461,76 @@ func createExtraRefs(extraRepos []string, defaultBranch string, pathAliases map[
 	return refs
 }
 
-func applyRequirements(job *config.JobBase, requirements []string, presetMap map[string]RequirementPreset) {
+// pathAlias returns the path alias of the primary repo, the override taking precedence over the
+// path alias of the org.
+func pathAlias(org, repo, override string, pathAliases map[string]string) string {
+	if override != "" {
+		return override
+	}
+	if pa, ok := pathAliases[org]; ok {
+		return fmt.Sprintf("%s/%s", pa, repo)
+	}
+	return ""
+}
+
+// checkoutPath returns the path, relative to the GOPATH, that Prow clones the ref to.
+func checkoutPath(ref prowjob.Refs) string {
+	if ref.PathAlias != "" {
+		return ref.PathAlias
+	}
+	return fmt.Sprintf("github.com/%s/%s", ref.Org, ref.Repo)
+}
+
+// workingDirConflict returns the checkout path Prow sets as the working directory of the job if it
+// differs from its working_dir. Decoration overrides the working directory of the jobs cloning repos
+// with the checkout path of the primary repo, which periodics clone first.
+func workingDirConflict(job Job, jobsConfig JobsConfig, pathAliases map[string]string) string {
+	if job.WorkingDir == "" || job.SkipCloning {
+		return ""
+	}
+	primary := prowjob.Refs{Org: jobsConfig.Org, Repo: jobsConfig.Repo, PathAlias: pathAlias(jobsConfig.Org, jobsConfig.Repo, job.PathAlias, pathAliases)}
+	checkout := path.Join(decorationCodeMountPath, "src", checkoutPath(primary))
+	if path.Clean(job.WorkingDir) == checkout {
+		return ""
+	}
+	return checkout
+}
+
+// validateCheckoutPaths validates that no two refs of a job, including the primary repo, are
+// cloned to the same path, which would cause one checkout to overwrite the other.
+func validateCheckoutPaths(org, repo, override string, extraRepos []string, pathAliases map[string]string) error {
+	primary := prowjob.Refs{Org: org, Repo: repo, PathAlias: pathAlias(org, repo, override, pathAliases)}
+	refs := append([]prowjob.Refs{primary}, createExtraRefs(extraRepos, "", pathAliases, nil)...)
+
+	var err error
+	seen := map[string]prowjob.Refs{}
+	for _, ref := range refs {
+		p := checkoutPath(ref)
+		if other, f := seen[p]; f {
+			err = multierror.Append(err, fmt.Errorf("refs %s/%s and %s/%s are both cloned to %s",
+				other.Org, other.Repo, ref.Org, ref.Repo, p))
+			continue
+		}
+		seen[p] = ref
+	}
+	return err
+}
+
+func applyRequirements(job *config.JobBase, requirements []string, presetMap map[string]RequirementPreset,
+	handlers map[string]RequirementHandler) {
 	presets := make([]RequirementPreset, 0)
+	custom := make([]RequirementHandler, 0)
 	for _, req := range requirements {
-		presets = append(presets, presetMap[req])
+		if handler, ok := handlers[req]; ok {
+			custom = append(custom, handler)
+		} else {
+			presets = append(presets, presetMap[req])
+		}
+	}
+	resolveRequirements(job.Name, job.Annotations, job.Labels, job.Spec, presets)
+	for _, handler := range custom {
+		handler(job)
 	}
-	resolveRequirements(job.Annotations, job.Labels, job.Spec, presets)
 }
 
 func applyModifiersPresubmit(presubmit *config.Presubmit, jobModifiers []string) {
@@ -729,38 +3545,366 @@ func applyModifiersPresubmit(presubmit *config.Presubmit, jobModifiers []string)
 	}
 }
 
+// applyModifiersPostsubmit applies the modifiers supported by postsubmits. Optional and skipped
+// do not exist on postsubmits and are rejected by validation for postsubmit only jobs.
 func applyModifiersPostsubmit(postsubmit *config.Postsubmit, jobModifiers []string) {
 	for _, modifier := range jobModifiers {
-		if modifier == ModifierOptional {
-			// Does not exist on postsubmit
-		} else if modifier == ModifierHidden {
+		if modifier == ModifierHidden {
 			postsubmit.SkipReport = true
+		} else if modifier == ModifierReportOnFailureOnly {
+			// The GitHub reporter honors skip_report, while the Slack reporter only reports the
+			// states of the job, to the channel of the Prow config.
+			postsubmit.SkipReport = true
+			postsubmit.ReporterConfig = &prowjob.ReporterConfig{Slack: &prowjob.SlackReporterConfig{
+				JobStatesToReport: []prowjob.ProwJobState{prowjob.FailureState, prowjob.ErrorState},
+			}}
 		}
-		// Cannot skip a postsubmit; instead just make `type: presubmit`
 	}
 }
 
-func applyMatrixJob(job Job, matrix map[string][]string) []Job {
+func applyMatrixJob(job Job, matrix map[string][]string, maxExpansion int) ([]Job, error) {
 	yamlStr, err := yaml.Marshal(job)
 	if err != nil {
-		exit(err, "failed to marshal the given Job")
+		return nil, fmt.Errorf("failed to marshal the given Job: %v", err)
+	}
+	cells, err := applyMatrix(string(yamlStr), matrix, maxExpansion)
+	if err != nil {
+		return nil, err
 	}
-	expandedYamlStr := applyMatrix(string(yamlStr), matrix)
 	jobs := make([]Job, 0)
-	for _, jobYaml := range expandedYamlStr {
+	for _, cell := range cells {
 		job := &Job{}
-		if err := yaml.Unmarshal([]byte(jobYaml), job); err != nil {
-			exit(err, "failed to unmarshal the yaml to Job")
+		if err := yaml.Unmarshal([]byte(cell.yaml), job); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the yaml to Job: %v", err)
+		}
+		if isOptionalCell(job.OptionalMatrix, cell.values) && !sets.NewString(job.Modifiers...).Has(ModifierOptional) {
+			job.Modifiers = append(job.Modifiers, ModifierOptional)
+		}
+		if len(cell.values) > 0 {
+			// Maps are marshalled with sorted keys, keeping the annotation stable.
+			bs, err := json.Marshal(cell.values)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal the matrix cell: %v", err)
+			}
+			job.Annotations = mergeMaps(job.Annotations, map[string]string{MatrixAnnotation: string(bs)})
 		}
 		jobs = append(jobs, *job)
 	}
-	return jobs
+	return jobs, nil
+}
+
+// changedFilesRegex returns the run_if_changed regex of the job, compiled from its paths if set. Each
+// path matches the file itself and, for a directory, the files below it.
+func changedFilesRegex(job Job) string {
+	if len(job.Paths) == 0 {
+		return job.Regex
+	}
+	paths := make([]string, 0, len(job.Paths))
+	for _, p := range job.Paths {
+		paths = append(paths, regexp.QuoteMeta(strings.TrimSuffix(p, "/")))
+	}
+	return "^(" + strings.Join(paths, "|") + ")(/|$)"
+}
+
+// alertEmail returns the email the testgrid alerts of a job owned by the team are sent to, defaulting
+// to the alert email of the testgrid config.
+func alertEmail(testgridConfig TestgridConfig, owner string) string {
+	if email, ok := testgridConfig.TeamAlertEmails[owner]; ok {
+		return email
+	}
+	return testgridConfig.AlertEmail
+}
+
+// withArtifactRetention records the artifact retention of the job of the given type in the annotations,
+// the retention of the job taking precedence over the one of the file for the type.
+func withArtifactRetention(annotations map[string]string, job Job, jobsConfig JobsConfig, jobType string) map[string]string {
+	retention := jobsConfig.ArtifactRetention[jobType]
+	if job.ArtifactRetention != "" {
+		retention = job.ArtifactRetention
+	}
+	if retention == "" {
+		return annotations
+	}
+	return mergeMaps(annotations, map[string]string{ArtifactRetentionAnnotation: retention})
+}
+
+// withTimeout returns the job with the timeout of a job type, overriding the shared timeout if set.
+func withTimeout(job Job, override *prowjob.Duration) Job {
+	if override != nil {
+		job.Timeout = override
+	}
+	return job
+}
+
+// typeTimeouts returns the timeout override of each type the job generates, nil if the type uses the job timeout.
+func typeTimeouts(job Job) map[string]*prowjob.Duration {
+	types := job.Types
+	if len(types) == 0 {
+		types = []string{TypePresubmit, TypePostsubmit}
+	}
+	overrides := map[string]*prowjob.Duration{
+		TypePresubmit:  job.PresubmitTimeout,
+		TypePostsubmit: job.PostsubmitTimeout,
+		TypePeriodic:   job.PeriodicTimeout,
+	}
+	timeouts := make(map[string]*prowjob.Duration, len(types))
+	for _, t := range types {
+		timeouts[t] = overrides[t]
+	}
+	return timeouts
+}
+
+// withPriorityClass returns the job with the priority class of a job type, unless the job sets its own.
+func withPriorityClass(job Job, class *string) Job {
+	if job.PriorityClassName == "" && class != nil {
+		job.PriorityClassName = *class
+	}
+	return job
+}
+
+// typeRegex returns the run_if_changed regex of a job type, overriding the shared regex if set.
+func typeRegex(shared, override string) string {
+	if override != "" {
+		return override
+	}
+	return shared
+}
+
+// applyKubernetesVersions expands the jobs into one job per Kubernetes version they target.
+func applyKubernetesVersions(jobs []Job) []Job {
+	res := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		if len(job.KubernetesVersions) == 0 {
+			res = append(res, job)
+			continue
+		}
+		for _, version := range job.KubernetesVersions {
+			versionJob := job
+			suffix := kubernetesVersionSuffix(version)
+			versionJob.Name += suffix
+			if job.PostsubmitName != "" {
+				versionJob.PostsubmitName += suffix
+			}
+			versionJob.Aliases = nil
+			for _, alias := range job.Aliases {
+				versionJob.Aliases = append(versionJob.Aliases, alias+suffix)
+			}
+			versionJob.Env = append([]v1.EnvVar{{Name: KubernetesVersionEnv, Value: version}}, job.Env...)
+			res = append(res, versionJob)
+		}
+	}
+	return res
+}
+
+// kubernetesVersionSuffix returns the suffix of the name of a job expanded for the Kubernetes version.
+func kubernetesVersionSuffix(version string) string {
+	return "-k8s-" + version
+}
+
+// applyShards expands the jobs into one job per shard of their test suite.
+func applyShards(jobs []Job) []Job {
+	res := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		if job.Shards <= 0 {
+			res = append(res, job)
+			continue
+		}
+		for index := 0; index < job.Shards; index++ {
+			shardJob := job
+			suffix := shardSuffix(index)
+			shardJob.Name += suffix
+			if job.PostsubmitName != "" {
+				shardJob.PostsubmitName += suffix
+			}
+			shardJob.Aliases = nil
+			for _, alias := range job.Aliases {
+				shardJob.Aliases = append(shardJob.Aliases, alias+suffix)
+			}
+			shardJob.Env = append([]v1.EnvVar{
+				{Name: ShardIndexEnv, Value: strconv.Itoa(index)},
+				{Name: ShardCountEnv, Value: strconv.Itoa(job.Shards)},
+			}, job.Env...)
+			res = append(res, shardJob)
+		}
+	}
+	return res
+}
+
+// shardSuffix returns the suffix of the name of the job expanded for the shard of the given index.
+func shardSuffix(index int) string {
+	return fmt.Sprintf("-shard-%d", index)
 }
 
-func applyMatrix(yamlStr string, matrix map[string][]string) []string {
+// applyPlatforms expands the jobs into one job per architecture and operating system they target.
+func applyPlatforms(jobs []Job) []Job {
+	res := make([]Job, 0, len(jobs))
+	for _, job := range jobs {
+		if len(job.Architectures) == 0 && len(job.OperatingSystems) == 0 {
+			if resource, ok := job.ArchResources[ArchAMD64]; ok {
+				job.Resource = resource
+			}
+			res = append(res, job)
+			continue
+		}
+		for _, system := range platformOperatingSystems(job) {
+			for _, arch := range platformArchitectures(job) {
+				platformJob := job
+				platformJob.OS = system
+				platformJob.Arch = arch
+				if resource, ok := job.ArchResources[arch]; ok {
+					platformJob.Resource = resource
+				}
+				platformJob.Name += platformSuffix(system, arch)
+				if job.PostsubmitName != "" {
+					platformJob.PostsubmitName += platformSuffix(system, arch)
+				}
+				platformJob.Aliases = nil
+				for _, alias := range job.Aliases {
+					platformJob.Aliases = append(platformJob.Aliases, alias+platformSuffix(system, arch))
+				}
+				platformJob.NodeSelector = mergeMaps(job.NodeSelector, map[string]string{
+					osNodeLabel:   system,
+					archNodeLabel: arch,
+				})
+				res = append(res, platformJob)
+			}
+		}
+	}
+	return res
+}
+
+// platformSuffix returns the suffix of the name of a job expanded for the platform.
+func platformSuffix(system, arch string) string {
+	suffix := ""
+	if system != OSLinux {
+		suffix += "-" + system
+	}
+	if arch != ArchAMD64 {
+		suffix += "-" + arch
+	}
+	return suffix
+}
+
+func platformArchitectures(job Job) []string {
+	if len(job.Architectures) == 0 {
+		return []string{ArchAMD64}
+	}
+	return job.Architectures
+}
+
+func platformOperatingSystems(job Job) []string {
+	if len(job.OperatingSystems) == 0 {
+		return []string{OSLinux}
+	}
+	return job.OperatingSystems
+}
+
+// platformTolerations returns the tolerations needed to schedule the job onto the node pools of its platform.
+func platformTolerations(job Job) []v1.Toleration {
+	var tolerations []v1.Toleration
+	// Jobs may target a platform through their node selector, e.g. set from a matrix dimension,
+	// rather than architectures and operating_systems.
+	arch, system := job.Arch, job.OS
+	if arch == "" {
+		arch = job.NodeSelector[archNodeLabel]
+	}
+	if system == "" {
+		system = job.NodeSelector[osNodeLabel]
+	}
+	if arch != "" && arch != ArchAMD64 {
+		tolerations = append(tolerations, v1.Toleration{
+			Key:      archNodeLabel,
+			Operator: v1.TolerationOpEqual,
+			Value:    arch,
+			Effect:   v1.TaintEffectNoSchedule,
+		})
+	}
+	if system == OSWindows {
+		tolerations = append(tolerations, v1.Toleration{
+			Key:      windowsNodeTaint,
+			Operator: v1.TolerationOpEqual,
+			Value:    OSWindows,
+			Effect:   v1.TaintEffectNoSchedule,
+		})
+	}
+	return tolerations
+}
+
+// checkVariables returns an error if the expanded job references variables that are neither matrix
+// dimensions nor env vars of the job, which Kubernetes would resolve in the command. The env vars of
+// the job include the ones of its env and requirement presets, from the file or the global config,
+// and the ones Prow sets.
+func checkVariables(job Job, jobsConfig JobsConfig, globalConfig GlobalConfig) error {
+	defined := sets.NewString(prowEnv.List()...)
+	for dim := range jobsConfig.Matrix {
+		defined.Insert("matrix." + dim)
+	}
+	envs := [][]v1.EnvVar{job.Env, jobsConfig.Env}
+	for _, preset := range job.EnvPresets {
+		env, f := jobsConfig.EnvPresets[preset]
+		if !f {
+			env = globalConfig.EnvPresets[preset]
+		}
+		envs = append(envs, env)
+	}
+	for _, req := range job.Requirements {
+		preset, f := jobsConfig.RequirementPresets[req]
+		if !f {
+			preset = globalConfig.RequirementPresets[req]
+		}
+		envs = append(envs, preset.Env)
+	}
+	for _, e := range joinEnv(envs...) {
+		defined.Insert(e.Name)
+	}
+
+	values := append([]string{job.Name}, job.Command...)
+	for _, schedule := range job.Schedules {
+		values = append(values, schedule.Args...)
+	}
+	for _, e := range joinEnv(job.Env, jobsConfig.Env) {
+		values = append(values, e.Value)
+	}
+	for _, k := range sets.StringKeySet(job.Labels).List() {
+		values = append(values, job.Labels[k])
+	}
+	for _, k := range sets.StringKeySet(job.Annotations).List() {
+		values = append(values, job.Annotations[k])
+	}
+	undefined := sets.NewString()
+	for _, value := range values {
+		for _, exp := range validateString(value) {
+			if !defined.Has(exp) {
+				undefined.Insert(exp)
+			}
+		}
+	}
+	if undefined.Len() > 0 {
+		return fmt.Errorf("undefined variables %v referenced, defined variables are %v", undefined.List(), defined.List())
+	}
+	return nil
+}
+
+// matrixCell is a job expanded from the matrix, along with the value of each dimension it was expanded with.
+type matrixCell struct {
+	yaml   string
+	values map[string]string
+}
+
+// isOptionalCell returns true if any of the values of the cell is marked optional.
+func isOptionalCell(optionalMatrix map[string][]string, values map[string]string) bool {
+	for dim, value := range values {
+		if sets.NewString(optionalMatrix[dim]...).Has(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func applyMatrix(yamlStr string, matrix map[string][]string, maxExpansion int) ([]matrixCell, error) {
 	subsExps := getVarSubstitutionExpressions(yamlStr)
 	if len(subsExps) == 0 {
-		return []string{yamlStr}
+		return []matrixCell{{yaml: yamlStr}}, nil
 	}
 
 	combs := make([]string, 0)
@@ -770,26 +3914,54 @@ func applyMatrix(yamlStr string, matrix map[string][]string) []string {
 			if _, ok := matrix[exp]; ok {
 				combs = append(combs, exp)
 			} else {
-				exit(errors.New("dimension is not configured in the matrix"), exp)
+				return nil, fmt.Errorf("%v: dimension is not configured in the matrix", exp)
 			}
 		}
 	}
 
-	res := &[]string{}
-	resolveCombinations(combs, yamlStr, 0, matrix, res)
-	return *res
+	if err := checkMatrixExpansion(combs, matrix, maxExpansion); err != nil {
+		return nil, err
+	}
+
+	res := &[]matrixCell{}
+	resolveCombinations(combs, yamlStr, map[string]string{}, 0, matrix, res)
+	return *res, nil
+}
+
+// checkMatrixExpansion returns an error if expanding the given dimensions of the matrix
+// would produce more than maxExpansion jobs. A maxExpansion of 0 means no limit.
+func checkMatrixExpansion(combs []string, matrix map[string][]string, maxExpansion int) error {
+	if maxExpansion <= 0 {
+		return nil
+	}
+	product := 1
+	dims := make([]string, 0, len(combs))
+	for _, comb := range combs {
+		product *= len(matrix[comb])
+		dims = append(dims, fmt.Sprintf("%s(%d)", comb, len(matrix[comb])))
+	}
+	if product > maxExpansion {
+		return fmt.Errorf("matrix expands to %d jobs (%s), exceeding the limit of %d",
+			product, strings.Join(dims, " x "), maxExpansion)
+	}
+	return nil
 }
 
-func resolveCombinations(combs []string, dest string, start int, matrix map[string][]string, res *[]string) {
+func resolveCombinations(combs []string, dest string, values map[string]string, start int, matrix map[string][]string, res *[]matrixCell) {
 	if start == len(combs) {
-		*res = append(*res, dest)
+		*res = append(*res, matrixCell{yaml: dest, values: values})
 		return
 	}
 
 	lst := matrix[combs[start]]
 	for i := range lst {
 		dest := replace(dest, combs[start], lst[i])
-		resolveCombinations(combs, dest, start+1, matrix, res)
+		cellValues := make(map[string]string, len(values)+1)
+		for k, v := range values {
+			cellValues[k] = v
+		}
+		cellValues[combs[start]] = lst[i]
+		resolveCombinations(combs, dest, cellValues, start+1, matrix, res)
 	}
 }
 
@@ -838,11 +4010,15 @@ func ReadProwJobConfig(file string) config.JobConfig {
 }
 
 // kubernetes API requires a pointer to a bool for some reason
-func newTrue() *bool {
-	b := true
+func newBool(b bool) *bool {
 	return &b
 }
 
+// isPrivileged returns whether the job runs privileged, which is the default.
+func isPrivileged(job Job) bool {
+	return job.Privileged == nil || *job.Privileged
+}
+
 // mergeMaps will merge multiple maps into one.
 // If there are duplicated keys in the maps, the value in the later maps will overwrite that of the previous ones.
 func mergeMaps(mps ...map[string]string) map[string]string {
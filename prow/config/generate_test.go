@@ -16,9 +16,20 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/sets"
+	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/config"
 )
 
 func TestGenerateConfig(t *testing.T) {
@@ -99,11 +110,36 @@ func TestFilterReleaseBranchingJobs(t *testing.T) {
 			},
 			filteredJobs: []Job{},
 		},
+		{
+			name: "filter jobs excluded from the release branch",
+			jobs: []Job{
+				{
+					Name:                    "job_1",
+					Command:                 []string{"exit", "0"},
+					ReleaseBranchExclusions: []string{"release-1.8"},
+					Types:                   []string{"presubmit"},
+				},
+				{
+					Name:                    "job_2",
+					Command:                 []string{"echo", "pass"},
+					ReleaseBranchExclusions: []string{"release-1.7"},
+					Types:                   []string{"postsubmit"},
+				},
+			},
+			filteredJobs: []Job{
+				{
+					Name:                    "job_2",
+					Command:                 []string{"echo", "pass"},
+					ReleaseBranchExclusions: []string{"release-1.7"},
+					Types:                   []string{"postsubmit"},
+				},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
 		expected := tc.filteredJobs
-		actual := FilterReleaseBranchingJobs(tc.jobs)
+		actual := FilterReleaseBranchingJobs(tc.jobs, "release-1.8")
 
 		if !reflect.DeepEqual(expected, actual) {
 			t.Errorf("Filtered jobs do not	 match; actual: %v\n expected %v\n", actual, expected)
@@ -158,3 +194,3096 @@ func TestMergeMaps(t *testing.T) {
 		}
 	}
 }
+
+func TestCheckMatrixExpansion(t *testing.T) {
+	matrix := map[string][]string{
+		"a": {"1", "2", "3"},
+		"b": {"x", "y"},
+	}
+	testCases := []struct {
+		name         string
+		combs        []string
+		maxExpansion int
+		expectErr    bool
+	}{
+		{
+			name:         "no limit",
+			combs:        []string{"a", "b"},
+			maxExpansion: 0,
+		},
+		{
+			name:         "within the limit",
+			combs:        []string{"a", "b"},
+			maxExpansion: 6,
+		},
+		{
+			name:         "exceeds the limit",
+			combs:        []string{"a", "b"},
+			maxExpansion: 5,
+			expectErr:    true,
+		},
+		{
+			name:         "only referenced dimensions count",
+			combs:        []string{"a"},
+			maxExpansion: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkMatrixExpansion(tc.combs, matrix, tc.maxExpansion)
+			if tc.expectErr && err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestResolveOverwritesRerunAuthConfig(t *testing.T) {
+	fileDefault := &prowjob.RerunAuthConfig{GitHubUsers: []string{"file-user"}}
+	jobOverride := &prowjob.RerunAuthConfig{GitHubUsers: []string{"job-user"}}
+	jobsConfig := JobsConfig{
+		RerunAuthConfig: fileDefault,
+		Jobs: []Job{
+			{Name: "default"},
+			{Name: "override", RerunAuthConfig: jobOverride},
+		},
+	}
+
+	resolved := resolveOverwrites(GlobalConfig{}, jobsConfig)
+	if !reflect.DeepEqual(resolved.Jobs[0].RerunAuthConfig, fileDefault) {
+		t.Errorf("expected file default %v, got %v", fileDefault, resolved.Jobs[0].RerunAuthConfig)
+	}
+	if !reflect.DeepEqual(resolved.Jobs[1].RerunAuthConfig, jobOverride) {
+		t.Errorf("expected job override %v, got %v", jobOverride, resolved.Jobs[1].RerunAuthConfig)
+	}
+	if hasRerunAuthorization(&prowjob.RerunAuthConfig{}) {
+		t.Errorf("expected an empty rerun_auth_config to grant no authorization")
+	}
+	if !hasRerunAuthorization(&prowjob.RerunAuthConfig{AllowAnyone: true}) {
+		t.Errorf("expected allow_anyone to grant authorization")
+	}
+
+	// An empty file-level default is reported even if every job overrides it.
+	cli := &Client{}
+	jobsConfig = resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:             "istio",
+		Repo:            "istio",
+		Image:           "image",
+		RerunAuthConfig: &prowjob.RerunAuthConfig{},
+		Jobs:            []Job{{Name: "override", Command: []string{"make"}, RerunAuthConfig: jobOverride}},
+	})
+	if err := cli.VerifyJobConfig("jobs.yaml", jobsConfig); err == nil || !strings.Contains(err.Error(), "jobs.yaml: rerun_auth_config must allow anyone") {
+		t.Errorf("expected the empty file-level rerun_auth_config to be rejected, got %v", err)
+	}
+}
+
+func TestPersistentCacheRequirement(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "cached", Types: []string{TypePresubmit}, Requirements: []string{"cache"}},
+			{Name: "uncached", Types: []string{TypePresubmit}},
+		},
+		RequirementPresets: map[string]RequirementPreset{
+			"cache": {
+				PersistentCache: &PersistentCache{ClaimName: "build-cache", MountPath: "/cache"},
+			},
+		},
+	}
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	presubmits := output.PresubmitsStatic["istio/istio"]
+	if len(presubmits) != 2 {
+		t.Fatalf("expected 2 presubmits, got %d", len(presubmits))
+	}
+
+	cached := presubmits[0].Spec
+	expectedVolume := v1.Volume{
+		Name: "build-cache",
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "build-cache"},
+		},
+	}
+	if !reflect.DeepEqual(cached.Volumes, []v1.Volume{expectedVolume}) {
+		t.Errorf("expected volumes %v, got %v", []v1.Volume{expectedVolume}, cached.Volumes)
+	}
+	expectedMount := v1.VolumeMount{Name: "build-cache", MountPath: "/cache"}
+	if !reflect.DeepEqual(cached.Containers[0].VolumeMounts, []v1.VolumeMount{expectedMount}) {
+		t.Errorf("expected volume mounts %v, got %v", []v1.VolumeMount{expectedMount}, cached.Containers[0].VolumeMounts)
+	}
+
+	uncached := presubmits[1].Spec
+	if len(uncached.Volumes) != 0 || len(uncached.Containers[0].VolumeMounts) != 0 {
+		t.Errorf("expected no cache mounted on job without the requirement, got %v and %v",
+			uncached.Volumes, uncached.Containers[0].VolumeMounts)
+	}
+
+	if err := validateRequirementPreset("cache", RequirementPreset{PersistentCache: &PersistentCache{MountPath: "/cache"}}); err == nil {
+		t.Errorf("expected an error for a persistent cache without a claim name")
+	}
+}
+
+func TestSecurityContext(t *testing.T) {
+	var user int64 = 1000
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:          "istio",
+		Repo:         "istio",
+		Image:        "image",
+		RunAsNonRoot: newBool(true),
+		RunAsUser:    &user,
+		FSGroup:      &user,
+		Jobs: []Job{
+			{Name: "non-root", Types: []string{TypePresubmit}, Privileged: newBool(false)},
+		},
+	})
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	spec := output.PresubmitsStatic["istio/istio"][0].Spec
+	expected := &v1.SecurityContext{
+		Privileged:   newBool(false),
+		RunAsUser:    &user,
+		RunAsNonRoot: newBool(true),
+	}
+	if !reflect.DeepEqual(spec.Containers[0].SecurityContext, expected) {
+		t.Errorf("expected container security context %v, got %v", expected, spec.Containers[0].SecurityContext)
+	}
+	if spec.SecurityContext == nil || !reflect.DeepEqual(spec.SecurityContext.FSGroup, &user) {
+		t.Errorf("expected pod security context with fsGroup %d, got %v", user, spec.SecurityContext)
+	}
+}
+
+func TestResolveGCSBucket(t *testing.T) {
+	testCases := []struct {
+		name     string
+		bucket   string
+		expected string
+	}{
+		{
+			name:     "literal bucket",
+			bucket:   "istio-prow",
+			expected: "istio-prow",
+		},
+		{
+			name:     "all placeholders",
+			bucket:   "{org}-{repo}-{branch}",
+			expected: "istio-proxy-release-1.8",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := resolveGCSBucket(tc.bucket, "istio", "proxy", "release-1.8")
+			if actual != tc.expected {
+				t.Errorf("expected bucket %q, got %q", tc.expected, actual)
+			}
+			if !gcsBucketRegex.MatchString(actual) {
+				t.Errorf("expected %q to be a valid bucket name", actual)
+			}
+		})
+	}
+}
+
+func TestApplyModifiersPostsubmit(t *testing.T) {
+	testCases := []struct {
+		name           string
+		modifiers      []string
+		skipReport     bool
+		reporterConfig *prowjob.ReporterConfig
+	}{
+		{
+			name:      "no modifiers",
+			modifiers: nil,
+		},
+		{
+			name:       "hidden",
+			modifiers:  []string{ModifierHidden},
+			skipReport: true,
+		},
+		{
+			name:       "report-on-failure-only",
+			modifiers:  []string{ModifierReportOnFailureOnly},
+			skipReport: true,
+			reporterConfig: &prowjob.ReporterConfig{Slack: &prowjob.SlackReporterConfig{
+				JobStatesToReport: []prowjob.ProwJobState{prowjob.FailureState, prowjob.ErrorState},
+			}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			postsubmit := config.Postsubmit{}
+			applyModifiersPostsubmit(&postsubmit, tc.modifiers)
+			if postsubmit.SkipReport != tc.skipReport {
+				t.Errorf("expected skip_report %v, got %v", tc.skipReport, postsubmit.SkipReport)
+			}
+			if !reflect.DeepEqual(postsubmit.ReporterConfig, tc.reporterConfig) {
+				t.Errorf("expected reporter_config %v, got %v", tc.reporterConfig, postsubmit.ReporterConfig)
+			}
+		})
+	}
+}
+
+func TestValidateReportOnFailureOnly(t *testing.T) {
+	cli := &Client{}
+	for _, tc := range []struct {
+		types []string
+		err   bool
+	}{
+		// Jobs without types generate a postsubmit along with their presubmit.
+		{types: nil},
+		{types: []string{TypePostsubmit}},
+		{types: []string{TypePresubmit, TypePostsubmit}},
+		{types: []string{TypePresubmit}, err: true},
+		{types: []string{TypePeriodic}, err: true},
+	} {
+		jobsConfig := JobsConfig{
+			Org:   "istio",
+			Repo:  "istio",
+			Image: "image",
+			Jobs: []Job{{Name: "publish", Command: []string{"make", "publish"}, Types: tc.types, Cron: "0 4 * * *",
+				Modifiers: []string{ModifierReportOnFailureOnly}}},
+		}
+		if err := cli.VerifyJobConfig("jobs.yaml", jobsConfig); (err != nil) != tc.err {
+			t.Errorf("types %v: expected an error %v, got %v", tc.types, tc.err, err)
+		}
+	}
+}
+
+func TestTideQueryLabel(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "gate", Types: []string{TypePresubmit}, TideQueryLabel: "release-gate"},
+			{Name: "unit", Types: []string{TypePresubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	if label, annotation := presubmits[0].Labels[TideQueryLabel], presubmits[0].Annotations[TideQueryAnnotation]; label != "release-gate" || annotation != "release-gate" {
+		t.Errorf("expected the tide query release-gate in the label and annotation, got %q and %q", label, annotation)
+	}
+	if _, f := presubmits[1].Labels[TideQueryLabel]; f {
+		t.Errorf("expected no tide query label on job %v, got %v", presubmits[1].Name, presubmits[1].Labels)
+	}
+	if _, f := presubmits[1].Annotations[TideQueryAnnotation]; f {
+		t.Errorf("expected no tide query annotation on job %v, got %v", presubmits[1].Name, presubmits[1].Annotations)
+	}
+
+	for label, valid := range map[string]bool{"release-gate": true, "gate1": true, "Release-Gate": false, "-gate": false, "gate-": false, "release_gate": false} {
+		if tideQueryLabelRegex.MatchString(label) != valid {
+			t.Errorf("expected %v to be a valid tide query label: %v", label, valid)
+		}
+	}
+}
+
+func TestPeriodicSchedules(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{
+				Name:    "e2e",
+				Types:   []string{TypePeriodic},
+				Command: []string{"e2e.sh"},
+				Schedules: []Schedule{
+					{Name: "smoke", Interval: "15m", Args: []string{"--smoke"}},
+					{Name: "full", Cron: "0 2 * * *"},
+				},
+			},
+		},
+	}
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	if len(output.Periodics) != 2 {
+		t.Fatalf("expected 2 periodics, got %d", len(output.Periodics))
+	}
+	smoke, full := output.Periodics[0], output.Periodics[1]
+	if smoke.Name != "e2e-smoke_istio_periodic" || smoke.Interval != "15m" || smoke.Cron != "" {
+		t.Errorf("unexpected smoke periodic: name %v, interval %v, cron %v", smoke.Name, smoke.Interval, smoke.Cron)
+	}
+	if !reflect.DeepEqual(smoke.Spec.Containers[0].Command, []string{"e2e.sh", "--smoke"}) {
+		t.Errorf("unexpected smoke command: %v", smoke.Spec.Containers[0].Command)
+	}
+	if full.Name != "e2e-full_istio_periodic" || full.Cron != "0 2 * * *" || full.Interval != "" {
+		t.Errorf("unexpected full periodic: name %v, interval %v, cron %v", full.Name, full.Interval, full.Cron)
+	}
+	if !reflect.DeepEqual(full.Spec.Containers[0].Command, []string{"e2e.sh"}) {
+		t.Errorf("unexpected full command: %v", full.Spec.Containers[0].Command)
+	}
+}
+
+func TestAssignCluster(t *testing.T) {
+	pool := []string{"a", "b", "c"}
+	assigned := sets.NewString()
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("job-%d", i)
+		cluster := assignCluster(name, pool, nil)
+		if !sets.NewString(pool...).Has(cluster) {
+			t.Fatalf("job %v assigned to cluster %v outside of the pool", name, cluster)
+		}
+		if again := assignCluster(name, pool, nil); again != cluster {
+			t.Errorf("job %v assignment is not stable: %v != %v", name, cluster, again)
+		}
+		assigned.Insert(cluster)
+	}
+	if assigned.Len() != len(pool) {
+		t.Errorf("expected jobs to be spread across all clusters, got %v", assigned.List())
+	}
+	if cluster := assignCluster("job", nil, nil); cluster != "" {
+		t.Errorf("expected no cluster for an empty pool, got %v", cluster)
+	}
+}
+
+func TestValidateCheckoutPaths(t *testing.T) {
+	pathAliases := map[string]string{"istio": "istio.io", "istio-ecosystem": "istio.io"}
+	testCases := []struct {
+		name      string
+		repos     []string
+		expectErr bool
+	}{
+		{
+			name:  "no extra repos",
+			repos: nil,
+		},
+		{
+			name:  "distinct repos",
+			repos: []string{"istio/tools", "istio/test-infra@master"},
+		},
+		{
+			name:      "primary repo listed again",
+			repos:     []string{"istio/istio@master"},
+			expectErr: true,
+		},
+		{
+			name:      "repos of different orgs sharing an alias",
+			repos:     []string{"istio/tools", "istio-ecosystem/tools"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateCheckoutPaths("istio", "istio", "", tc.repos, pathAliases)
+			if tc.expectErr && err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOptionalMatrix(t *testing.T) {
+	matrix := map[string][]string{
+		"go":   {"1.13", "1.14"},
+		"arch": {"amd64", "arm64"},
+	}
+	job := Job{
+		Name:           "unit-$(matrix.go)-$(matrix.arch)",
+		OptionalMatrix: map[string][]string{"arch": {"arm64"}},
+	}
+
+	expected := map[string]bool{
+		"unit-1.13-amd64": false,
+		"unit-1.13-arm64": true,
+		"unit-1.14-amd64": false,
+		"unit-1.14-arm64": true,
+	}
+	jobs, err := applyMatrixJob(job, matrix, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != len(expected) {
+		t.Fatalf("expected %d jobs, got %d", len(expected), len(jobs))
+	}
+	for _, j := range jobs {
+		optional := sets.NewString(j.Modifiers...).Has(ModifierOptional)
+		if want, f := expected[j.Name]; !f || optional != want {
+			t.Errorf("job %v: expected optional %v, got %v", j.Name, want, optional)
+		}
+	}
+}
+
+func TestNodeSelectorMergeStrategy(t *testing.T) {
+	global := GlobalConfig{NodeSelector: map[string]string{"pool": "default", "arch": "amd64"}}
+	testCases := []struct {
+		name             string
+		fileStrategy     string
+		jobStrategy      string
+		jobNodeSelector  map[string]string
+		expectedSelector map[string]string
+	}{
+		{
+			name:             "replace by default",
+			jobNodeSelector:  map[string]string{"pool": "large"},
+			expectedSelector: map[string]string{"pool": "large"},
+		},
+		{
+			name:             "merge from file",
+			fileStrategy:     NodeSelectorMergeMerge,
+			jobNodeSelector:  map[string]string{"pool": "large"},
+			expectedSelector: map[string]string{"pool": "large", "arch": "amd64"},
+		},
+		{
+			name:             "job overrides file strategy",
+			fileStrategy:     NodeSelectorMergeMerge,
+			jobStrategy:      NodeSelectorMergeReplace,
+			jobNodeSelector:  map[string]string{"pool": "large"},
+			expectedSelector: map[string]string{"pool": "large"},
+		},
+		{
+			name:             "inherit when unset",
+			fileStrategy:     NodeSelectorMergeMerge,
+			expectedSelector: map[string]string{"pool": "default", "arch": "amd64"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jobsConfig := resolveOverwrites(global, JobsConfig{
+				NodeSelectorMergeStrategy: tc.fileStrategy,
+				Jobs: []Job{{
+					Name:                      "unit",
+					NodeSelector:              tc.jobNodeSelector,
+					NodeSelectorMergeStrategy: tc.jobStrategy,
+				}},
+			})
+			if actual := jobsConfig.Jobs[0].NodeSelector; !reflect.DeepEqual(actual, tc.expectedSelector) {
+				t.Errorf("expected node selector %v, got %v", tc.expectedSelector, actual)
+			}
+		})
+	}
+}
+
+func TestProjectedToken(t *testing.T) {
+	cli := &Client{}
+	expiration := int64(3600)
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:               "oidc",
+			Types:              []string{TypePresubmit},
+			ServiceAccountName: "prober",
+			ProjectedToken:     &ProjectedToken{Audience: "sts.example.com", ExpirationSeconds: &expiration},
+		}},
+	}
+
+	spec := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].Spec
+	if spec.ServiceAccountName != "prober" {
+		t.Errorf("expected service account prober, got %v", spec.ServiceAccountName)
+	}
+	expectedVolumes := []v1.Volume{{
+		Name: projectedTokenVolume,
+		VolumeSource: v1.VolumeSource{
+			Projected: &v1.ProjectedVolumeSource{
+				Sources: []v1.VolumeProjection{{
+					ServiceAccountToken: &v1.ServiceAccountTokenProjection{
+						Audience:          "sts.example.com",
+						ExpirationSeconds: &expiration,
+						Path:              projectedTokenPath,
+					},
+				}},
+			},
+		},
+	}}
+	if !reflect.DeepEqual(spec.Volumes, expectedVolumes) {
+		t.Errorf("expected volumes %v, got %v", expectedVolumes, spec.Volumes)
+	}
+	expectedMounts := []v1.VolumeMount{{Name: projectedTokenVolume, MountPath: projectedTokenMountPath, ReadOnly: true}}
+	if !reflect.DeepEqual(spec.Containers[0].VolumeMounts, expectedMounts) {
+		t.Errorf("expected volume mounts %v, got %v", expectedMounts, spec.Containers[0].VolumeMounts)
+	}
+}
+
+func TestVersionStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(v string) { Version = v }(Version)
+
+	jobs := config.JobConfig{Periodics: []config.Periodic{{JobBase: config.JobBase{Name: "periodic"}}}}
+	fname := filepath.Join(dir, "jobs.gen.yaml")
+	// The default header does not end with a newline, unlike the one of the global config.
+	for _, header := range []string{DefaultAutogenHeader, "# THIS FILE IS AUTOGENERATED. See prow/config/README.md\n"} {
+		cli := &Client{GlobalConfig: GlobalConfig{AutogenHeader: header}}
+
+		Version = "v1.2.3"
+		cli.WriteConfig(jobs, fname)
+		output, err := ioutil.ReadFile(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedPrefix := strings.TrimSuffix(header, "\n") + "\n" + versionStampPrefix + "v1.2.3\n"
+		if !strings.HasPrefix(string(output), expectedPrefix) {
+			t.Errorf("expected output to start with %q, got %q", expectedPrefix, string(output))
+		}
+
+		Version = "v1.2.4"
+		if err := cli.CheckConfig(jobs, fname); err != nil {
+			t.Errorf("expected the version stamp to be ignored, got %v", err)
+		}
+		jobs.Periodics[0].Name = "other"
+		if err := cli.CheckConfig(jobs, fname); err == nil {
+			t.Error("expected a changed job to be reported despite the version stamp")
+		}
+		jobs.Periodics[0].Name = "periodic"
+
+		Version = ""
+		cli.WriteConfig(jobs, fname)
+		if err := cli.CheckConfig(jobs, fname); err != nil {
+			t.Errorf("expected no drift for an unstamped file, got %v", err)
+		}
+	}
+}
+
+func TestTypeSpecificLabels(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:             "e2e",
+			Types:            []string{TypePresubmit, TypePostsubmit},
+			Labels:           map[string]string{"shared": "true"},
+			PresubmitLabels:  map[string]string{"presubmit": "true"},
+			PostsubmitLabels: map[string]string{"postsubmit": "true"},
+		}},
+	}
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	expectedPresubmit := map[string]string{"shared": "true", "presubmit": "true"}
+	if actual := output.PresubmitsStatic["istio/istio"][0].Labels; !reflect.DeepEqual(actual, expectedPresubmit) {
+		t.Errorf("expected presubmit labels %v, got %v", expectedPresubmit, actual)
+	}
+	expectedPostsubmit := map[string]string{"shared": "true", "postsubmit": "true"}
+	if actual := output.PostsubmitsStatic["istio/istio"][0].Labels; !reflect.DeepEqual(actual, expectedPostsubmit) {
+		t.Errorf("expected postsubmit labels %v, got %v", expectedPostsubmit, actual)
+	}
+}
+
+func TestConflictingLabels(t *testing.T) {
+	shared := map[string]string{"a": "1", "b": "2"}
+	if errs := conflictingLabels(shared, map[string]string{"a": "1", "c": "3"}, "presubmit_labels"); len(errs) != 0 {
+		t.Errorf("expected no conflicts, got %v", errs)
+	}
+	if errs := conflictingLabels(shared, map[string]string{"a": "2", "b": "3"}, "presubmit_labels"); len(errs) != 2 {
+		t.Errorf("expected 2 conflicts, got %v", errs)
+	}
+}
+
+func TestLongestJobName(t *testing.T) {
+	jobsConfig := JobsConfig{
+		Repo:     "istio",
+		Branches: []string{"master", "release-1.10"},
+		Matrix:   map[string][]string{"k8s": {"1.17", "1.18-rc"}},
+	}
+	testCases := []struct {
+		name     string
+		job      Job
+		expected string
+	}{
+		{
+			name:     "presubmit",
+			job:      Job{Name: "unit", Types: []string{TypePresubmit}},
+			expected: "unit_istio_release-1.10",
+		},
+		{
+			name:     "default types",
+			job:      Job{Name: "unit"},
+			expected: "unit_istio_release-1.10_postsubmit",
+		},
+		{
+			name:     "matrix",
+			job:      Job{Name: "e2e-$(matrix.k8s)", Types: []string{TypePresubmit}},
+			expected: "e2e-1.18-rc_istio_release-1.10",
+		},
+		{
+			name: "periodic schedules",
+			job: Job{Name: "perf", Types: []string{TypePeriodic},
+				Schedules: []Schedule{{Name: "daily"}, {Name: "weekly"}}},
+			expected: "perf-weekly_istio_release-1.10_periodic",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if actual := longestJobName(tc.job, jobsConfig); actual != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestCensorSecrets(t *testing.T) {
+	presets := map[string]RequirementPreset{
+		"github": {Volumes: []v1.Volume{
+			{Name: "github", VolumeSource: v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: "github-token"}}},
+			{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		}},
+		"docker": {Volumes: []v1.Volume{
+			{Name: "docker", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}},
+		}},
+	}
+	if actual := secretVolumes([]string{"github", "docker"}, presets); !reflect.DeepEqual(actual, []string{"github"}) {
+		t.Errorf("expected secret volumes [github], got %v", actual)
+	}
+	if actual := secretVolumes([]string{"docker"}, presets); len(actual) != 0 {
+		t.Errorf("expected no secret volumes, got %v", actual)
+	}
+
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:                "istio",
+		Repo:               "istio",
+		Image:              "image",
+		RequirementPresets: presets,
+		Jobs: []Job{{
+			Name:          "secrets",
+			Types:         []string{TypePresubmit},
+			Requirements:  []string{"github"},
+			CensorSecrets: true,
+		}},
+	}
+	dc := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].DecorationConfig
+	if dc == nil || dc.CensorSecrets == nil || !*dc.CensorSecrets {
+		t.Errorf("expected secrets to be censored, got %v", dc)
+	}
+}
+
+func TestResolveMatrixFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, ".matrix.yaml")
+	if err := ioutil.WriteFile(fname, []byte(`{"go": ["1.13", "1.14"], "k8s": ["1.17"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	matrix, err := resolveMatrixFile(fname, map[string][]string{"k8s": {"1.18"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := map[string][]string{"go": {"1.13", "1.14"}, "k8s": {"1.18"}}
+	if !reflect.DeepEqual(matrix, expected) {
+		t.Errorf("expected matrix %v, got %v", expected, matrix)
+	}
+
+	if _, err := resolveMatrixFile(filepath.Join(dir, "missing.yaml"), nil); err == nil {
+		t.Errorf("expected an error for a missing matrix file")
+	}
+}
+
+func TestCheckConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cli := &Client{GlobalConfig: GlobalConfig{AutogenHeader: DefaultAutogenHeader + "\n"}}
+	upToDate := config.JobConfig{Periodics: []config.Periodic{{JobBase: config.JobBase{Name: "up-to-date"}}}}
+	drifted := config.JobConfig{Periodics: []config.Periodic{{JobBase: config.JobBase{Name: "drifted"}}}}
+	upToDateFile := filepath.Join(dir, "up-to-date.gen.yaml")
+	driftedFile := filepath.Join(dir, "drifted.gen.yaml")
+	missingFile := filepath.Join(dir, "missing.gen.yaml")
+	cli.WriteConfig(upToDate, upToDateFile)
+	cli.WriteConfig(upToDate, driftedFile)
+
+	result, err := cli.CheckConfigs(map[string]config.JobConfig{
+		upToDateFile: upToDate,
+		driftedFile:  drifted,
+		missingFile:  upToDate,
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !result.HasDrift() || !reflect.DeepEqual(result.Drifted, []string{driftedFile}) {
+		t.Errorf("expected drifted files %v, got %v", []string{driftedFile}, result.Drifted)
+	}
+	if !reflect.DeepEqual(result.Missing, []string{missingFile}) {
+		t.Errorf("expected missing files %v, got %v", []string{missingFile}, result.Missing)
+	}
+	if result, err := cli.CheckConfigs(map[string]config.JobConfig{missingFile: upToDate}); err != nil || !result.HasDrift() {
+		t.Errorf("expected a missing file to be reported as drift, got %v, %v", result, err)
+	}
+
+	if _, err := cli.CheckConfigs(map[string]config.JobConfig{dir: upToDate}); err == nil {
+		t.Errorf("expected an error when the file cannot be read")
+	}
+}
+
+func TestEnvPresets(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(GlobalConfig{
+		EnvPresets: map[string][]v1.EnvVar{
+			"gcp": {{Name: "PROJECT", Value: "global"}, {Name: "CREDENTIALS", Value: "/etc/sa.json"}},
+		},
+	}, JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Env:   []v1.EnvVar{{Name: "CREDENTIALS", Value: "file"}, {Name: "FILE", Value: "file"}},
+		EnvPresets: map[string][]v1.EnvVar{
+			"proxy": {{Name: "HTTP_PROXY", Value: "proxy"}, {Name: "PROJECT", Value: "proxy"}},
+		},
+		Jobs: []Job{{
+			Name:       "gcp",
+			Types:      []string{TypePresubmit},
+			Env:        []v1.EnvVar{{Name: "PROJECT", Value: "job"}},
+			EnvPresets: []string{"gcp", "proxy"},
+		}},
+	})
+
+	expected := []v1.EnvVar{
+		{Name: "PROJECT", Value: "job"},
+		{Name: "CREDENTIALS", Value: "/etc/sa.json"},
+		{Name: "HTTP_PROXY", Value: "proxy"},
+		{Name: "FILE", Value: "file"},
+	}
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	if actual := output.PresubmitsStatic["istio/istio"][0].Spec.Containers[0].Env; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected env %v, got %v", expected, actual)
+	}
+}
+
+func TestApplyPlatforms(t *testing.T) {
+	jobs := applyPlatforms([]Job{
+		{Name: "unit"},
+		{Name: "e2e", Architectures: []string{ArchAMD64, ArchARM64}, NodeSelector: map[string]string{"pool": "build"}},
+		{Name: "win", OperatingSystems: []string{OSWindows}},
+	})
+
+	expected := []struct {
+		name         string
+		nodeSelector map[string]string
+		tolerations  []v1.Toleration
+	}{
+		{name: "unit"},
+		{
+			name:         "e2e",
+			nodeSelector: map[string]string{"pool": "build", osNodeLabel: OSLinux, archNodeLabel: ArchAMD64},
+		},
+		{
+			name:         "e2e-arm64",
+			nodeSelector: map[string]string{"pool": "build", osNodeLabel: OSLinux, archNodeLabel: ArchARM64},
+			tolerations: []v1.Toleration{{
+				Key: archNodeLabel, Operator: v1.TolerationOpEqual, Value: ArchARM64, Effect: v1.TaintEffectNoSchedule,
+			}},
+		},
+		{
+			name:         "win-windows",
+			nodeSelector: map[string]string{osNodeLabel: OSWindows, archNodeLabel: ArchAMD64},
+			tolerations: []v1.Toleration{{
+				Key: windowsNodeTaint, Operator: v1.TolerationOpEqual, Value: OSWindows, Effect: v1.TaintEffectNoSchedule,
+			}},
+		},
+	}
+	if len(jobs) != len(expected) {
+		t.Fatalf("expected %d jobs, got %d", len(expected), len(jobs))
+	}
+	for i, e := range expected {
+		if jobs[i].Name != e.name {
+			t.Errorf("expected job %v, got %v", e.name, jobs[i].Name)
+		}
+		if !reflect.DeepEqual(jobs[i].NodeSelector, e.nodeSelector) {
+			t.Errorf("job %v: expected node selector %v, got %v", e.name, e.nodeSelector, jobs[i].NodeSelector)
+		}
+		if actual := platformTolerations(jobs[i]); !reflect.DeepEqual(actual, e.tolerations) {
+			t.Errorf("job %v: expected tolerations %v, got %v", e.name, e.tolerations, actual)
+		}
+	}
+}
+
+func TestWindowsJobIsNotPrivileged(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{AutomountServiceAccountToken: map[string]bool{"default": false}}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:                  "win",
+			Types:                 []string{TypePresubmit},
+			OperatingSystems:      []string{OSLinux, OSWindows},
+			ShareProcessNamespace: newBool(true),
+			ProjectedToken:        &ProjectedToken{Audience: "sts.googleapis.com"},
+		}},
+	}
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	if len(presubmits) != 2 {
+		t.Fatalf("expected a linux and a windows job, got %d jobs", len(presubmits))
+	}
+	linux, windows := presubmits[0], presubmits[1]
+	if windows.Name != "win-windows_istio" {
+		t.Errorf("expected job win-windows_istio, got %v", windows.Name)
+	}
+	if sc := windows.Spec.Containers[0].SecurityContext; sc != nil {
+		t.Errorf("expected no security context, got %v", sc)
+	}
+	if spec := windows.Spec; spec.AutomountServiceAccountToken != nil || spec.ShareProcessNamespace != nil || len(spec.Volumes) > 0 {
+		t.Errorf("expected no Linux-only pod settings on windows, got automount %v, share_process_namespace %v and volumes %v",
+			spec.AutomountServiceAccountToken, spec.ShareProcessNamespace, spec.Volumes)
+	}
+	if spec := linux.Spec; spec.AutomountServiceAccountToken == nil || spec.ShareProcessNamespace == nil || len(spec.Volumes) != 1 {
+		t.Errorf("expected the Linux-only pod settings on linux, got automount %v, share_process_namespace %v and volumes %v",
+			spec.AutomountServiceAccountToken, spec.ShareProcessNamespace, spec.Volumes)
+	}
+}
+
+func TestTypeSpecificRegex(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:            "docs",
+			Regex:           "^docs/",
+			PostsubmitRegex: "^(docs|content)/",
+		}},
+	}
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	if actual := output.PresubmitsStatic["istio/istio"][0].RunIfChanged; actual != "^docs/" {
+		t.Errorf("expected presubmit run_if_changed ^docs/, got %v", actual)
+	}
+	if actual := output.PostsubmitsStatic["istio/istio"][0].RunIfChanged; actual != "^(docs|content)/" {
+		t.Errorf("expected postsubmit run_if_changed ^(docs|content)/, got %v", actual)
+	}
+}
+
+func TestTestgridAnnotationPrecedence(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{TestgridConfig: TestgridConfig{Enabled: true, AlertEmail: "oncall@istio.io"}}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:        "unit",
+			Types:       []string{TypePostsubmit},
+			Annotations: map[string]string{TestGridDashboard: "custom-dashboard"},
+		}},
+	}
+
+	annotations := cli.ConvertJobConfig(jobsConfig, "master").PostsubmitsStatic["istio/istio"][0].Annotations
+	if annotations[TestGridDashboard] != "custom-dashboard" {
+		t.Errorf("expected the author's dashboard to win, got %v", annotations[TestGridDashboard])
+	}
+	if annotations[TestGridAlertEmail] != "oncall@istio.io" {
+		t.Errorf("expected the generated alert email, got %v", annotations[TestGridAlertEmail])
+	}
+}
+
+func TestQuotaScopeLabel(t *testing.T) {
+	testCases := []struct {
+		name       string
+		quotaScope string
+		expected   string
+	}{
+		{name: "derived from org and repo", expected: "istio-istio"},
+		{name: "overridden", quotaScope: "shared", expected: "shared"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cli := &Client{GlobalConfig: GlobalConfig{QuotaScopeLabel: "prow.istio.io/quota-scope"}}
+			jobsConfig := JobsConfig{
+				Org:        "istio",
+				Repo:       "istio",
+				Image:      "image",
+				QuotaScope: tc.quotaScope,
+				Jobs:       []Job{{Name: "unit", Types: []string{TypePresubmit}}},
+			}
+			labels := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].Labels
+			if actual := labels["prow.istio.io/quota-scope"]; actual != tc.expected {
+				t.Errorf("expected quota scope %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestOptionalIfFlag(t *testing.T) {
+	testCases := []struct {
+		name     string
+		override map[string]bool
+		expected bool
+	}{
+		{name: "declared default", expected: false},
+		{name: "overridden", override: map[string]bool{"rollout": true}, expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cli := &Client{
+				GlobalConfig: GlobalConfig{FeatureFlags: map[string]bool{"rollout": false}},
+				FeatureFlags: tc.override,
+			}
+			jobsConfig := JobsConfig{
+				Org:   "istio",
+				Repo:  "istio",
+				Image: "image",
+				Jobs:  []Job{{Name: "lint", Types: []string{TypePresubmit}, OptionalIfFlag: "rollout"}},
+			}
+			presubmit := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0]
+			if presubmit.Optional != tc.expected {
+				t.Errorf("expected optional %v, got %v", tc.expected, presubmit.Optional)
+			}
+		})
+	}
+}
+
+func TestMeshInject(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:        "istio",
+		Repo:       "istio",
+		Image:      "image",
+		MeshInject: newBool(false),
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}},
+			{Name: "injected", Types: []string{TypePresubmit}, MeshInject: newBool(true)},
+		},
+	})
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	if actual := presubmits[0].Annotations[MeshInjectAnnotation]; actual != "false" {
+		t.Errorf("expected the file default false, got %q", actual)
+	}
+	if actual := presubmits[1].Annotations[MeshInjectAnnotation]; actual != "true" {
+		t.Errorf("expected the job override true, got %q", actual)
+	}
+}
+
+func TestLensHints(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs:  []Job{{Name: "coverage", Types: []string{TypePresubmit}, LensHints: []string{"coverage", "junit"}}},
+	}
+
+	annotations := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].Annotations
+	if actual := annotations[LensHintsAnnotation]; actual != "coverage,junit" {
+		t.Errorf("expected lens hints coverage,junit, got %q", actual)
+	}
+}
+
+func TestCheckVariables(t *testing.T) {
+	jobsConfig := JobsConfig{
+		Matrix:             map[string][]string{"go": {"1.14"}},
+		Env:                []v1.EnvVar{{Name: "OUT", Value: "/out"}},
+		RequirementPresets: map[string]RequirementPreset{"gcp": {Env: []v1.EnvVar{{Name: "GOOGLE_APPLICATION_CREDENTIALS"}}}},
+	}
+	globalConfig := GlobalConfig{EnvPresets: map[string][]v1.EnvVar{"proxy": {{Name: "HTTP_PROXY", Value: "proxy"}}}}
+	testCases := []struct {
+		name      string
+		job       Job
+		fileEnv   []v1.EnvVar
+		expectErr bool
+	}{
+		{
+			name: "env var references",
+			job:  Job{Name: "unit", Command: []string{"make", "test", "OUT=$(OUT)"}},
+		},
+		{
+			name: "prow env var references",
+			job:  Job{Name: "unit", Command: []string{"make", "test", "ARTIFACTS=$(ARTIFACTS)", "PR=$(PULL_NUMBER)"}},
+		},
+		{
+			name: "preset env var references",
+			job: Job{Name: "unit", Command: []string{"make", "test", "PROXY=$(HTTP_PROXY)", "CREDS=$(GOOGLE_APPLICATION_CREDENTIALS)"},
+				EnvPresets: []string{"proxy"}, Requirements: []string{"gcp"}},
+		},
+		{
+			name:      "env var of an unused preset",
+			job:       Job{Name: "unit", Command: []string{"make", "test", "PROXY=$(HTTP_PROXY)"}},
+			expectErr: true,
+		},
+		{
+			name:      "undefined variable in command",
+			job:       Job{Name: "unit", Command: []string{"make", "test", "GO=$(matrix.golang)"}},
+			expectErr: true,
+		},
+		{
+			name:      "undefined variable in labels",
+			job:       Job{Name: "unit", Labels: map[string]string{"version": "$(version)"}},
+			expectErr: true,
+		},
+		{
+			name:      "undefined variable in file env",
+			job:       Job{Name: "unit"},
+			fileEnv:   []v1.EnvVar{{Name: "OUT", Value: "$(OUTPUT_DIR)/out"}},
+			expectErr: true,
+		},
+		{
+			name:    "file env overridden by the job",
+			job:     Job{Name: "unit", Env: []v1.EnvVar{{Name: "OUT", Value: "$(ARTIFACTS)/out"}}},
+			fileEnv: []v1.EnvVar{{Name: "OUT", Value: "$(OUTPUT_DIR)/out"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jobsConfig := jobsConfig
+			if tc.fileEnv != nil {
+				jobsConfig.Env = tc.fileEnv
+			}
+			err := checkVariables(tc.job, jobsConfig, globalConfig)
+			if tc.expectErr && err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+			if !tc.expectErr && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOauthTokenSecret(t *testing.T) {
+	cli := &Client{}
+	timeout := &prowjob.Duration{Duration: time.Hour}
+	secret := &prowjob.OauthTokenSecret{Name: "github-token", Key: "oauth"}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:             "commenter",
+			Types:            []string{TypePresubmit},
+			Timeout:          timeout,
+			GCSLogBucket:     "istio-prow",
+			OauthTokenSecret: secret,
+		}},
+	}
+
+	dc := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].DecorationConfig
+	if dc == nil {
+		t.Fatalf("expected a decoration config")
+	}
+	if !reflect.DeepEqual(dc.OauthTokenSecret, secret) {
+		t.Errorf("expected oauth token secret %v, got %v", secret, dc.OauthTokenSecret)
+	}
+	if dc.Timeout == nil || dc.Timeout.Duration != time.Hour || dc.GCSConfiguration == nil || dc.GCSConfiguration.Bucket != "istio-prow" {
+		t.Errorf("expected the timeout and gcs configuration to be kept, got %v", dc)
+	}
+}
+
+func TestRequiredImage(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs:  []Job{{Name: "image", Types: []string{TypePresubmit}, RequiredImage: "gcr.io/istio-testing/pilot:latest"}},
+	}
+
+	presubmit := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0]
+	if actual := presubmit.Annotations[RequiredImageAnnotation]; actual != "gcr.io/istio-testing/pilot:latest" {
+		t.Errorf("expected the required image annotation, got %q", actual)
+	}
+	if len(presubmit.Spec.InitContainers) != 1 || presubmit.Spec.InitContainers[0].Image != DefaultImagePoller {
+		t.Errorf("expected an init container waiting for the image, got %v", presubmit.Spec.InitContainers)
+	}
+}
+
+func TestImageReferenceFormat(t *testing.T) {
+	valid := []string{
+		"gcr.io/istio-testing/pilot:latest",
+		"localhost:5000/pilot",
+		"gcr.io/istio-testing/pilot@sha256:" + strings.Repeat("a", 64),
+	}
+	invalid := []string{"pilot", "gcr.io/istio-testing/Pilot:latest", "gcr.io/istio-testing/pilot:", "gcr.io//pilot"}
+	for _, image := range valid {
+		if !imageReferenceRegex.MatchString(image) {
+			t.Errorf("expected %v to be valid", image)
+		}
+	}
+	for _, image := range invalid {
+		if imageReferenceRegex.MatchString(image) {
+			t.Errorf("expected %v to be invalid", image)
+		}
+	}
+}
+
+func TestBranchImages(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:         "unit",
+			Image:        "image",
+			Types:        []string{TypePresubmit},
+			BranchImages: map[string]string{"release-1.20": "image-1.20"},
+		}},
+	}
+
+	for branch, expected := range map[string]string{"master": "image", "release-1.20": "image-1.20"} {
+		presubmit := cli.ConvertJobConfig(jobsConfig, branch).PresubmitsStatic["istio/istio"][0]
+		if actual := presubmit.Spec.Containers[0].Image; actual != expected {
+			t.Errorf("branch %v: expected image %v, got %v", branch, expected, actual)
+		}
+	}
+}
+
+func TestCloneOptions(t *testing.T) {
+	cli := &Client{}
+	depth, fullDepth := 1, 0
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:            "istio",
+		Repo:           "istio",
+		Image:          "image",
+		CloneDepth:     &depth,
+		SkipSubmodules: newBool(true),
+		Jobs: []Job{
+			{Name: "shallow", Types: []string{TypePresubmit}, Repos: []string{"istio/tools"}},
+			{Name: "full", Types: []string{TypePresubmit}, CloneDepth: &fullDepth},
+		},
+	})
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	shallow := presubmits[0].UtilityConfig
+	if shallow.CloneDepth != 1 || !shallow.SkipSubmodules {
+		t.Errorf("expected the file clone options, got depth %v and skip submodules %v", shallow.CloneDepth, shallow.SkipSubmodules)
+	}
+	if shallow.ExtraRefs[0].CloneDepth != 1 || !shallow.ExtraRefs[0].SkipSubmodules {
+		t.Errorf("expected the clone options to apply to extra refs, got %v", shallow.ExtraRefs[0])
+	}
+	if full := presubmits[1].UtilityConfig; full.CloneDepth != 0 {
+		t.Errorf("expected the job to override the clone depth, got %v", full.CloneDepth)
+	}
+}
+
+func TestRequirementHandlers(t *testing.T) {
+	cli := &Client{RequirementHandlers: map[string]RequirementHandler{
+		"org-quota": func(job *config.JobBase) {
+			job.Labels["org-quota"] = "true"
+		},
+	}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		RequirementPresets: map[string]RequirementPreset{
+			"gcp": {Labels: map[string]string{"preset-service-account": "true"}},
+		},
+		Jobs: []Job{{Name: "unit", Types: []string{TypePresubmit}, Requirements: []string{"org-quota", "gcp"}}},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	labels := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].Labels
+	expected := map[string]string{"org-quota": "true", "preset-service-account": "true"}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("expected labels %v, got %v", expected, labels)
+	}
+}
+
+func TestTerminationGracePeriod(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{MaxTerminationGracePeriodSeconds: 300}}
+	fileDefault, override := int64(60), int64(120)
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:                           "istio",
+		Repo:                          "istio",
+		Image:                         "image",
+		TerminationGracePeriodSeconds: &fileDefault,
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}},
+			{Name: "override", Types: []string{TypePresubmit}, TerminationGracePeriodSeconds: &override},
+		},
+	})
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []int64{fileDefault, override} {
+		if actual := presubmits[i].Spec.TerminationGracePeriodSeconds; actual == nil || *actual != expected {
+			t.Errorf("job %v: expected grace period %v, got %v", presubmits[i].Name, expected, actual)
+		}
+	}
+
+	testCases := []struct {
+		seconds   int64
+		max       int64
+		expectErr bool
+	}{
+		{seconds: 300, max: 300},
+		{seconds: 301, max: 300, expectErr: true},
+		{seconds: 3600, max: 0},
+		{seconds: -1, max: 0, expectErr: true},
+	}
+	for _, tc := range testCases {
+		err := checkTerminationGracePeriod(tc.seconds, tc.max)
+		if tc.expectErr != (err != nil) {
+			t.Errorf("grace period %d with maximum %d: expected error %v, got %v", tc.seconds, tc.max, tc.expectErr, err)
+		}
+	}
+}
+
+func TestSpecHash(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{SpecHash: true}}
+	generate := func(command ...string) config.JobConfig {
+		return cli.ConvertJobConfig(JobsConfig{
+			Org:   "istio",
+			Repo:  "istio",
+			Image: "image",
+			Jobs:  []Job{{Name: "unit", Command: command, Annotations: map[string]string{"a": "b"}}},
+		}, "master")
+	}
+
+	output := generate("make", "test")
+	presubmitHash := output.PresubmitsStatic["istio/istio"][0].Annotations[SpecHashAnnotation]
+	postsubmitHash := output.PostsubmitsStatic["istio/istio"][0].Annotations[SpecHashAnnotation]
+	if presubmitHash == "" || presubmitHash == postsubmitHash {
+		t.Errorf("expected distinct presubmit and postsubmit hashes, got %q and %q", presubmitHash, postsubmitHash)
+	}
+	if again := generate("make", "test").PresubmitsStatic["istio/istio"][0].Annotations[SpecHashAnnotation]; again != presubmitHash {
+		t.Errorf("expected the hash to be stable, got %q and %q", presubmitHash, again)
+	}
+	if changed := generate("make", "lint").PresubmitsStatic["istio/istio"][0].Annotations[SpecHashAnnotation]; changed == presubmitHash {
+		t.Errorf("expected the hash to change with the spec")
+	}
+}
+
+func TestAliases(t *testing.T) {
+	cli := &Client{}
+	output := cli.ConvertJobConfig(JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs:  []Job{{Name: "integ-test", Command: []string{"make"}, Aliases: []string{"integration-test"}}},
+	}, "release-1.20")
+	presubmit := output.PresubmitsStatic["istio/istio"][0]
+	if presubmit.RerunCommand != "/test integ-test_istio_release-1.20" {
+		t.Errorf("unexpected rerun command %q", presubmit.RerunCommand)
+	}
+	trigger := regexp.MustCompile(presubmit.Trigger)
+	for comment, expected := range map[string]bool{
+		"/test integ-test_istio_release-1.20":       true,
+		"/test integration-test_istio_release-1.20": true,
+		"/test unit-test_istio_release-1.20":        false,
+		"/test integration-test_istio":              false,
+	} {
+		if trigger.MatchString(comment) != expected {
+			t.Errorf("expected %q matching %v", comment, expected)
+		}
+	}
+}
+
+func TestRunWindow(t *testing.T) {
+	globalConfig := GlobalConfig{RunWindows: map[string]string{"off-peak": "0 22 * * *"}}
+	cli := &Client{GlobalConfig: globalConfig}
+	jobsConfig := resolveOverwrites(globalConfig, JobsConfig{
+		Org:      "istio",
+		Repo:     "istio",
+		Image:    "image",
+		Interval: "1h",
+		Jobs: []Job{
+			{Name: "benchmark", Types: []string{TypePeriodic}, RunWindow: "weekday-nights"},
+			{Name: "load", Types: []string{TypePeriodic}, RunWindow: "off-peak"},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	periodics := cli.ConvertJobConfig(jobsConfig, "master").Periodics
+	for i, expected := range []string{"0 2 * * 1-5", "0 22 * * *"} {
+		if periodics[i].Cron != expected || periodics[i].Interval != "" {
+			t.Errorf("expected periodic %v to run on %q, got cron %q and interval %q", periodics[i].Name, expected, periodics[i].Cron, periodics[i].Interval)
+		}
+	}
+}
+
+func TestAutomountServiceAccountToken(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{AutomountServiceAccountToken: map[string]bool{"default": true, "untrusted": false}}}
+	output := cli.ConvertJobConfig(JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "trusted", Types: []string{TypePresubmit}},
+			{Name: "untrusted", Types: []string{TypePresubmit}, Cluster: "untrusted"},
+			{Name: "unknown", Types: []string{TypePresubmit}, Cluster: "unknown"},
+		},
+	}, "master")
+	for i, expected := range []bool{true, false, false} {
+		presubmit := output.PresubmitsStatic["istio/istio"][i]
+		if automount := presubmit.Spec.AutomountServiceAccountToken; automount == nil || *automount != expected {
+			t.Errorf("expected job %v to set automount to %v, got %v", presubmit.Name, expected, automount)
+		}
+	}
+}
+
+func TestValidateWithProw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prow-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The decoration defaults and namespaces of prow/config.yaml, which the decorated jobs rely on.
+	prowConfig := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(prowConfig, []byte(`plank:
+  job_url_prefix_config:
+    '*': https://prow.istio.io/view/
+  pod_pending_timeout: 15m
+  pod_unscheduled_timeout: 30m
+  default_decoration_configs:
+    '*':
+      timeout: 2h
+      grace_period: 15s
+      utility_images:
+        clonerefs: "gcr.io/k8s-prow/clonerefs:v20210524-cf0aabdfa9"
+        initupload: "gcr.io/k8s-prow/initupload:v20210524-cf0aabdfa9"
+        entrypoint: "gcr.io/k8s-prow/entrypoint:v20210524-cf0aabdfa9"
+        sidecar: "gcr.io/k8s-prow/sidecar:v20210524-cf0aabdfa9"
+      gcs_configuration:
+        bucket: "istio-prow"
+        path_strategy: "explicit"
+      gcs_credentials_secret: "service-account"
+prowjob_namespace: default
+pod_namespace: test-pods
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &Client{}
+	output := cli.ConvertJobConfig(JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "unit", Command: []string{"make", "test"}},
+			{Name: "nightly", Command: []string{"make", "test"}, Types: []string{TypePeriodic}, Cron: "0 4 * * *"},
+		},
+	}, "master")
+	configs := map[string]config.JobConfig{"istio/istio/istio.istio.master.gen.yaml": output}
+	if err := ValidateWithProw(prowConfig, configs); err != nil {
+		t.Errorf("expected the generated config to be valid, got %v", err)
+	}
+	if err := ValidateWithProw(filepath.Join(dir, "missing.yaml"), configs); err == nil {
+		t.Errorf("expected an error for a missing prow config")
+	}
+}
+
+func TestArchResources(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		ResourcePresets: map[string]v1.ResourceRequirements{
+			"default": {Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("2")}},
+			"arm64":   {Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("4")}},
+		},
+		Jobs: []Job{{
+			Name:          "build",
+			Types:         []string{TypePresubmit},
+			Architectures: []string{ArchAMD64, ArchARM64},
+			ArchResources: map[string]string{ArchARM64: "arm64"},
+		}},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []string{"2", "4"} {
+		cpu := presubmits[i].Spec.Containers[0].Resources.Requests[v1.ResourceCPU]
+		if cpu.String() != expected {
+			t.Errorf("expected job %v to request %v cpu, got %v", presubmits[i].Name, expected, cpu.String())
+		}
+	}
+}
+
+func TestPathAliasOverride(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{PathAliases: map[string]string{"istio": "istio.io"}}}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:       "istio",
+		Repo:      "istio",
+		Image:     "image",
+		PathAlias: "example.dev/vanity",
+		Jobs: []Job{
+			{Name: "file", Types: []string{TypePresubmit}},
+			{Name: "job", Types: []string{TypePresubmit, TypePeriodic}, Interval: "24h", PathAlias: "example.dev/other"},
+			{Name: "periodic", Types: []string{TypePeriodic}, Interval: "24h", Repos: []string{"istio/tools"}},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	presubmits := output.PresubmitsStatic["istio/istio"]
+	for i, expected := range []string{"example.dev/vanity", "example.dev/other"} {
+		if presubmits[i].PathAlias != expected {
+			t.Errorf("expected job %v to have path alias %v, got %v", presubmits[i].Name, expected, presubmits[i].PathAlias)
+		}
+	}
+	for i, expected := range []string{"example.dev/other", "example.dev/vanity"} {
+		refs := output.Periodics[i].ExtraRefs
+		if refs[0].PathAlias != expected {
+			t.Errorf("expected periodic %v to clone its repo to %v, got %v", output.Periodics[i].Name, expected, refs[0].PathAlias)
+		}
+		if len(refs) > 1 && refs[1].PathAlias != "istio.io/tools" {
+			t.Errorf("expected periodic %v to keep the org path alias of its extra repos, got %v", output.Periodics[i].Name, refs[1].PathAlias)
+		}
+	}
+	for path, valid := range map[string]bool{"example.dev/vanity": true, "istio.io": false, "vanity/repo": false} {
+		if importPathRegex.MatchString(path) != valid {
+			t.Errorf("expected %v to be a valid import path: %v", path, valid)
+		}
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := []string{filepath.Join(dir, "istio", "b.gen.yaml"), filepath.Join(dir, "istio", "a.gen.yaml")}
+	if err := os.MkdirAll(filepath.Join(dir, "istio"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{"b: 1\n", versionStampPrefix + "1.0\na: 1\n"}
+	for i, file := range files {
+		if err := ioutil.WriteFile(file, []byte(contents[i]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest := filepath.Join(dir, "SHA256SUMS")
+	if err := WriteManifest(files, manifest); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The checksums of the contents without the version stamp.
+	expected := "37b128c59f1f5097f73f82691cb519f1f568667faab5ced1b4ab979d36837eae  istio/a.gen.yaml\n" +
+		"08e60701d32af867a9df2a88cc0a72b634187039d243c4dd3afe1b87b957c97d  istio/b.gen.yaml\n"
+	if string(got) != expected {
+		t.Errorf("expected manifest:\n%s\ngot:\n%s", expected, got)
+	}
+
+	// A new generator version does not change the manifest.
+	if err := ioutil.WriteFile(files[1], []byte(versionStampPrefix+"2.0\na: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteManifest(files, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(manifest); err != nil || string(got) != expected {
+		t.Errorf("expected the manifest to be unchanged by the version stamp, got %s (%v)", got, err)
+	}
+}
+
+func TestRuntimeClassOverhead(t *testing.T) {
+	overhead := v1.ResourceList{v1.ResourceCPU: resource.MustParse("250m")}
+	cli := &Client{GlobalConfig: GlobalConfig{RuntimeClassOverheads: map[string]v1.ResourceList{"gvisor": overhead}}}
+	jobOverhead := v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")}
+	presubmits := cli.ConvertJobConfig(JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}, RuntimeClassName: "gvisor"},
+			{Name: "override", Types: []string{TypePresubmit}, RuntimeClassName: "gvisor", Overhead: jobOverhead},
+		},
+	}, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []v1.ResourceList{overhead, jobOverhead} {
+		spec := presubmits[i].Spec
+		if spec.RuntimeClassName == nil || *spec.RuntimeClassName != "gvisor" {
+			t.Errorf("expected job %v to use the gvisor runtime class, got %v", presubmits[i].Name, spec.RuntimeClassName)
+		}
+		if !reflect.DeepEqual(spec.Overhead, expected) {
+			t.Errorf("expected job %v to have overhead %v, got %v", presubmits[i].Name, expected, spec.Overhead)
+		}
+	}
+}
+
+func TestRequirementServiceAccount(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		RequirementPresets: map[string]RequirementPreset{
+			"gcp": {ServiceAccountName: "prowjob-default-sa"},
+		},
+		Jobs: []Job{
+			{Name: "gcp", Types: []string{TypePresubmit}, Requirements: []string{"gcp"}},
+			{Name: "explicit", Types: []string{TypePresubmit}, Requirements: []string{"gcp"}, ServiceAccountName: "prowjob-default-sa"},
+			{Name: "none", Types: []string{TypePresubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []string{"prowjob-default-sa", "prowjob-default-sa", ""} {
+		if sa := presubmits[i].Spec.ServiceAccountName; sa != expected {
+			t.Errorf("expected job %v to use service account %q, got %q", presubmits[i].Name, expected, sa)
+		}
+	}
+}
+
+func TestUploadSettings(t *testing.T) {
+	cli := &Client{}
+	upload := &UploadSettings{
+		GracePeriod:  &prowjob.Duration{Duration: 15 * time.Minute},
+		PathStrategy: prowjob.PathStrategyExplicit,
+		MediaTypes:   map[string]string{"log": "text/plain"},
+	}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:          "istio",
+		Repo:         "istio",
+		Image:        "image",
+		GCSLogBucket: "istio-prow",
+		Upload:       upload,
+		Jobs:         []Job{{Name: "unit", Types: []string{TypePresubmit}}},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	dc := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].DecorationConfig
+	if dc == nil || dc.GracePeriod.Duration != 15*time.Minute {
+		t.Fatalf("expected the grace period to be set, got %v", dc)
+	}
+	expected := &prowjob.GCSConfiguration{
+		Bucket:       "istio-prow",
+		PathStrategy: prowjob.PathStrategyExplicit,
+		MediaTypes:   map[string]string{"log": "text/plain"},
+	}
+	if !reflect.DeepEqual(dc.GCSConfiguration, expected) {
+		t.Errorf("expected gcs configuration %v, got %v", expected, dc.GCSConfiguration)
+	}
+
+	timeout := &prowjob.Duration{Duration: 10 * time.Minute}
+	for _, tc := range []struct {
+		upload UploadSettings
+		valid  bool
+	}{
+		{UploadSettings{PathStrategy: prowjob.PathStrategyLegacy, DefaultOrg: "istio", DefaultRepo: "istio"}, true},
+		{UploadSettings{PathStrategy: prowjob.PathStrategySingle}, false},
+		{UploadSettings{PathStrategy: "nested"}, false},
+		{UploadSettings{DefaultOrg: "istio"}, false},
+		{UploadSettings{GracePeriod: &prowjob.Duration{Duration: time.Minute}}, true},
+		{UploadSettings{GracePeriod: &prowjob.Duration{Duration: time.Hour}}, false},
+	} {
+		if err := validateUploadSettings(tc.upload, timeout); (err == nil) != tc.valid {
+			t.Errorf("expected %+v to be valid: %v, got error %v", tc.upload, tc.valid, err)
+		}
+	}
+}
+
+func TestMatrixAnnotation(t *testing.T) {
+	matrix := map[string][]string{"go-version": {"1.14", "1.15"}, "arch": {"amd64"}}
+	jobs, err := applyMatrixJob(Job{Name: "unit-$(matrix.go-version)-$(matrix.arch)"}, matrix, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{`{"arch":"amd64","go-version":"1.14"}`, `{"arch":"amd64","go-version":"1.15"}`} {
+		if got := jobs[i].Annotations[MatrixAnnotation]; got != expected {
+			t.Errorf("expected job %v to be annotated with %v, got %v", jobs[i].Name, expected, got)
+		}
+	}
+	if plain, _ := applyMatrixJob(Job{Name: "unit"}, matrix, 0); plain[0].Annotations != nil {
+		t.Errorf("expected no annotation for a job not using the matrix, got %v", plain[0].Annotations)
+	}
+}
+
+func TestPlatformTolerationsMatrix(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:    "istio",
+		Repo:   "istio",
+		Image:  "image",
+		Matrix: map[string][]string{"arch": {ArchAMD64, ArchARM64}},
+		Jobs: []Job{
+			{
+				Name:         "selector-$(matrix.arch)",
+				Types:        []string{TypePresubmit},
+				NodeSelector: map[string]string{archNodeLabel: "$(matrix.arch)"},
+			},
+			{
+				Name:          "platform-$(matrix.arch)",
+				Types:         []string{TypePresubmit},
+				Architectures: []string{"$(matrix.arch)"},
+			},
+		},
+	}
+	arm64Toleration := []v1.Toleration{{Key: archNodeLabel, Operator: v1.TolerationOpEqual, Value: ArchARM64, Effect: v1.TaintEffectNoSchedule}}
+	for _, presubmit := range cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"] {
+		var expected []v1.Toleration
+		if presubmit.Spec.NodeSelector[archNodeLabel] == ArchARM64 {
+			expected = arm64Toleration
+		}
+		if !reflect.DeepEqual(presubmit.Spec.Tolerations, expected) {
+			t.Errorf("expected job %v to have tolerations %v, got %v", presubmit.Name, expected, presubmit.Spec.Tolerations)
+		}
+	}
+}
+
+func TestWriteConfigGrouped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grouped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cli := &Client{}
+	output := cli.ConvertJobConfig(JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "unit", Types: []string{TypePresubmit, TypePostsubmit}, Labels: map[string]string{"team": "networking"}},
+			{Name: "lint", Types: []string{TypePresubmit}},
+			{Name: "e2e", Types: []string{TypePeriodic}, Cron: "0 2 * * *", Labels: map[string]string{"team": "security"}},
+		},
+	}, "master")
+	fname := filepath.Join(dir, "istio.istio.master.gen.yaml")
+	key := GroupByLabel("team")
+
+	groups := GroupJobConfig(output, fname, key)
+	expected := map[string][]string{
+		fname: {"lint_istio"},
+		filepath.Join(dir, "istio.istio.master.networking.gen.yaml"): {"unit_istio", "unit_istio_postsubmit"},
+		filepath.Join(dir, "istio.istio.master.security.gen.yaml"):   {"e2e_istio_periodic"},
+	}
+	for file, names := range expected {
+		jc := groups[file]
+		var got []string
+		for _, p := range jc.PresubmitsStatic["istio/istio"] {
+			got = append(got, p.Name)
+		}
+		for _, p := range jc.PostsubmitsStatic["istio/istio"] {
+			got = append(got, p.Name)
+		}
+		for _, p := range jc.Periodics {
+			got = append(got, p.Name)
+		}
+		if !reflect.DeepEqual(got, names) {
+			t.Errorf("expected %v to contain %v, got %v", file, names, got)
+		}
+	}
+	if len(groups) != len(expected) {
+		t.Errorf("expected %d groups, got %d", len(expected), len(groups))
+	}
+
+	if err := cli.CheckConfigGrouped(output, fname, key); err == nil {
+		t.Errorf("expected drift before writing the groups")
+	}
+	cli.WriteConfigGrouped(output, fname, key)
+	if err := cli.CheckConfigGrouped(output, fname, key); err != nil {
+		t.Errorf("expected no drift after writing the groups, got %v", err)
+	}
+
+	// Once all its jobs are grouped, the original file must be deleted.
+	output.PresubmitsStatic["istio/istio"] = output.PresubmitsStatic["istio/istio"][:1]
+	groups = GroupJobConfig(output, fname, key)
+	if _, ok := groups[fname]; ok {
+		t.Errorf("expected no group for %v once all its jobs are grouped", fname)
+	}
+	if err := cli.CheckConfigGrouped(output, fname, key); err == nil {
+		t.Errorf("expected drift while %v exists", fname)
+	}
+	if result, err := cli.CheckConfigs(groups, RemovedFiles(groups, fname)...); err != nil || !reflect.DeepEqual(result.Stale, []string{fname}) {
+		t.Errorf("expected %v to be stale, got %v, %v", fname, result.Stale, err)
+	}
+	cli.WriteConfigGrouped(output, fname, key)
+	if _, err := os.Stat(fname); !os.IsNotExist(err) {
+		t.Errorf("expected %v to be deleted, got %v", fname, err)
+	}
+	if err := cli.CheckConfigGrouped(output, fname, key); err != nil {
+		t.Errorf("expected no drift after deleting %v, got %v", fname, err)
+	}
+}
+
+func TestWorkingDirConflict(t *testing.T) {
+	jobsConfig := JobsConfig{Org: "istio", Repo: "istio"}
+	pathAliases := map[string]string{"istio": "istio.io"}
+	testCases := []struct {
+		name     string
+		job      Job
+		expected string
+	}{
+		{name: "unset", job: Job{}},
+		{name: "checkout path", job: Job{WorkingDir: "/home/prow/go/src/istio.io/istio/"}},
+		{name: "other path", job: Job{WorkingDir: "/workspace"}, expected: "/home/prow/go/src/istio.io/istio"},
+		{name: "path alias", job: Job{WorkingDir: "/home/prow/go/src/istio.io/istio", PathAlias: "example.dev/vanity"},
+			expected: "/home/prow/go/src/example.dev/vanity"},
+		{name: "skip cloning", job: Job{WorkingDir: "/workspace", SkipCloning: true}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if checkout := workingDirConflict(tc.job, jobsConfig, pathAliases); checkout != tc.expected {
+				t.Errorf("expected the conflicting checkout path %q, got %q", tc.expected, checkout)
+			}
+		})
+	}
+}
+
+func TestSkipCloning(t *testing.T) {
+	cli := &Client{}
+	periodic := cli.ConvertJobConfig(JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs:  []Job{{Name: "cleanup", Types: []string{TypePeriodic}, Cron: "0 4 * * *", SkipCloning: true}},
+	}, "master").Periodics[0]
+	if dc := periodic.DecorationConfig; dc == nil || dc.SkipCloning == nil || !*dc.SkipCloning {
+		t.Errorf("expected the job to skip cloning, got %v", dc)
+	}
+	if len(periodic.ExtraRefs) != 0 {
+		t.Errorf("expected no extra refs, got %v", periodic.ExtraRefs)
+	}
+}
+
+func TestValidateTestgridDashboards(t *testing.T) {
+	if err := ValidateTestgridDashboards([]RepoBranch{
+		{Org: "istio", Repo: "istio", Branch: "master"},
+		{Org: "istio", Repo: "istio", Branch: "release-1.20"},
+		{Org: "istio", Repo: "api", Branch: "master"},
+	}); err != nil {
+		t.Errorf("expected unique dashboards, got %v", err)
+	}
+
+	err := ValidateTestgridDashboards([]RepoBranch{
+		{Org: "istio", Repo: "b_c", Branch: "a"},
+		{Org: "istio", Repo: "c", Branch: "a_b"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "testgrid dashboard istio_a_b_c is generated for istio/b_c@a, istio/c@a_b") {
+		t.Errorf("expected a collision of istio_a_b_c, got %v", err)
+	}
+}
+
+func TestReadinessGates(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:            "istio",
+		Repo:           "istio",
+		Image:          "image",
+		ReadinessGates: []string{"example.com/network-ready"},
+		Jobs: []Job{
+			{Name: "file", Types: []string{TypePresubmit}},
+			{Name: "job", Types: []string{TypePresubmit}, ReadinessGates: []string{"example.com/quota-ready"}},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []v1.PodConditionType{"example.com/network-ready", "example.com/quota-ready"} {
+		gates := presubmits[i].Spec.ReadinessGates
+		if !reflect.DeepEqual(gates, []v1.PodReadinessGate{{ConditionType: expected}}) {
+			t.Errorf("expected job %v to have the readiness gate %v, got %v", presubmits[i].Name, expected, gates)
+		}
+	}
+}
+
+func TestDistributeConcurrencyPools(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{SpecHash: true, ConcurrencyPools: map[string]int{"gcp-api": 5}}}
+	convert := func(repo string, jobs ...Job) config.JobConfig {
+		return cli.ConvertJobConfig(JobsConfig{Org: "istio", Repo: repo, Image: "image", Jobs: jobs}, "master")
+	}
+	istio := convert("istio",
+		Job{Name: "a", Types: []string{TypePresubmit}, ConcurrencyPool: "gcp-api"},
+		Job{Name: "b", Types: []string{TypePresubmit}, ConcurrencyPool: "gcp-api"},
+		Job{Name: "unpooled", Types: []string{TypePresubmit}})
+	api := convert("api", Job{Name: "c", Types: []string{TypePostsubmit}, ConcurrencyPool: "gcp-api"})
+	before := istio.PresubmitsStatic["istio/istio"][0].Annotations[SpecHashAnnotation]
+
+	cli.DistributeConcurrencyPools([]config.JobConfig{istio, api})
+	presubmits := istio.PresubmitsStatic["istio/istio"]
+	for i, expected := range []int{2, 1, 0} {
+		if presubmits[i].MaxConcurrency != expected {
+			t.Errorf("expected job %v to have a max_concurrency of %d, got %d", presubmits[i].Name, expected, presubmits[i].MaxConcurrency)
+		}
+	}
+	// Postsubmits are ordered before presubmits, receiving the remainder first.
+	if postsubmit := api.PostsubmitsStatic["istio/api"][0]; postsubmit.MaxConcurrency != 2 {
+		t.Errorf("expected the postsubmit to have a max_concurrency of 2, got %d", postsubmit.MaxConcurrency)
+	}
+	if after := presubmits[0].Annotations[SpecHashAnnotation]; after == before {
+		t.Errorf("expected the spec hash to be updated")
+	}
+}
+
+func TestObservabilityLabels(t *testing.T) {
+	cli := &Client{ObservabilityLabels: true}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs:  []Job{{Name: "job", Types: []string{TypePresubmit, TypePeriodic}, Cron: "0 0 * * *"}},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	presubmit := output.PresubmitsStatic["istio/istio"][0]
+	periodic := output.Periodics[0]
+	if repo := presubmit.Labels[ObservabilityRepoLabel]; repo != "istio.istio" {
+		t.Errorf("expected the repo label istio.istio, got %q", repo)
+	}
+	if typ := periodic.Labels[ObservabilityTypeLabel]; typ != TypePeriodic {
+		t.Errorf("expected the type label %v, got %q", TypePeriodic, typ)
+	}
+	id := presubmit.Labels[ObservabilityJobIDLabel]
+	if len(id) != 16 || id == periodic.Labels[ObservabilityJobIDLabel] {
+		t.Errorf("expected distinct job ids of 16 characters, got %q and %q", id, periodic.Labels[ObservabilityJobIDLabel])
+	}
+
+	// The job id only depends on the identity of the job.
+	jobsConfig.Jobs[0].Command = []string{"changed"}
+	if again := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].Labels[ObservabilityJobIDLabel]; again != id {
+		t.Errorf("expected the job id %q to be stable, got %q", id, again)
+	}
+}
+
+func TestValidateScheduleInterval(t *testing.T) {
+	cases := []struct {
+		interval    string
+		minInterval time.Duration
+		err         string
+	}{
+		{interval: "10m", minInterval: DefaultMinPeriodicInterval},
+		{interval: "5s", minInterval: DefaultMinPeriodicInterval, err: "interval 5s (5s) in periodic job is below the minimum of 5m0s"},
+		{interval: "90s", minInterval: time.Hour, err: "interval 90s (1m30s) in periodic job is below the minimum of 1h0m0s"},
+		{interval: "5s", minInterval: 0},
+		{interval: "1000h", minInterval: DefaultMinPeriodicInterval},
+	}
+	for _, tc := range cases {
+		err := validateSchedule("job", "", tc.interval, tc.minInterval)
+		if tc.err == "" && err != nil {
+			t.Errorf("interval %v: unexpected error %v", tc.interval, err)
+		} else if tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("interval %v: expected error %q, got %v", tc.interval, tc.err, err)
+		}
+	}
+
+	if _, err := minPeriodicInterval(GlobalConfig{MinPeriodicInterval: "5"}); err == nil {
+		t.Errorf("expected an invalid min_periodic_interval to be rejected")
+	}
+}
+
+func TestImagePullSecretsPresets(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{ImagePullSecretsPresets: map[string][]string{
+		"private-registry": {"gcr-private-pull", "quay-pull"},
+	}}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "none", Types: []string{TypePresubmit}},
+			{
+				Name:                    "job",
+				Types:                   []string{TypePresubmit},
+				ImagePullSecretsPresets: []string{"private-registry"},
+				ImagePullSecrets:        []string{"quay-pull", "docker-pull"},
+			},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	if secrets := presubmits[0].Spec.ImagePullSecrets; secrets != nil {
+		t.Errorf("expected no image pull secrets, got %v", secrets)
+	}
+	expected := []v1.LocalObjectReference{{Name: "gcr-private-pull"}, {Name: "quay-pull"}, {Name: "docker-pull"}}
+	if secrets := presubmits[1].Spec.ImagePullSecrets; !reflect.DeepEqual(secrets, expected) {
+		t.Errorf("expected the image pull secrets %v, got %v", expected, secrets)
+	}
+}
+
+func TestPreviewSchedule(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	day := func(d, h int, loc *time.Location) time.Time { return time.Date(2020, 1, d, h, 0, 0, 0, loc) }
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+	cases := []struct {
+		name     string
+		job      Job
+		expected []time.Time
+		err      string
+	}{
+		{
+			name:     "cron",
+			job:      Job{Name: "job", Types: []string{TypePeriodic}, Cron: "0 6 * * *"},
+			expected: []time.Time{day(2, 6, time.UTC), day(3, 6, time.UTC)},
+		},
+		{
+			name:     "cron time zone",
+			job:      Job{Name: "job", Types: []string{TypePeriodic}, Cron: "CRON_TZ=America/New_York 0 6 * * *"},
+			expected: []time.Time{day(2, 6, ny), day(3, 6, ny)},
+		},
+		{
+			name:     "interval",
+			job:      Job{Name: "job", Types: []string{TypePeriodic}, Interval: "12h"},
+			expected: []time.Time{day(2, 0, time.UTC), day(2, 12, time.UTC)},
+		},
+		{
+			name: "schedules",
+			job: Job{Name: "job", Types: []string{TypePeriodic}, Schedules: []Schedule{
+				{Name: "smoke", Interval: "18h"},
+				{Name: "full", Cron: "0 6 * * *"},
+			}},
+			expected: []time.Time{day(2, 6, time.UTC), day(2, 6, time.UTC)},
+		},
+		{
+			name: "presubmit",
+			job:  Job{Name: "job", Types: []string{TypePresubmit}, Interval: "1h"},
+			err:  "job job is not a periodic",
+		},
+		{
+			name: "no schedule",
+			job:  Job{Name: "job", Types: []string{TypePeriodic}},
+			err:  "exactly one of cron and interval must be set in periodic job",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			times, err := previewSchedule(tc.job, 2, now)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("expected error %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(times) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, times)
+			}
+			for i := range times {
+				if !times[i].Equal(tc.expected[i]) {
+					t.Errorf("expected %v, got %v", tc.expected, times)
+				}
+			}
+		})
+	}
+}
+
+func TestShareProcessNamespace(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:                   "istio",
+		Repo:                  "istio",
+		Image:                 "image",
+		ShareProcessNamespace: newBool(true),
+		Jobs: []Job{
+			{Name: "file", Types: []string{TypePresubmit}},
+			{Name: "job", Types: []string{TypePresubmit}, ShareProcessNamespace: newBool(false)},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []bool{true, false} {
+		share := presubmits[i].Spec.ShareProcessNamespace
+		if share == nil || *share != expected {
+			t.Errorf("expected job %v to have share_process_namespace %v, got %v", presubmits[i].Name, expected, share)
+		}
+	}
+}
+
+func TestPostsubmitName(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "unit-tests", Types: []string{TypePresubmit, TypePostsubmit}, PostsubmitName: "publish-coverage",
+				Architectures: []string{ArchAMD64, ArchARM64}},
+			{Name: "lint", Types: []string{TypePresubmit, TypePostsubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "release-1.8")
+	var presubmits, postsubmits []string
+	for _, presubmit := range output.PresubmitsStatic["istio/istio"] {
+		presubmits = append(presubmits, presubmit.Name)
+	}
+	for _, postsubmit := range output.PostsubmitsStatic["istio/istio"] {
+		postsubmits = append(postsubmits, postsubmit.Name)
+	}
+	expectedPresubmits := []string{"unit-tests_istio_release-1.8", "unit-tests-arm64_istio_release-1.8", "lint_istio_release-1.8"}
+	if !reflect.DeepEqual(presubmits, expectedPresubmits) {
+		t.Errorf("expected the presubmits %v, got %v", expectedPresubmits, presubmits)
+	}
+	expectedPostsubmits := []string{"publish-coverage_istio_release-1.8_postsubmit", "publish-coverage-arm64_istio_release-1.8_postsubmit",
+		"lint_istio_release-1.8_postsubmit"}
+	if !reflect.DeepEqual(postsubmits, expectedPostsubmits) {
+		t.Errorf("expected the postsubmits %v, got %v", expectedPostsubmits, postsubmits)
+	}
+
+	jobsConfig.Branches = []string{"release-1.8"}
+	if name := longestJobName(jobsConfig.Jobs[0], jobsConfig); name != "publish-coverage-arm64_istio_release-1.8_postsubmit" {
+		t.Errorf("expected the longest name to be the postsubmit, got %v", name)
+	}
+}
+
+func TestCheckJobNameLength(t *testing.T) {
+	jobsConfig := JobsConfig{Org: "istio", Repo: "istio", Image: "image", Branches: []string{"master"}}
+	for _, tc := range []struct {
+		job Job
+		err bool
+	}{
+		{job: Job{Name: "unit-tests", Types: []string{TypePresubmit}}},
+		{job: Job{Name: strings.Repeat("a", 57), Types: []string{TypePresubmit}}},
+		{job: Job{Name: strings.Repeat("a", 58), Types: []string{TypePresubmit}}, err: true},
+		{job: Job{Name: strings.Repeat("a", 50), Types: []string{TypePeriodic}}, err: true},
+		{job: Job{Name: "unit-tests", Types: []string{TypePresubmit}, Architectures: []string{ArchAMD64, ArchARM64},
+			KubernetesVersions: []string{"1.19", "1.20"}}},
+	} {
+		if err := checkJobNameLength(tc.job, jobsConfig); (err != nil) != tc.err {
+			t.Errorf("job %v: expected an error %v, got %v", tc.job.Name, tc.err, err)
+		}
+	}
+}
+
+func TestLifecyclePreStop(t *testing.T) {
+	var grace int64 = 300
+	cli := &Client{GlobalConfig: GlobalConfig{MaxTerminationGracePeriodSeconds: 600}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}, Lifecycle: &Lifecycle{PreStop: []string{"make", "cleanup"}}},
+			{Name: "explicit", Types: []string{TypePresubmit}, Lifecycle: &Lifecycle{PreStop: []string{"make", "cleanup"}},
+				TerminationGracePeriodSeconds: &grace},
+			{Name: "none", Types: []string{TypePresubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	expected := &v1.Lifecycle{PreStop: &v1.Handler{Exec: &v1.ExecAction{Command: []string{"make", "cleanup"}}}}
+	if lc := presubmits[0].Spec.Containers[0].Lifecycle; !reflect.DeepEqual(lc, expected) {
+		t.Errorf("expected the lifecycle %v, got %v", expected, lc)
+	}
+	for i, expected := range []int64{DefaultPreStopGracePeriodSeconds, grace} {
+		if seconds := presubmits[i].Spec.TerminationGracePeriodSeconds; seconds == nil || *seconds != expected {
+			t.Errorf("expected job %v to have a termination grace period of %d, got %v", presubmits[i].Name, expected, seconds)
+		}
+	}
+	if none := presubmits[2].Spec; none.Containers[0].Lifecycle != nil || none.TerminationGracePeriodSeconds != nil {
+		t.Errorf("expected no lifecycle nor termination grace period, got %v and %v", none.Containers[0].Lifecycle, none.TerminationGracePeriodSeconds)
+	}
+
+	if seconds := *preStopGracePeriod(60); seconds != 60 {
+		t.Errorf("expected the grace period to be capped to 60, got %d", seconds)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	job := Job{Name: "job", Paths: []string{"pilot/", "pkg/config", "go.mod"}}
+	regex := changedFilesRegex(job)
+	if regex != `^(pilot|pkg/config|go\.mod)(/|$)` {
+		t.Errorf("unexpected regex %v", regex)
+	}
+	re := regexp.MustCompile(regex)
+	for file, expected := range map[string]bool{
+		"pilot/pkg/model.go":  true,
+		"pkg/config/types.go": true,
+		"go.mod":              true,
+		"pilot.go":            false,
+		"pkg/configmap.go":    false,
+		"goxmod":              false,
+		"tools/pilot/main.go": false,
+	} {
+		if re.MatchString(file) != expected {
+			t.Errorf("expected %v to match %v: %v", regex, file, expected)
+		}
+	}
+
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs:  []Job{{Name: "job", Paths: []string{"pilot"}, PostsubmitRegex: "^release/"}},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	if presubmit := output.PresubmitsStatic["istio/istio"][0]; presubmit.RunIfChanged != "^(pilot)(/|$)" || presubmit.AlwaysRun {
+		t.Errorf("expected the presubmit to run if pilot changed, got %q", presubmit.RunIfChanged)
+	}
+	if postsubmit := output.PostsubmitsStatic["istio/istio"][0]; postsubmit.RunIfChanged != "^release/" {
+		t.Errorf("expected postsubmit_regex to override paths, got %q", postsubmit.RunIfChanged)
+	}
+}
+
+func TestActiveDeadlineSeconds(t *testing.T) {
+	hour := &prowjob.Duration{Duration: time.Hour}
+	var explicit int64 = 600
+	seconds := func(s int64) *int64 { return &s }
+	cases := []struct {
+		name     string
+		job      Job
+		buffer   *prowjob.Duration
+		expected *int64
+	}{
+		{name: "no timeout", job: Job{}, buffer: &prowjob.Duration{Duration: time.Minute}},
+		{name: "no buffer", job: Job{Timeout: hour}},
+		{name: "buffer", job: Job{Timeout: hour}, buffer: &prowjob.Duration{Duration: time.Minute}, expected: seconds(3660)},
+		{
+			name:     "grace period",
+			job:      Job{Timeout: hour, Upload: &UploadSettings{GracePeriod: &prowjob.Duration{Duration: time.Minute}}},
+			buffer:   &prowjob.Duration{Duration: time.Minute},
+			expected: seconds(3720),
+		},
+		{name: "explicit", job: Job{Timeout: hour, ActiveDeadlineSeconds: &explicit}, expected: &explicit},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			deadline := activeDeadlineSeconds(tc.job, tc.buffer)
+			if !reflect.DeepEqual(deadline, tc.expected) {
+				t.Errorf("expected the deadline %v, got %v", tc.expected, deadline)
+			}
+		})
+	}
+
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs:  []Job{{Name: "job", Types: []string{TypePresubmit}, Timeout: hour}},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+	presubmit := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0]
+	if deadline := presubmit.Spec.ActiveDeadlineSeconds; deadline != nil {
+		t.Errorf("expected no active deadline without active_deadline_buffer, got %v", *deadline)
+	}
+	jobsConfig.ActiveDeadlineBuffer = &prowjob.Duration{Duration: 15 * time.Minute}
+	presubmit = cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0]
+	if deadline := presubmit.Spec.ActiveDeadlineSeconds; deadline == nil || *deadline != 4500 {
+		t.Errorf("expected an active deadline of 4500s, got %v", deadline)
+	}
+}
+
+func TestResultsReporter(t *testing.T) {
+	secret := &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "results-dashboard"}, Key: "token"}
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:             "istio",
+		Repo:            "istio",
+		Image:           "image",
+		ResultsReporter: &ResultsReporter{Endpoint: "https://results.example.com/api", AuthSecret: secret},
+		Jobs: []Job{
+			{Name: "file", Types: []string{TypePresubmit}},
+			{Name: "job", Types: []string{TypePresubmit}, ResultsReporter: &ResultsReporter{Endpoint: "https://other.example.com", AuthSecret: secret}},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []string{"https://results.example.com/api", "https://other.example.com"} {
+		annotations := presubmits[i].Annotations
+		if annotations[ResultsEndpointAnnotation] != expected || annotations[ResultsAuthSecretAnnotation] != "results-dashboard/token" {
+			t.Errorf("expected job %v to report to %v, got %v", presubmits[i].Name, expected, annotations)
+		}
+	}
+
+	// Converting a job config without validating it must not panic on a missing secret.
+	unvalidated := jobsConfig
+	unvalidated.Jobs = []Job{{Name: "job", Types: []string{TypePresubmit}, ResultsReporter: &ResultsReporter{Endpoint: "https://other.example.com"}}}
+	annotations := cli.ConvertJobConfig(unvalidated, "master").PresubmitsStatic["istio/istio"][0].Annotations
+	if _, f := annotations[ResultsAuthSecretAnnotation]; f {
+		t.Errorf("expected no auth secret annotation without an auth_secret, got %v", annotations)
+	}
+
+	for _, rr := range []ResultsReporter{
+		{Endpoint: "results.example.com", AuthSecret: secret},
+		{Endpoint: "https://results.example.com"},
+		{Endpoint: "https://results.example.com", AuthSecret: &v1.SecretKeySelector{Key: "token"}},
+	} {
+		if err := validateResultsReporter(rr); err == nil {
+			t.Errorf("expected the reporter %+v to be rejected", rr)
+		}
+	}
+}
+
+func TestTypeTimeouts(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:             "integ",
+			Types:            []string{TypePresubmit, TypePostsubmit, TypePeriodic},
+			Cron:             "0 0 * * *",
+			Timeout:          &prowjob.Duration{Duration: 2 * time.Hour},
+			PresubmitTimeout: &prowjob.Duration{Duration: time.Hour},
+			PeriodicTimeout:  &prowjob.Duration{Duration: 4 * time.Hour},
+		}},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	for _, tc := range []struct {
+		jobType  string
+		jb       config.JobBase
+		expected time.Duration
+	}{
+		{TypePresubmit, output.PresubmitsStatic["istio/istio"][0].JobBase, time.Hour},
+		{TypePostsubmit, output.PostsubmitsStatic["istio/istio"][0].JobBase, 2 * time.Hour},
+		{TypePeriodic, output.Periodics[0].JobBase, 4 * time.Hour},
+	} {
+		if timeout := tc.jb.DecorationConfig.Timeout; timeout == nil || timeout.Duration != tc.expected {
+			t.Errorf("expected the %v to have a timeout of %v, got %v", tc.jobType, tc.expected, timeout)
+		}
+	}
+
+	day := &prowjob.Duration{Duration: 24 * time.Hour}
+	for _, tc := range []struct {
+		job      Job
+		expected map[string]*prowjob.Duration
+	}{
+		{Job{}, map[string]*prowjob.Duration{TypePresubmit: nil, TypePostsubmit: nil}},
+		{Job{Types: []string{TypePresubmit, TypePeriodic}, PeriodicTimeout: day}, map[string]*prowjob.Duration{TypePresubmit: nil, TypePeriodic: day}},
+		{Job{Types: []string{TypePresubmit}, PeriodicTimeout: day}, map[string]*prowjob.Duration{TypePresubmit: nil}},
+	} {
+		if timeouts := typeTimeouts(tc.job); !reflect.DeepEqual(timeouts, tc.expected) {
+			t.Errorf("expected the timeouts %v of types %v, got %v", tc.expected, tc.job.Types, timeouts)
+		}
+	}
+}
+
+func TestEnableServiceLinks(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:                "istio",
+		Repo:               "istio",
+		Image:              "image",
+		EnableServiceLinks: newBool(false),
+		Jobs: []Job{
+			{Name: "file", Types: []string{TypePresubmit}},
+			{Name: "job", Types: []string{TypePresubmit}, EnableServiceLinks: newBool(true)},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []bool{false, true} {
+		links := presubmits[i].Spec.EnableServiceLinks
+		if links == nil || *links != expected {
+			t.Errorf("expected job %v to have enable_service_links %v, got %v", presubmits[i].Name, expected, links)
+		}
+	}
+
+	unset := cli.ConvertJobConfig(JobsConfig{Org: "istio", Repo: "istio", Image: "image", Jobs: []Job{{Name: "job"}}}, "master")
+	if links := unset.PresubmitsStatic["istio/istio"][0].Spec.EnableServiceLinks; links != nil {
+		t.Errorf("expected enable_service_links to be left to the Kubernetes default, got %v", *links)
+	}
+}
+
+func TestBehaviorHash(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{BehaviorHash: true}}
+	hash := func(job Job) string {
+		job.Types = []string{TypePresubmit}
+		jobsConfig := JobsConfig{Org: "istio", Repo: "istio", Image: "image", Jobs: []Job{job}}
+		return cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].Annotations[BehaviorHashAnnotation]
+	}
+	base := hash(Job{Name: "unit", Command: []string{"make", "test"}})
+	if base == "" {
+		t.Fatalf("expected a behavior hash")
+	}
+	mesh := true
+	for name, job := range map[string]Job{
+		"renamed":    {Name: "unit-renamed", Command: []string{"make", "test"}},
+		"annotated":  {Name: "unit", Command: []string{"make", "test"}, Annotations: map[string]string{"a": "b"}},
+		"labeled":    {Name: "unit", Command: []string{"make", "test"}, Labels: map[string]string{"team": "networking"}},
+		"owned":      {Name: "unit", Command: []string{"make", "test"}, Owner: "networking"},
+		"same again": {Name: "unit", Command: []string{"make", "test"}},
+	} {
+		if h := hash(job); h != base {
+			t.Errorf("%v: expected the behavior hash to be unchanged", name)
+		}
+	}
+	for name, job := range map[string]Job{
+		"command":  {Name: "unit", Command: []string{"make", "lint"}},
+		"preset":   {Name: "unit", Command: []string{"make", "test"}, Labels: map[string]string{"preset-kind": "true"}},
+		"regex":    {Name: "unit", Command: []string{"make", "test"}, Regex: "^pkg/"},
+		"repos":    {Name: "unit", Command: []string{"make", "test"}, Repos: []string{"istio/api"}},
+		"cluster":  {Name: "unit", Command: []string{"make", "test"}, Cluster: "build"},
+		"timeout":  {Name: "unit", Command: []string{"make", "test"}, Timeout: &prowjob.Duration{Duration: time.Hour}},
+		"selector": {Name: "unit", Command: []string{"make", "test"}, NodeSelector: map[string]string{"pool": "big"}},
+		"mesh":     {Name: "unit", Command: []string{"make", "test"}, MeshInject: &mesh},
+		"retry":    {Name: "unit", Command: []string{"make", "test"}, RetryPolicy: &RetryPolicy{MaxRetries: 2, RetryOn: []string{"evicted"}}},
+		"injected": {Name: "unit", Command: []string{"make", "test"}, Annotations: map[string]string{MeshInjectAnnotation: "true"}},
+	} {
+		if h := hash(job); h == base {
+			t.Errorf("%v: expected the behavior hash to change", name)
+		}
+	}
+}
+
+func TestDefaultBranches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cli := &Client{GlobalConfig: GlobalConfig{DefaultBranches: map[string]string{"istio-ecosystem": "main"}}}
+	for org, expected := range map[string][]string{"istio-ecosystem": {"main"}, "istio": {"master"}} {
+		file := filepath.Join(dir, org+".yaml")
+		if err := ioutil.WriteFile(file, []byte(`{"org": "`+org+`", "repo": "repo", "image": "image"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if branches := cli.ReadJobsConfig(file).Branches; !reflect.DeepEqual(branches, expected) {
+			t.Errorf("expected org %v to default to the branches %v, got %v", org, expected, branches)
+		}
+	}
+}
+
+func TestNodeSize(t *testing.T) {
+	toleration := v1.Toleration{Key: "dedicated", Value: "xlarge", Effect: v1.TaintEffectNoSchedule}
+	cli := &Client{GlobalConfig: GlobalConfig{NodeSizes: map[string]NodeSize{
+		"xlarge": {NodeSelector: map[string]string{"node-size": "xlarge"}, Tolerations: []v1.Toleration{toleration}},
+	}}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "sized", Types: []string{TypePresubmit}, NodeSize: "xlarge", NodeSelector: map[string]string{"pool": "build"}},
+			{Name: "unsized", Types: []string{TypePresubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	sized := presubmits[0].Spec
+	if expected := map[string]string{"pool": "build", "node-size": "xlarge"}; !reflect.DeepEqual(sized.NodeSelector, expected) {
+		t.Errorf("expected the node selector %v, got %v", expected, sized.NodeSelector)
+	}
+	if !reflect.DeepEqual(sized.Tolerations, []v1.Toleration{toleration}) {
+		t.Errorf("expected the tolerations of the node size, got %v", sized.Tolerations)
+	}
+	if unsized := presubmits[1].Spec; unsized.NodeSelector != nil || unsized.Tolerations != nil {
+		t.Errorf("expected no node selector nor tolerations, got %v and %v", unsized.NodeSelector, unsized.Tolerations)
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prowgen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, ".global.yaml"), []byte(`{"lockfile": "lockfile.yaml"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lockfile := `{"istio/api": {"sha": "0f1ac93c"}, "istio/tools": {"branch": "release-1.8", "sha": "bf6d37b1"}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "lockfile.yaml"), []byte(lockfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cli := &Client{GlobalConfig: ReadGlobalSettings(filepath.Join(dir, ".global.yaml"))}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{{
+			Name:  "job",
+			Types: []string{TypePeriodic},
+			Cron:  "0 0 * * *",
+			Repos: []string{"istio/api@lockfile", "istio/tools@lockfile", "istio/proxy"},
+		}},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	refs := cli.ConvertJobConfig(jobsConfig, "master").Periodics[0].ExtraRefs
+	expected := []struct{ repo, branch, sha string }{
+		{"istio", "master", ""},
+		{"api", "master", "0f1ac93c"},
+		{"tools", "release-1.8", "bf6d37b1"},
+		{"proxy", "master", ""},
+	}
+	if len(refs) != len(expected) {
+		t.Fatalf("expected %d refs, got %v", len(expected), refs)
+	}
+	for i, e := range expected {
+		if refs[i].Repo != e.repo || refs[i].BaseRef != e.branch || refs[i].BaseSHA != e.sha {
+			t.Errorf("expected ref %v@%v pinned to %q, got %v@%v pinned to %q", e.repo, e.branch, e.sha, refs[i].Repo, refs[i].BaseRef, refs[i].BaseSHA)
+		}
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:       "istio",
+		Repo:      "istio",
+		Image:     "image",
+		Namespace: "test-pods-networking",
+		Jobs: []Job{
+			{Name: "file", Types: []string{TypePresubmit}},
+			{Name: "job", Types: []string{TypePresubmit}, Namespace: "test-pods-security"},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []string{"test-pods-networking", "test-pods-security"} {
+		if ns := presubmits[i].Namespace; ns == nil || *ns != expected {
+			t.Errorf("expected job %v to run in the namespace %v, got %v", presubmits[i].Name, expected, ns)
+		}
+	}
+	unset := cli.ConvertJobConfig(JobsConfig{Org: "istio", Repo: "istio", Image: "image", Jobs: []Job{{Name: "job"}}}, "master")
+	if ns := unset.PresubmitsStatic["istio/istio"][0].Namespace; ns != nil {
+		t.Errorf("expected the namespace to be left to the Prow config, got %v", *ns)
+	}
+}
+
+func TestTTY(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "debug", Types: []string{TypePresubmit}, TTY: true, Stdin: true},
+			{Name: "test", Types: []string{TypePresubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []bool{true, false} {
+		c := presubmits[i].Spec.Containers[0]
+		if c.TTY != expected || c.Stdin != expected {
+			t.Errorf("expected job %v to have tty and stdin %v, got %v and %v", presubmits[i].Name, expected, c.TTY, c.Stdin)
+		}
+	}
+}
+
+func TestAssignClusterWeights(t *testing.T) {
+	pool := []string{"small", "large"}
+	weights := map[string]int{"large": 3}
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("job-%d", i)
+		cluster := assignCluster(name, pool, weights)
+		if again := assignCluster(name, pool, weights); again != cluster {
+			t.Errorf("job %v assignment is not stable: %v != %v", name, cluster, again)
+		}
+		counts[cluster]++
+	}
+	// The large cluster should get about three quarters of the jobs.
+	if counts["large"] < 650 || counts["large"] > 850 {
+		t.Errorf("expected the jobs to be spread proportionally to the weights, got %v", counts)
+	}
+
+	// Without weights, the assignment is uniform and unchanged.
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("job-%d", i)
+		if weighted, uniform := assignCluster(name, pool, map[string]int{"small": 1, "large": 1}), assignCluster(name, pool, nil); weighted != uniform {
+			t.Errorf("expected equal weights to assign job %v like no weights, got %v and %v", name, weighted, uniform)
+		}
+	}
+
+	// Weights not validated to be positive are clamped to 1.
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("job-%d", i)
+		if clamped, uniform := assignCluster(name, pool, map[string]int{"small": 0, "large": -1}), assignCluster(name, pool, nil); clamped != uniform {
+			t.Errorf("expected non positive weights to assign job %v like no weights, got %v and %v", name, clamped, uniform)
+		}
+	}
+}
+
+func TestContextPrefix(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:           "istio",
+		Repo:          "istio",
+		Branches:      []string{"master"},
+		Image:         "image",
+		ContextPrefix: "istio/",
+		Jobs: []Job{
+			{Name: "unit", Command: []string{"test"}},
+			{Name: "lint", Command: []string{"lint"}, Context: "lint"},
+			{Name: "build", Command: []string{"build"}, Types: []string{TypePostsubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	contexts := map[string]string{}
+	for _, presubmit := range cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"] {
+		contexts[presubmit.Name] = presubmit.Context
+	}
+	expected := map[string]string{"unit_istio": "istio/unit_istio", "lint_istio": "istio/lint"}
+	if !reflect.DeepEqual(contexts, expected) {
+		t.Errorf("expected contexts %v, got %v", expected, contexts)
+	}
+}
+
+func TestValidateContexts(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:    "istio",
+		Repo:   "istio",
+		Image:  "image",
+		Matrix: map[string][]string{"go": {"1.13", "1.14"}},
+		Jobs: []Job{
+			{Name: "unit-$(matrix.go)", Command: []string{"test"}, Context: "unit"},
+			{Name: "lint", Command: []string{"lint"}, KubernetesVersions: []string{"1.17", "1.18"}},
+		},
+	}
+	err := validateContexts("jobs.yaml", cli.ConvertJobConfig(jobsConfig, "master"))
+	if err == nil || !strings.Contains(err.Error(), "context unit of presubmit unit-1.14_istio is also the context of presubmit unit-1.13_istio") {
+		t.Errorf("expected the context shared by the matrix jobs to be rejected, got %v", err)
+	}
+	if err != nil && strings.Contains(err.Error(), "lint") {
+		t.Errorf("expected the kubernetes_versions of lint to have distinct contexts, got %v", err)
+	}
+
+	jobsConfig.Jobs[0].Context = ""
+	if err := validateContexts("jobs.yaml", cli.ConvertJobConfig(jobsConfig, "master")); err != nil {
+		t.Errorf("expected the contexts defaulting to the job names to be unique, got %v", err)
+	}
+}
+
+func TestDecorationResources(t *testing.T) {
+	sidecar := &v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("1Gi")},
+		Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("2Gi")},
+	}
+	initUpload := &v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+	}
+	cli := &Client{GlobalConfig: GlobalConfig{
+		MaxDecorationResources: v1.ResourceList{v1.ResourceMemory: resource.MustParse("4Gi")},
+	}}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:                 "istio",
+		Repo:                "istio",
+		Image:               "image",
+		DecorationResources: &prowjob.Resources{Sidecar: sidecar},
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}},
+			{Name: "override", Types: []string{TypePresubmit}, DecorationResources: &prowjob.Resources{InitUpload: initUpload}},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []*prowjob.Resources{{Sidecar: sidecar}, {InitUpload: initUpload}} {
+		if got := presubmits[i].DecorationConfig.Resources; !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected job %v to have the decoration resources %+v, got %+v", presubmits[i].Name, expected, got)
+		}
+	}
+
+	if err := validateDecorationResources(prowjob.Resources{Sidecar: &v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("3Gi")},
+		Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("8Gi")},
+	}}, cli.GlobalConfig.MaxDecorationResources); err == nil || !strings.Contains(err.Error(), "exceeds the max_decoration_resources") {
+		t.Errorf("expected resources over the maximum to be rejected, got %v", err)
+	}
+	if err := validateDecorationResources(prowjob.Resources{Sidecar: &v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceMemory: resource.MustParse("3Gi")},
+		Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("2Gi")},
+	}}, nil); err == nil || !strings.Contains(err.Error(), "exceeds its limit") {
+		t.Errorf("expected requests over the limits to be rejected, got %v", err)
+	}
+}
+
+func TestSkipDraft(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "expensive", Types: []string{TypePresubmit, TypePostsubmit}, SkipDraft: true},
+			{Name: "cheap", Types: []string{TypePresubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	presubmits := output.PresubmitsStatic["istio/istio"]
+	for i, expected := range []string{"true", ""} {
+		if got := presubmits[i].Annotations[SkipDraftAnnotation]; got != expected {
+			t.Errorf("expected job %v to have the %v annotation %q, got %q", presubmits[i].Name, SkipDraftAnnotation, expected, got)
+		}
+	}
+	if _, f := output.PostsubmitsStatic["istio/istio"][0].Annotations[SkipDraftAnnotation]; f {
+		t.Errorf("expected the postsubmit not to have the %v annotation", SkipDraftAnnotation)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:         "istio",
+		Repo:        "istio",
+		Image:       "image",
+		RetryPolicy: &RetryPolicy{MaxRetries: 2, RetryOn: []string{"evicted", "node-lost"}},
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}},
+			{Name: "flaky", Types: []string{TypePresubmit}, RetryPolicy: &RetryPolicy{MaxRetries: 5, RetryOn: []string{"image-pull"}}},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []map[string]string{
+		{RetryMaxRetriesAnnotation: "2", RetryOnAnnotation: "evicted,node-lost"},
+		{RetryMaxRetriesAnnotation: "5", RetryOnAnnotation: "image-pull"},
+	} {
+		for k, v := range expected {
+			if got := presubmits[i].Annotations[k]; got != v {
+				t.Errorf("expected job %v to have the annotation %v=%v, got %q", presubmits[i].Name, k, v, got)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		policy   RetryPolicy
+		expected string
+	}{
+		{RetryPolicy{MaxRetries: 6, RetryOn: []string{"evicted"}}, "max_retries 6 must be between 1 and 5"},
+		{RetryPolicy{MaxRetries: 1}, "retry_on must list at least one condition"},
+		{RetryPolicy{MaxRetries: 1, RetryOn: []string{"test-failure"}}, "'test-failure' is not a valid retry_on condition"},
+	} {
+		if err := validateRetryPolicy(tc.policy); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("expected the retry policy %+v to be rejected with %q, got %v", tc.policy, tc.expected, err)
+		}
+	}
+}
+
+func TestTerminationMessagePolicy(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:                      "istio",
+		Repo:                     "istio",
+		Image:                    "image",
+		TerminationMessagePolicy: string(v1.TerminationMessageFallbackToLogsOnError),
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}},
+			{Name: "override", Types: []string{TypePresubmit}, TerminationMessagePolicy: string(v1.TerminationMessageReadFile)},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []v1.TerminationMessagePolicy{v1.TerminationMessageFallbackToLogsOnError, v1.TerminationMessageReadFile} {
+		if got := presubmits[i].Spec.Containers[0].TerminationMessagePolicy; got != expected {
+			t.Errorf("expected job %v to have the termination message policy %v, got %v", presubmits[i].Name, expected, got)
+		}
+	}
+	unset := cli.ConvertJobConfig(JobsConfig{Org: "istio", Repo: "istio", Image: "image", Jobs: []Job{{Name: "job"}}}, "master")
+	if got := unset.PresubmitsStatic["istio/istio"][0].Spec.Containers[0].TerminationMessagePolicy; got != "" {
+		t.Errorf("expected the termination message policy to be left to Kubernetes, got %v", got)
+	}
+}
+
+func TestKubernetesVersions(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{
+				Name:               "e2e",
+				Types:              []string{TypePresubmit},
+				KubernetesVersions: []string{"1.17", "1.18.2"},
+				Architectures:      []string{ArchAMD64, ArchARM64},
+				Env:                []v1.EnvVar{{Name: "FOO", Value: "bar"}},
+			},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	versions := map[string]string{}
+	for _, presubmit := range cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"] {
+		env := presubmit.Spec.Containers[0].Env
+		if len(env) != 2 || env[0].Name != KubernetesVersionEnv || env[1].Name != "FOO" {
+			t.Errorf("expected job %v to have the %v env along its own, got %v", presubmit.Name, KubernetesVersionEnv, env)
+			continue
+		}
+		versions[presubmit.Name] = env[0].Value
+	}
+	expected := map[string]string{
+		"e2e-k8s-1.17_istio":         "1.17",
+		"e2e-k8s-1.17-arm64_istio":   "1.17",
+		"e2e-k8s-1.18.2_istio":       "1.18.2",
+		"e2e-k8s-1.18.2-arm64_istio": "1.18.2",
+	}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected jobs %v, got %v", expected, versions)
+	}
+
+	if name := longestJobName(jobsConfig.Jobs[0], jobsConfig); name != "e2e-k8s-1.18.2-arm64_istio" {
+		t.Errorf("expected the longest name to account for the kubernetes versions, got %v", name)
+	}
+	for _, version := range []string{"v1.18", "1.18.x", "1"} {
+		if kubernetesVersionRegex.MatchString(version) {
+			t.Errorf("expected the kubernetes version %v to be rejected", version)
+		}
+	}
+}
+
+func TestHostNetwork(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{HostNetworkClusters: []string{"trusted"}}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "cni", Types: []string{TypePresubmit}, Cluster: "trusted", HostNetwork: newBool(true)},
+			{Name: "dns", Types: []string{TypePresubmit}, Cluster: "trusted", HostNetwork: newBool(true), DNSPolicy: string(v1.DNSDefault)},
+			{Name: "unit", Types: []string{TypePresubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []struct {
+		hostNetwork bool
+		dnsPolicy   v1.DNSPolicy
+	}{
+		{true, v1.DNSClusterFirstWithHostNet},
+		{true, v1.DNSDefault},
+		{false, ""},
+	} {
+		spec := presubmits[i].Spec
+		if spec.HostNetwork != expected.hostNetwork || spec.DNSPolicy != expected.dnsPolicy {
+			t.Errorf("expected job %v to have host network %v and dns policy %q, got %v and %q",
+				presubmits[i].Name, expected.hostNetwork, expected.dnsPolicy, spec.HostNetwork, spec.DNSPolicy)
+		}
+	}
+}
+
+func TestArtifactRetention(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:               "istio",
+		Repo:              "istio",
+		Image:             "image",
+		ArtifactRetention: map[string]string{TypePresubmit: "7d", TypePostsubmit: "365d"},
+		Jobs: []Job{
+			{Name: "build", Types: []string{TypePresubmit, TypePostsubmit, TypePeriodic}, Cron: "0 2 * * *"},
+			{Name: "release", Types: []string{TypePresubmit, TypePostsubmit}, ArtifactRetention: "forever"},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	retentions := map[string]string{}
+	for _, presubmit := range output.PresubmitsStatic["istio/istio"] {
+		retentions[presubmit.Name] = presubmit.Annotations[ArtifactRetentionAnnotation]
+	}
+	for _, postsubmit := range output.PostsubmitsStatic["istio/istio"] {
+		retentions[postsubmit.Name] = postsubmit.Annotations[ArtifactRetentionAnnotation]
+	}
+	for _, periodic := range output.Periodics {
+		if _, f := periodic.Annotations[ArtifactRetentionAnnotation]; f {
+			t.Errorf("expected periodic %v without a retention not to have the %v annotation", periodic.Name, ArtifactRetentionAnnotation)
+		}
+	}
+	expected := map[string]string{
+		"build_istio":              "7d",
+		"build_istio_postsubmit":   "365d",
+		"release_istio":            "forever",
+		"release_istio_postsubmit": "forever",
+	}
+	if !reflect.DeepEqual(retentions, expected) {
+		t.Errorf("expected retentions %v, got %v", expected, retentions)
+	}
+}
+
+func TestContainerImagePullPolicies(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+		Org:             "istio",
+		Repo:            "istio",
+		Image:           "image",
+		ImagePullPolicy: string(v1.PullAlways),
+		Jobs: []Job{
+			{Name: "default", Types: []string{TypePresubmit}},
+			{Name: "override", Types: []string{TypePresubmit}, ImagePullPolicy: string(v1.PullNever)},
+		},
+	})
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, expected := range []v1.PullPolicy{v1.PullAlways, v1.PullNever} {
+		if got := presubmits[i].Spec.Containers[0].ImagePullPolicy; got != expected {
+			t.Errorf("expected the test container of job %v to have the pull policy %v, got %v", presubmits[i].Name, expected, got)
+		}
+	}
+}
+
+func TestTeamAlertEmails(t *testing.T) {
+	cli := &Client{GlobalConfig: GlobalConfig{TestgridConfig: TestgridConfig{
+		Enabled:         true,
+		AlertEmail:      "oncall@example.com",
+		TeamAlertEmails: map[string]string{"networking": "networking@example.com"},
+	}}}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "pilot", Types: []string{TypePostsubmit, TypePeriodic}, Cron: "0 2 * * *", Owner: "networking"},
+			{Name: "docs", Types: []string{TypePostsubmit}, Owner: "docs"},
+			{Name: "unowned", Types: []string{TypePostsubmit}},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	emails := map[string]string{}
+	for _, postsubmit := range output.PostsubmitsStatic["istio/istio"] {
+		emails[postsubmit.Name] = postsubmit.Annotations[TestGridAlertEmail]
+	}
+	for _, periodic := range output.Periodics {
+		emails[periodic.Name] = periodic.Annotations[TestGridAlertEmail]
+	}
+	expected := map[string]string{
+		"pilot_istio_postsubmit":   "networking@example.com",
+		"pilot_istio_periodic":     "networking@example.com",
+		"docs_istio_postsubmit":    "oncall@example.com",
+		"unowned_istio_postsubmit": "oncall@example.com",
+	}
+	if !reflect.DeepEqual(emails, expected) {
+		t.Errorf("expected alert emails %v, got %v", expected, emails)
+	}
+}
+
+func TestTypePriorityClasses(t *testing.T) {
+	high, low := "ci-high", "ci-low"
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:                    "istio",
+		Repo:                   "istio",
+		Image:                  "image",
+		PresubmitPriorityClass: &high,
+		PeriodicPriorityClass:  &low,
+		Jobs: []Job{
+			{Name: "build", Types: []string{TypePresubmit, TypePostsubmit, TypePeriodic}, Cron: "0 2 * * *"},
+			{Name: "release", Types: []string{TypePresubmit, TypePeriodic}, Cron: "0 2 * * *", PriorityClassName: "ci-critical"},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	classes := map[string]string{}
+	for _, presubmit := range output.PresubmitsStatic["istio/istio"] {
+		classes[presubmit.Name] = presubmit.Spec.PriorityClassName
+	}
+	for _, postsubmit := range output.PostsubmitsStatic["istio/istio"] {
+		classes[postsubmit.Name] = postsubmit.Spec.PriorityClassName
+	}
+	for _, periodic := range output.Periodics {
+		classes[periodic.Name] = periodic.Spec.PriorityClassName
+	}
+	expected := map[string]string{
+		"build_istio":            high,
+		"build_istio_postsubmit": "",
+		"build_istio_periodic":   low,
+		"release_istio":          "ci-critical",
+		"release_istio_periodic": "ci-critical",
+	}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("expected priority classes %v, got %v", expected, classes)
+	}
+}
+
+func TestBootstrappingRepos(t *testing.T) {
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "unit", Types: []string{TypePresubmit}},
+			{Name: "lint", Types: []string{TypePresubmit}, Modifiers: []string{ModifierOptional}},
+		},
+	}
+	for _, tc := range []struct {
+		bootstrapping map[string]bool
+		expected      []bool
+	}{
+		{map[string]bool{"istio/istio": true}, []bool{true, true}},
+		{map[string]bool{"istio/istio": false}, []bool{false, true}},
+		{map[string]bool{"istio/proxy": true}, []bool{false, true}},
+	} {
+		cli := &Client{GlobalConfig: GlobalConfig{BootstrappingRepos: tc.bootstrapping}}
+		cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+		presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+		for i, expected := range tc.expected {
+			if presubmits[i].Optional != expected {
+				t.Errorf("bootstrapping repos %v: expected job %v to be optional %v, got %v", tc.bootstrapping, presubmits[i].Name, expected, presubmits[i].Optional)
+			}
+		}
+	}
+}
+
+func TestResourceMode(t *testing.T) {
+	preset := v1.ResourceRequirements{
+		Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")},
+		Limits:   v1.ResourceList{v1.ResourceCPU: resource.MustParse("2")},
+	}
+	for _, tc := range []struct {
+		mode     string
+		expected v1.ResourceRequirements
+	}{
+		{"", preset},
+		{ResourceModeBoth, preset},
+		{ResourceModeRequests, v1.ResourceRequirements{Requests: preset.Requests}},
+		{ResourceModeLimits, v1.ResourceRequirements{Limits: preset.Limits}},
+	} {
+		cli := &Client{}
+		jobsConfig := resolveOverwrites(cli.GlobalConfig, JobsConfig{
+			Org:             "istio",
+			Repo:            "istio",
+			Image:           "image",
+			ResourcePresets: map[string]v1.ResourceRequirements{DefaultResource: preset},
+			ResourceMode:    tc.mode,
+			Jobs:            []Job{{Name: "unit", Types: []string{TypePresubmit}}},
+		})
+		cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+		got := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"][0].Spec.Containers[0].Resources
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("resource mode %q: expected resources %+v, got %+v", tc.mode, tc.expected, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		mode      string
+		resources v1.ResourceRequirements
+		expected  string
+	}{
+		{ResourceModeLimits, v1.ResourceRequirements{Requests: preset.Requests}, "requires the preset to set limits"},
+		{ResourceModeRequests, v1.ResourceRequirements{Limits: preset.Limits}, "requires the preset to set requests"},
+		{ResourceModeBoth, v1.ResourceRequirements{Requests: preset.Limits, Limits: preset.Requests}, "cpu request 2 exceeds its limit 1"},
+	} {
+		if err := validateResourceMode(modeResources(tc.resources, tc.mode), tc.mode); err == nil || !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("resource mode %v: expected an error containing %q, got %v", tc.mode, tc.expected, err)
+		}
+	}
+}
+
+func TestSubPathJobPlaceholder(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{Name: "build", Types: []string{TypePresubmit}, Requirements: []string{"cache"}},
+			{Name: "test", Types: []string{TypePresubmit}, Requirements: []string{"cache"}},
+		},
+		RequirementPresets: map[string]RequirementPreset{
+			"cache": {
+				PersistentCache: &PersistentCache{ClaimName: "build-cache", MountPath: "/cache", SubPath: "{job}"},
+				Volumes:         []v1.Volume{{Name: "scratch"}},
+				VolumeMounts:    []v1.VolumeMount{{Name: "scratch", MountPath: "/scratch", SubPath: "jobs/{job}/tmp"}},
+			},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	presubmits := cli.ConvertJobConfig(jobsConfig, "master").PresubmitsStatic["istio/istio"]
+	for i, name := range []string{"build_istio", "test_istio"} {
+		subPaths := map[string]string{}
+		for _, vm := range presubmits[i].Spec.Containers[0].VolumeMounts {
+			subPaths[vm.MountPath] = vm.SubPath
+		}
+		expected := map[string]string{"/cache": name, "/scratch": "jobs/" + name + "/tmp"}
+		if !reflect.DeepEqual(subPaths, expected) {
+			t.Errorf("expected job %v to have the subPaths %v, got %v", name, expected, subPaths)
+		}
+	}
+	if subPath := jobsConfig.RequirementPresets["cache"].VolumeMounts[0].SubPath; subPath != "jobs/{job}/tmp" {
+		t.Errorf("expected the preset not to be modified, got the subPath %v", subPath)
+	}
+
+	for _, subPath := range []string{"/abs", "../other", "jobs/../../other"} {
+		preset := RequirementPreset{VolumeMounts: []v1.VolumeMount{{Name: "scratch", MountPath: "/scratch", SubPath: subPath}}}
+		if err := validateRequirementPreset("cache", preset); err == nil {
+			t.Errorf("expected the subPath %v to be rejected", subPath)
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:   "istio",
+		Repo:  "istio",
+		Image: "image",
+		Jobs: []Job{
+			{
+				Name:   "integ",
+				Types:  []string{TypePostsubmit, TypePeriodic},
+				Cron:   "0 4 * * *",
+				Shards: 3,
+				Env:    []v1.EnvVar{{Name: "FOO", Value: "bar"}},
+			},
+		},
+	}
+	cli.ValidateJobConfig("jobs.yaml", jobsConfig)
+
+	shardEnv := func(env []v1.EnvVar) string {
+		values := map[string]string{}
+		for _, e := range env {
+			values[e.Name] = e.Value
+		}
+		return values[ShardIndexEnv] + "/" + values[ShardCountEnv] + "/" + values["FOO"]
+	}
+	output := cli.ConvertJobConfig(jobsConfig, "master")
+	shards := map[string]string{}
+	for _, postsubmit := range output.PostsubmitsStatic["istio/istio"] {
+		shards[postsubmit.Name] = shardEnv(postsubmit.Spec.Containers[0].Env)
+	}
+	for _, periodic := range output.Periodics {
+		shards[periodic.Name] = shardEnv(periodic.Spec.Containers[0].Env)
+	}
+	expected := map[string]string{
+		"integ-shard-0_istio_postsubmit": "0/3/bar",
+		"integ-shard-1_istio_postsubmit": "1/3/bar",
+		"integ-shard-2_istio_postsubmit": "2/3/bar",
+		"integ-shard-0_istio_periodic":   "0/3/bar",
+		"integ-shard-1_istio_periodic":   "1/3/bar",
+		"integ-shard-2_istio_periodic":   "2/3/bar",
+	}
+	if !reflect.DeepEqual(shards, expected) {
+		t.Errorf("expected shards %v, got %v", expected, shards)
+	}
+
+	jobsConfig.Jobs[0].Shards = 12
+	if name := longestJobName(jobsConfig.Jobs[0], jobsConfig); name != "integ-shard-11_istio_postsubmit" {
+		t.Errorf("expected the longest name to account for the shards, got %v", name)
+	}
+}
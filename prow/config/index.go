@@ -0,0 +1,107 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/test-infra/prow/config"
+)
+
+// JobProvenance records the meta config a generated job is produced from.
+type JobProvenance struct {
+	// File is the path of the meta config file.
+	File string
+	// Job is the name of the job in the file, before expansion.
+	Job    string
+	Branch string
+	Type   string
+	// Matrix is the matrix cell the job is expanded from, if any.
+	Matrix map[string]string
+}
+
+// BuildJobIndex generates the jobs of the meta config files of the directory and returns the
+// provenance of each generated job, keyed by its name. Each file is validated and generated once
+// per branch, like the generator does, and the jobs are attributed to the job of the file they are
+// expanded from. Files are selected like the generator does, skipping the ones starting with a ".".
+func (cli *Client) BuildJobIndex(dir string) (map[string]JobProvenance, error) {
+	index := map[string]JobProvenance{}
+	add := func(jb config.JobBase, provenance JobProvenance) error {
+		if existing, f := index[jb.Name]; f {
+			return fmt.Errorf("job %v is generated from both %v job %v and %v job %v",
+				jb.Name, existing.File, existing.Job, provenance.File, provenance.Job)
+		}
+		if cell := jb.Annotations[MatrixAnnotation]; cell != "" {
+			if err := json.Unmarshal([]byte(cell), &provenance.Matrix); err != nil {
+				return fmt.Errorf("failed to unmarshal the matrix cell of job %v: %v", jb.Name, err)
+			}
+		}
+		index[jb.Name] = provenance
+		return nil
+	}
+
+	err := filepath.Walk(dir, func(src string, file os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file.IsDir() {
+			return nil
+		}
+		if filepath.Ext(file.Name()) != ".yaml" && filepath.Ext(file.Name()) != ".yml" || strings.HasPrefix(file.Name(), ".") {
+			return nil
+		}
+		jobsConfig, err := cli.LoadJobsConfig(src)
+		if err != nil {
+			return err
+		}
+		if err := cli.VerifyJobConfig(src, jobsConfig); err != nil {
+			return fmt.Errorf("validation failed: %v", err)
+		}
+		repo := fmt.Sprintf("%s/%s", jobsConfig.Org, jobsConfig.Repo)
+		for _, branch := range jobsConfig.Branches {
+			output, parents, err := cli.generateJobConfig(jobsConfig, branch)
+			if err != nil {
+				return fmt.Errorf("%s: %v", src, err)
+			}
+			provenance := func(jobType string, i int) JobProvenance {
+				return JobProvenance{File: src, Job: parents[jobType][i], Branch: branch, Type: jobType}
+			}
+			for i, presubmit := range output.PresubmitsStatic[repo] {
+				if err := add(presubmit.JobBase, provenance(TypePresubmit, i)); err != nil {
+					return err
+				}
+			}
+			for i, postsubmit := range output.PostsubmitsStatic[repo] {
+				if err := add(postsubmit.JobBase, provenance(TypePostsubmit, i)); err != nil {
+					return err
+				}
+			}
+			for i, periodic := range output.Periodics {
+				if err := add(periodic.JobBase, provenance(TypePeriodic, i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildJobIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job-index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "istio.yaml")
+	content := `{
+  "org": "istio",
+  "repo": "istio",
+  "image": "image",
+  "branches": ["master", "release-1.6"],
+  "matrix": {"go": ["1.13", "1.14"]},
+  "jobs": [
+    {"name": "unit-go-$(matrix.go)", "types": ["presubmit"], "command": ["make", "test"]},
+    {"name": "build", "types": ["postsubmit", "periodic"], "command": ["make", "build"], "cron": "0 2 * * *"}
+  ]
+}`
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Files starting with a "." are not job configs.
+	if err := ioutil.WriteFile(filepath.Join(dir, ".global.yaml"), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := (&Client{}).BuildJobIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]JobProvenance{
+		"unit-go-1.13_istio":                 {File: file, Job: "unit-go-$(matrix.go)", Branch: "master", Type: TypePresubmit, Matrix: map[string]string{"go": "1.13"}},
+		"unit-go-1.14_istio":                 {File: file, Job: "unit-go-$(matrix.go)", Branch: "master", Type: TypePresubmit, Matrix: map[string]string{"go": "1.14"}},
+		"unit-go-1.13_istio_release-1.6":     {File: file, Job: "unit-go-$(matrix.go)", Branch: "release-1.6", Type: TypePresubmit, Matrix: map[string]string{"go": "1.13"}},
+		"unit-go-1.14_istio_release-1.6":     {File: file, Job: "unit-go-$(matrix.go)", Branch: "release-1.6", Type: TypePresubmit, Matrix: map[string]string{"go": "1.14"}},
+		"build_istio_postsubmit":             {File: file, Job: "build", Branch: "master", Type: TypePostsubmit},
+		"build_istio_release-1.6_postsubmit": {File: file, Job: "build", Branch: "release-1.6", Type: TypePostsubmit},
+		"build_istio_periodic":               {File: file, Job: "build", Branch: "master", Type: TypePeriodic},
+		"build_istio_release-1.6_periodic":   {File: file, Job: "build", Branch: "release-1.6", Type: TypePeriodic},
+	}
+	if !reflect.DeepEqual(index, expected) {
+		for name, provenance := range index {
+			if !reflect.DeepEqual(provenance, expected[name]) {
+				t.Errorf("job %v: expected %+v, got %+v", name, expected[name], provenance)
+			}
+		}
+		for name := range expected {
+			if _, f := index[name]; !f {
+				t.Errorf("expected job %v to be indexed", name)
+			}
+		}
+	}
+}
+
+func TestBuildJobIndexErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{name: "malformed", content: `{"org": "istio",`},
+		{name: "invalid", content: `{"repo": "istio", "image": "image", "jobs": [{"name": "unit", "command": ["make"]}]}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "job-index")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := ioutil.WriteFile(filepath.Join(dir, "istio.yaml"), []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := (&Client{}).BuildJobIndex(dir); err == nil {
+				t.Errorf("expected an error, got nil")
+			}
+		})
+	}
+}
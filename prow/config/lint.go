@@ -0,0 +1,69 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/test-infra/prow/config"
+)
+
+// LintThresholds defines the resource requests above which a job is considered expensive.
+// A zero quantity disables the check for that resource.
+type LintThresholds struct {
+	CPU    resource.Quantity
+	Memory resource.Quantity
+}
+
+// LintExpensivePresubmits returns a finding for every presubmit that runs on all pull requests
+// while requesting more resources than the thresholds.
+func LintExpensivePresubmits(jobs config.JobConfig, thresholds LintThresholds) []string {
+	orgRepos := make([]string, 0, len(jobs.PresubmitsStatic))
+	for orgRepo := range jobs.PresubmitsStatic {
+		orgRepos = append(orgRepos, orgRepo)
+	}
+	sort.Strings(orgRepos)
+
+	var findings []string
+	for _, orgRepo := range orgRepos {
+		for _, presubmit := range jobs.PresubmitsStatic[orgRepo] {
+			if !presubmit.AlwaysRun || presubmit.RunIfChanged != "" || presubmit.Spec == nil {
+				continue
+			}
+			for _, c := range presubmit.Spec.Containers {
+				if exceeded := exceededResources(c.Resources.Requests, thresholds); len(exceeded) > 0 {
+					findings = append(findings, fmt.Sprintf(
+						"%s: presubmit %s always runs and requests %v above the threshold, consider limiting it with `regex`",
+						orgRepo, presubmit.Name, exceeded))
+				}
+			}
+		}
+	}
+	return findings
+}
+
+func exceededResources(requests v1.ResourceList, thresholds LintThresholds) []string {
+	var exceeded []string
+	if cpu, ok := requests[v1.ResourceCPU]; ok && !thresholds.CPU.IsZero() && cpu.Cmp(thresholds.CPU) > 0 {
+		exceeded = append(exceeded, fmt.Sprintf("cpu %s", cpu.String()))
+	}
+	if memory, ok := requests[v1.ResourceMemory]; ok && !thresholds.Memory.IsZero() && memory.Cmp(thresholds.Memory) > 0 {
+		exceeded = append(exceeded, fmt.Sprintf("memory %s", memory.String()))
+	}
+	return exceeded
+}
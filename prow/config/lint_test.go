@@ -0,0 +1,57 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/test-infra/prow/config"
+)
+
+func TestLintExpensivePresubmits(t *testing.T) {
+	presubmit := func(name string, alwaysRun bool, regex string, cpu string) config.Presubmit {
+		return config.Presubmit{
+			JobBase: config.JobBase{
+				Name: name,
+				Spec: &v1.PodSpec{
+					Containers: []v1.Container{{
+						Resources: v1.ResourceRequirements{
+							Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu)},
+						},
+					}},
+				},
+			},
+			AlwaysRun:           alwaysRun,
+			RegexpChangeMatcher: config.RegexpChangeMatcher{RunIfChanged: regex},
+		}
+	}
+	jobs := config.JobConfig{
+		PresubmitsStatic: map[string][]config.Presubmit{
+			"istio/istio": {
+				presubmit("cheap", true, "", "1"),
+				presubmit("expensive", true, "", "16"),
+				presubmit("expensive-filtered", false, "^foo/", "16"),
+				presubmit("expensive-skipped", false, "", "16"),
+			},
+		},
+	}
+
+	findings := LintExpensivePresubmits(jobs, LintThresholds{CPU: resource.MustParse("8")})
+	if len(findings) != 1 {
+		t.Fatalf("expected exactly one finding, got %v", findings)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/test-infra/prow/config"
+)
+
+type jobRow struct {
+	name      string
+	jobType   string
+	trigger   string
+	resources string
+	owner     string
+	// repo and branch are not rendered, they order the rows of jobs of the same name and type.
+	repo   string
+	branch string
+}
+
+// RenderJobsTable renders a markdown table with one row per generated job, sorted by name, type,
+// org/repo and branch, so the output is deterministic and can be committed and checked for drift.
+func RenderJobsTable(jobConfigs ...config.JobConfig) string {
+	var rows []jobRow
+	for _, jc := range jobConfigs {
+		for repo, presubmits := range jc.PresubmitsStatic {
+			for _, job := range presubmits {
+				trigger := "always"
+				if job.RunIfChanged != "" {
+					trigger = "changes matching `" + job.RunIfChanged + "`"
+				} else if !job.AlwaysRun {
+					trigger = "manual"
+				}
+				rows = append(rows, newJobRow(job.JobBase, TypePresubmit, trigger, repo, job.Brancher))
+			}
+		}
+		for repo, postsubmits := range jc.PostsubmitsStatic {
+			for _, job := range postsubmits {
+				trigger := "merge"
+				if job.RunIfChanged != "" {
+					trigger = "merge of changes matching `" + job.RunIfChanged + "`"
+				}
+				rows = append(rows, newJobRow(job.JobBase, TypePostsubmit, trigger, repo, job.Brancher))
+			}
+		}
+		for _, job := range jc.Periodics {
+			trigger := "cron `" + job.Cron + "`"
+			if job.Interval != "" {
+				trigger = "every " + job.Interval
+			}
+			row := newJobRow(job.JobBase, TypePeriodic, trigger, "", config.Brancher{})
+			if len(job.ExtraRefs) > 0 {
+				row.repo = job.ExtraRefs[0].Org + "/" + job.ExtraRefs[0].Repo
+				row.branch = job.ExtraRefs[0].BaseRef
+			}
+			rows = append(rows, row)
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.jobType != b.jobType {
+			return a.jobType < b.jobType
+		}
+		if a.repo != b.repo {
+			return a.repo < b.repo
+		}
+		return a.branch < b.branch
+	})
+
+	var sb strings.Builder
+	sb.WriteString("| Name | Type | Trigger | Resources | Owner |\n")
+	sb.WriteString("| --- | --- | --- | --- | --- |\n")
+	for _, r := range rows {
+		cells := []string{r.name, r.jobType, r.trigger, r.resources, r.owner}
+		for i := range cells {
+			cells[i] = strings.ReplaceAll(cells[i], "|", `\|`)
+		}
+		sb.WriteString("| " + strings.Join(cells, " | ") + " |\n")
+	}
+	return sb.String()
+}
+
+func newJobRow(jb config.JobBase, jobType, trigger, repo string, brancher config.Brancher) jobRow {
+	return jobRow{
+		name:      jb.Name,
+		jobType:   jobType,
+		trigger:   trigger,
+		resources: describeResources(jb.Spec),
+		owner:     jb.Annotations[OwnerAnnotation],
+		repo:      repo,
+		branch:    strings.Join(brancher.Branches, ","),
+	}
+}
+
+// describeResources summarizes the resource requests of the containers of the pod.
+func describeResources(spec *v1.PodSpec) string {
+	if spec == nil {
+		return ""
+	}
+	var descriptions []string
+	for _, c := range spec.Containers {
+		var requests []string
+		if cpu, ok := c.Resources.Requests[v1.ResourceCPU]; ok {
+			requests = append(requests, fmt.Sprintf("cpu: %s", cpu.String()))
+		}
+		if memory, ok := c.Resources.Requests[v1.ResourceMemory]; ok {
+			requests = append(requests, fmt.Sprintf("memory: %s", memory.String()))
+		}
+		if len(requests) > 0 {
+			descriptions = append(descriptions, strings.Join(requests, ", "))
+		}
+	}
+	return strings.Join(descriptions, "; ")
+}
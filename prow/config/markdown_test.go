@@ -0,0 +1,87 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/test-infra/prow/config"
+)
+
+func TestRenderJobsTable(t *testing.T) {
+	spec := &v1.PodSpec{
+		Containers: []v1.Container{{
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceCPU:    resource.MustParse("1"),
+					v1.ResourceMemory: resource.MustParse("3Gi"),
+				},
+			},
+		}},
+	}
+	jobs := config.JobConfig{
+		PresubmitsStatic: map[string][]config.Presubmit{
+			"istio/istio": {{
+				JobBase:             config.JobBase{Name: "unit", Spec: spec, Annotations: map[string]string{OwnerAnnotation: "team"}},
+				RegexpChangeMatcher: config.RegexpChangeMatcher{RunIfChanged: "a|b"},
+			}},
+		},
+		Periodics: []config.Periodic{{
+			JobBase:  config.JobBase{Name: "nightly"},
+			Interval: "24h",
+		}},
+	}
+
+	expected := `| Name | Type | Trigger | Resources | Owner |
+| --- | --- | --- | --- | --- |
+| nightly | periodic | every 24h |  |  |
+| unit | presubmit | changes matching ` + "`a\\|b`" + ` | cpu: 1, memory: 3Gi | team |
+`
+	if actual := RenderJobsTable(jobs); actual != expected {
+		t.Errorf("unexpected table:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
+
+func TestRenderJobsTableOrder(t *testing.T) {
+	// The owners tell the rows of jobs of the same name and type apart.
+	presubmit := func(branch, owner string) config.Presubmit {
+		return config.Presubmit{
+			JobBase:   config.JobBase{Name: "lint", Annotations: map[string]string{OwnerAnnotation: owner}},
+			AlwaysRun: true,
+			Brancher:  config.Brancher{Branches: []string{branch}},
+		}
+	}
+	jobs := []config.JobConfig{
+		{
+			PresubmitsStatic:  map[string][]config.Presubmit{"istio/proxy": {presubmit("^master$", "proxy")}},
+			PostsubmitsStatic: map[string][]config.Postsubmit{"istio/istio": {{JobBase: config.JobBase{Name: "lint"}}}},
+		},
+		{PresubmitsStatic: map[string][]config.Presubmit{"istio/istio": {presubmit("^release-1.8$", "release")}}},
+		{PresubmitsStatic: map[string][]config.Presubmit{"istio/istio": {presubmit("^master$", "master")}}},
+	}
+
+	expected := `| Name | Type | Trigger | Resources | Owner |
+| --- | --- | --- | --- | --- |
+| lint | postsubmit | merge |  |  |
+| lint | presubmit | always |  | master |
+| lint | presubmit | always |  | release |
+| lint | presubmit | always |  | proxy |
+`
+	if actual := RenderJobsTable(jobs...); actual != expected {
+		t.Errorf("unexpected table:\n%s\nexpected:\n%s", actual, expected)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	v1 "k8s.io/api/core/v1"
+	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/config"
+)
+
+// migrationTodoPrefix prefixes the comments recording the settings a migration could not convert.
+const migrationTodoPrefix = "# TODO(migration): "
+
+// MigrateJobConfig converts the jobs of a handwritten Prow job config for the org/repo on the branch
+// into the equivalent meta config. The resources and volumes of each job are converted into a resource
+// and requirement preset named after it. Settings without an equivalent in the meta config are
+// returned as TODOs, to be resolved by hand.
+func MigrateJobConfig(jc config.JobConfig, org, repo, branch string) (JobsConfig, []string) {
+	m := &migration{
+		jobsConfig: JobsConfig{
+			Org:                org,
+			Repo:               repo,
+			Branches:           []string{branch},
+			ResourcePresets:    map[string]v1.ResourceRequirements{},
+			RequirementPresets: map[string]RequirementPreset{},
+		},
+		suffix: "_" + repo,
+	}
+	if branch != "master" {
+		m.suffix += "_" + branch
+	}
+	orgRepo := org + "/" + repo
+
+	for _, presubmit := range jc.PresubmitsStatic[orgRepo] {
+		job := m.migrateJobBase(presubmit.JobBase, "", branch)
+		if presubmit.RunIfChanged != "" {
+			job.Regex = presubmit.RunIfChanged
+		} else if !presubmit.AlwaysRun {
+			job.Modifiers = append(job.Modifiers, ModifierSkipped)
+		}
+		if presubmit.Optional {
+			job.Modifiers = append(job.Modifiers, ModifierOptional)
+		}
+		if presubmit.SkipReport {
+			job.Modifiers = append(job.Modifiers, ModifierHidden)
+		}
+		if presubmit.Context != "" && presubmit.Context != presubmit.Name {
+			job.Context = presubmit.Context
+		}
+		if presubmit.Trigger != "" || presubmit.RerunCommand != "" {
+			m.todo(presubmit.Name, "trigger and rerun_command are not supported, use aliases for former job names")
+		}
+		m.add(job, TypePresubmit)
+	}
+	for _, postsubmit := range jc.PostsubmitsStatic[orgRepo] {
+		job := m.migrateJobBase(postsubmit.JobBase, "_postsubmit", branch)
+		job.Regex = postsubmit.RunIfChanged
+		if postsubmit.SkipReport {
+			job.Modifiers = append(job.Modifiers, ModifierHidden)
+		}
+		m.add(job, TypePostsubmit)
+	}
+	for _, periodic := range jc.Periodics {
+		refs := periodic.ExtraRefs
+		if len(refs) == 0 || refs[0].Org != org || refs[0].Repo != repo {
+			continue
+		}
+		// The repo of the meta config is cloned first by the generated periodics.
+		periodic.ExtraRefs = refs[1:]
+		job := m.migrateJobBase(periodic.JobBase, "_periodic", branch)
+		job.Cron = periodic.Cron
+		job.Interval = periodic.Interval
+		m.add(job, TypePeriodic)
+	}
+
+	return m.jobsConfig, m.todos
+}
+
+// MarshalMigratedJobsConfig marshals the migrated meta config, recording the TODOs of the migration
+// as comments at the top of the file.
+func MarshalMigratedJobsConfig(jobsConfig JobsConfig, todos []string) ([]byte, error) {
+	bs, err := yaml.Marshal(jobsConfig)
+	if err != nil {
+		return nil, err
+	}
+	header := ""
+	for _, todo := range todos {
+		header += migrationTodoPrefix + todo + "\n"
+	}
+	return append([]byte(header), bs...), nil
+}
+
+type migration struct {
+	jobsConfig JobsConfig
+	todos      []string
+	// suffix is appended to the job names by the generator.
+	suffix string
+}
+
+func (m *migration) todo(job, msg string) {
+	m.todos = append(m.todos, fmt.Sprintf("job %s: %s", job, msg))
+}
+
+// add adds the job of the given type, merging it into a job of the same name that only differs in types.
+func (m *migration) add(job Job, jobType string) {
+	for i, existing := range m.jobsConfig.Jobs {
+		existingSpec, spec := existing, job
+		existingSpec.Types, spec.Types = nil, nil
+		if reflect.DeepEqual(existingSpec, spec) {
+			m.jobsConfig.Jobs[i].Types = append(m.jobsConfig.Jobs[i].Types, jobType)
+			return
+		}
+	}
+	job.Types = []string{jobType}
+	m.jobsConfig.Jobs = append(m.jobsConfig.Jobs, job)
+}
+
+// migrateJobBase converts the settings shared by all job types. The name of the job is stripped of
+// the suffixes the generator appends for the job type.
+func (m *migration) migrateJobBase(jb config.JobBase, typeSuffix, branch string) Job {
+	name := strings.TrimSuffix(jb.Name, m.suffix+typeSuffix)
+	if name == jb.Name {
+		m.todo(jb.Name, fmt.Sprintf("the job will be renamed to %s%s%s", name, m.suffix, typeSuffix))
+	}
+	job := Job{
+		Name:           name,
+		Cluster:        jb.Cluster,
+		MaxConcurrency: jb.MaxConcurrency,
+		Labels:         jb.Labels,
+		Annotations:    jb.Annotations,
+		PathAlias:      jb.PathAlias,
+	}
+	if jb.Namespace != nil {
+		job.Namespace = *jb.Namespace
+	}
+	if jb.CloneDepth != 0 {
+		job.CloneDepth = &jb.CloneDepth
+	}
+	if jb.SkipSubmodules {
+		job.SkipSubmodules = newBool(true)
+	}
+	if jb.RerunAuthConfig != nil {
+		job.RerunAuthConfig = jb.RerunAuthConfig
+	}
+	for _, ref := range jb.ExtraRefs {
+		r := ref.Org + "/" + ref.Repo
+		if ref.BaseRef != "" && ref.BaseRef != branch {
+			r += "@" + ref.BaseRef
+		}
+		if ref.BaseSHA != "" {
+			m.todo(jb.Name, fmt.Sprintf("repo %s is pinned to %s, add it to the lockfile and clone it @%s", r, ref.BaseSHA, LockfileRef))
+		}
+		job.Repos = append(job.Repos, r)
+	}
+	if jb.Decorate == nil || !*jb.Decorate {
+		m.todo(jb.Name, "the job is not decorated, while generated jobs always are")
+	}
+	if dc := jb.DecorationConfig; dc != nil {
+		m.migrateDecorationConfig(&job, jb.Name, *dc)
+	}
+	if jb.Spec != nil {
+		m.migrateSpec(&job, jb.Name, *jb.Spec)
+	}
+	return job
+}
+
+func (m *migration) migrateDecorationConfig(job *Job, name string, dc prowjob.DecorationConfig) {
+	job.Timeout = dc.Timeout
+	job.UtilityImages = dc.UtilityImages
+	job.OauthTokenSecret = dc.OauthTokenSecret
+	if dc.CensorSecrets != nil {
+		job.CensorSecrets = *dc.CensorSecrets
+	}
+	if dc.SkipCloning != nil {
+		job.SkipCloning = *dc.SkipCloning
+	}
+	if dc.GracePeriod != nil {
+		job.Upload = &UploadSettings{GracePeriod: dc.GracePeriod}
+	}
+	if gcs := dc.GCSConfiguration; gcs != nil {
+		job.GCSLogBucket = gcs.Bucket
+		if gcs.PathStrategy != "" || len(gcs.MediaTypes) > 0 {
+			if job.Upload == nil {
+				job.Upload = &UploadSettings{}
+			}
+			job.Upload.PathStrategy = gcs.PathStrategy
+			job.Upload.DefaultOrg = gcs.DefaultOrg
+			job.Upload.DefaultRepo = gcs.DefaultRepo
+			job.Upload.MediaTypes = gcs.MediaTypes
+		}
+	}
+	job.DecorationResources = dc.Resources
+	if dc.GCSCredentialsSecret != "" || len(dc.SSHKeySecrets) > 0 || dc.CookiefileSecret != "" {
+		m.todo(name, "the gcs_credentials_secret, ssh_key_secrets and cookiefile_secret decoration settings are not supported")
+	}
+}
+
+func (m *migration) migrateSpec(job *Job, name string, spec v1.PodSpec) {
+	job.NodeSelector = spec.NodeSelector
+	job.ServiceAccountName = spec.ServiceAccountName
+	job.RestartPolicy = string(spec.RestartPolicy)
+	job.TerminationGracePeriodSeconds = spec.TerminationGracePeriodSeconds
+	job.Overhead = spec.Overhead
+	job.ShareProcessNamespace = spec.ShareProcessNamespace
+	job.EnableServiceLinks = spec.EnableServiceLinks
+	job.PriorityClassName = spec.PriorityClassName
+	if spec.HostNetwork {
+		job.HostNetwork = newBool(true)
+	}
+	if spec.DNSPolicy != "" && !(spec.HostNetwork && spec.DNSPolicy == v1.DNSClusterFirstWithHostNet) {
+		job.DNSPolicy = string(spec.DNSPolicy)
+	}
+	for _, secret := range spec.ImagePullSecrets {
+		job.ImagePullSecrets = append(job.ImagePullSecrets, secret.Name)
+	}
+	for _, gate := range spec.ReadinessGates {
+		job.ReadinessGates = append(job.ReadinessGates, string(gate.ConditionType))
+	}
+	if spec.RuntimeClassName != nil {
+		job.RuntimeClassName = *spec.RuntimeClassName
+	}
+	if spec.SecurityContext != nil {
+		job.FSGroup = spec.SecurityContext.FSGroup
+	}
+	if len(spec.Tolerations) > 0 || spec.Affinity != nil || len(spec.InitContainers) > 0 {
+		m.todo(name, "tolerations, affinity and init containers are not supported")
+	}
+	if len(spec.Containers) != 1 {
+		m.todo(name, fmt.Sprintf("the job has %d containers, only the first one is migrated", len(spec.Containers)))
+	}
+	if len(spec.Containers) == 0 {
+		return
+	}
+
+	c := spec.Containers[0]
+	job.Image = c.Image
+	job.ImagePullPolicy = string(c.ImagePullPolicy)
+	job.TerminationMessagePolicy = string(c.TerminationMessagePolicy)
+	job.Command = append(append([]string{}, c.Command...), c.Args...)
+	job.Env = c.Env
+	job.WorkingDir = c.WorkingDir
+	job.TTY = c.TTY
+	job.Stdin = c.Stdin
+	if lc := c.Lifecycle; lc != nil {
+		if lc.PreStop != nil && lc.PreStop.Exec != nil {
+			job.Lifecycle = &Lifecycle{PreStop: lc.PreStop.Exec.Command}
+		}
+		if lc.PostStart != nil || lc.PreStop != nil && lc.PreStop.Exec == nil {
+			m.todo(name, "only exec pre_stop lifecycle hooks are supported")
+		}
+	}
+	// Generated jobs are privileged unless disabled.
+	job.Privileged = newBool(false)
+	if sc := c.SecurityContext; sc != nil {
+		if sc.Privileged != nil {
+			job.Privileged = sc.Privileged
+		}
+		job.RunAsUser = sc.RunAsUser
+		job.RunAsGroup = sc.RunAsGroup
+		job.RunAsNonRoot = sc.RunAsNonRoot
+	}
+
+	// The presets are named after the job, unless the jobs of another type of the same name need
+	// different ones.
+	if len(c.Resources.Requests) > 0 || len(c.Resources.Limits) > 0 {
+		preset := job.Name
+		if existing, ok := m.jobsConfig.ResourcePresets[preset]; ok && !reflect.DeepEqual(existing, c.Resources) {
+			preset = name
+		}
+		m.jobsConfig.ResourcePresets[preset] = c.Resources
+		job.Resource = preset
+	}
+	if len(spec.Volumes) > 0 || len(c.VolumeMounts) > 0 {
+		preset := job.Name
+		requirement := RequirementPreset{Volumes: spec.Volumes, VolumeMounts: c.VolumeMounts}
+		if existing, ok := m.jobsConfig.RequirementPresets[preset]; ok && !reflect.DeepEqual(existing, requirement) {
+			preset = name
+		}
+		m.jobsConfig.RequirementPresets[preset] = requirement
+		job.Requirements = []string{preset}
+	}
+}
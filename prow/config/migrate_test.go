@@ -0,0 +1,98 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kr/pretty"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	prowjob "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/config"
+)
+
+func TestMigrateJobConfig(t *testing.T) {
+	cli := &Client{}
+	jobsConfig := JobsConfig{
+		Org:      "istio",
+		Repo:     "istio",
+		Branches: []string{"release-1.20"},
+		ResourcePresets: map[string]v1.ResourceRequirements{
+			"default": {Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("2")}},
+		},
+		RequirementPresets: map[string]RequirementPreset{
+			"cache": {
+				Volumes:      []v1.Volume{{Name: "cache", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}},
+				VolumeMounts: []v1.VolumeMount{{Name: "cache", MountPath: "/cache"}},
+			},
+		},
+		Jobs: []Job{
+			{
+				Name:         "unit",
+				Types:        []string{TypePresubmit, TypePostsubmit},
+				Image:        "image",
+				Command:      []string{"make", "test"},
+				Requirements: []string{"cache"},
+				Timeout:      &prowjob.Duration{Duration: time.Hour},
+				Repos:        []string{"istio/tools@master"},
+			},
+			{Name: "lint", Types: []string{TypePresubmit}, Image: "image", Command: []string{"make", "lint"}, Regex: "\\.go$", Modifiers: []string{ModifierOptional}},
+			{Name: "nightly", Types: []string{TypePeriodic}, Image: "image", Command: []string{"make", "e2e"}, Cron: "0 2 * * *"},
+		},
+	}
+	original := cli.ConvertJobConfig(jobsConfig, "release-1.20")
+
+	migrated, todos := MigrateJobConfig(original, "istio", "istio", "release-1.20")
+	if len(todos) > 0 {
+		t.Errorf("expected no TODOs, got %v", todos)
+	}
+	if len(migrated.Jobs) != 3 || !reflect.DeepEqual(migrated.Jobs[0].Types, []string{TypePresubmit, TypePostsubmit}) {
+		t.Errorf("expected the presubmit and postsubmit of unit to be merged, got %v", migrated.Jobs)
+	}
+	if regenerated := cli.ConvertJobConfig(migrated, "release-1.20"); !reflect.DeepEqual(regenerated, original) {
+		t.Errorf("expected the migrated config to generate the original config, diff: %v", pretty.Diff(original, regenerated))
+	}
+}
+
+func TestMigrateJobConfigTodos(t *testing.T) {
+	legacy := config.JobConfig{
+		PresubmitsStatic: map[string][]config.Presubmit{"istio/istio": {{
+			JobBase: config.JobBase{
+				Name: "legacy-build",
+				Spec: &v1.PodSpec{Containers: []v1.Container{{Image: "builder"}, {Image: "sidecar"}}},
+			},
+			AlwaysRun: true,
+		}}},
+	}
+	migrated, todos := MigrateJobConfig(legacy, "istio", "istio", "master")
+	if migrated.Jobs[0].Name != "legacy-build" || migrated.Jobs[0].Image != "builder" {
+		t.Errorf("expected the first container to be migrated, got %v", migrated.Jobs[0])
+	}
+	if len(todos) != 3 {
+		t.Fatalf("expected TODOs for the name, decoration and containers, got %v", todos)
+	}
+
+	bs, err := MarshalMigratedJobsConfig(migrated, todos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(bs), migrationTodoPrefix+"job legacy-build: the job will be renamed to legacy-build_istio\n") {
+		t.Errorf("expected the TODOs as comments at the top of the file, got:\n%s", bs)
+	}
+}
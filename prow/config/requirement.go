@@ -15,9 +15,21 @@
 package config
 
 import (
+	"fmt"
+	"path"
+	"strings"
+
 	v1 "k8s.io/api/core/v1"
+	"k8s.io/test-infra/prow/config"
 )
 
+// subPathJobPlaceholder is substituted with the name of the job in the subPaths of volume mounts, so
+// that jobs sharing a volume get their own directory of it.
+const subPathJobPlaceholder = "{job}"
+
+// RequirementHandler applies a custom requirement to the JobBase of a generated job.
+type RequirementHandler func(job *config.JobBase)
+
 // RequirementPreset can be used to re-use settings across multiple jobs.
 type RequirementPreset struct {
 	Annotations  map[string]string `json:"annotations"`
@@ -25,17 +37,61 @@ type RequirementPreset struct {
 	Env          []v1.EnvVar       `json:"env"`
 	Volumes      []v1.Volume       `json:"volumes"`
 	VolumeMounts []v1.VolumeMount  `json:"volumeMounts"`
+
+	PersistentCache *PersistentCache `json:"persistentCache,omitempty"`
+
+	// ServiceAccountName sets the service account of the pod, e.g. a Kubernetes service account bound
+	// to a GCP service account with workload identity. The binding is the iam.gke.io/gcp-service-account
+	// annotation of the service account in the build cluster, which the jobs cannot set.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+}
+
+// PersistentCache mounts a shared PersistentVolumeClaim, typically used to reuse a build cache across jobs.
+type PersistentCache struct {
+	ClaimName string `json:"claimName"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+	// SubPath is the directory of the claim mounted, e.g. {job} for each job to get its own cache.
+	SubPath string `json:"subPath,omitempty"`
+}
+
+// volume returns the volume and volume mount attaching the cache. The volume is named after the claim.
+func (pc PersistentCache) volume() (v1.Volume, v1.VolumeMount) {
+	volume := v1.Volume{
+		Name: pc.ClaimName,
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				ClaimName: pc.ClaimName,
+				ReadOnly:  pc.ReadOnly,
+			},
+		},
+	}
+	mount := v1.VolumeMount{
+		Name:      pc.ClaimName,
+		MountPath: pc.MountPath,
+		ReadOnly:  pc.ReadOnly,
+		SubPath:   pc.SubPath,
+	}
+	return volume, mount
 }
 
-func resolveRequirements(annotations, labels map[string]string, spec *v1.PodSpec, requirements []RequirementPreset) {
+func resolveRequirements(name string, annotations, labels map[string]string, spec *v1.PodSpec, requirements []RequirementPreset) {
 	if spec != nil {
 		for _, req := range requirements {
-			mergeRequirement(req, annotations, labels, spec.Containers, &spec.Volumes)
+			mergeRequirement(name, req, annotations, labels, spec.Containers, &spec.Volumes)
+			if req.ServiceAccountName != "" {
+				spec.ServiceAccountName = req.ServiceAccountName
+			}
 		}
 	}
 }
 
-func mergeRequirement(req RequirementPreset, annotations, labels map[string]string, containers []v1.Container, volumes *[]v1.Volume) {
+func mergeRequirement(name string, req RequirementPreset, annotations, labels map[string]string, containers []v1.Container, volumes *[]v1.Volume) {
+	if req.PersistentCache != nil {
+		volume, mount := req.PersistentCache.volume()
+		req.Volumes = append(append([]v1.Volume{}, req.Volumes...), volume)
+		req.VolumeMounts = append(append([]v1.VolumeMount{}, req.VolumeMounts...), mount)
+	}
 	for a, v := range req.Annotations {
 		annotations[a] = v
 	}
@@ -69,6 +125,7 @@ func mergeRequirement(req RequirementPreset, annotations, labels map[string]stri
 		}
 	}
 	for _, vm1 := range req.VolumeMounts {
+		vm1.SubPath = strings.Replace(vm1.SubPath, subPathJobPlaceholder, name, -1)
 		for i := range containers {
 			exists := false
 			for _, vm2 := range containers[i].VolumeMounts {
@@ -83,3 +140,60 @@ func mergeRequirement(req RequirementPreset, annotations, labels map[string]stri
 		}
 	}
 }
+
+func validateRequirementPreset(name string, req RequirementPreset) error {
+	if req.PersistentCache != nil {
+		if req.PersistentCache.ClaimName == "" {
+			return fmt.Errorf("requirement preset %v: persistentCache.claimName must be set", name)
+		}
+		if req.PersistentCache.MountPath == "" {
+			return fmt.Errorf("requirement preset %v: persistentCache.mountPath must be set", name)
+		}
+		if err := validateSubPath(req.PersistentCache.SubPath); err != nil {
+			return fmt.Errorf("requirement preset %v: persistentCache.subPath %v", name, err)
+		}
+	}
+	for _, vm := range req.VolumeMounts {
+		if err := validateSubPath(vm.SubPath); err != nil {
+			return fmt.Errorf("requirement preset %v: subPath of volume mount %v %v", name, vm.Name, err)
+		}
+	}
+	return nil
+}
+
+// validateSubPath validates that the subPath stays within the volume.
+func validateSubPath(subPath string) error {
+	if path.IsAbs(subPath) {
+		return fmt.Errorf("%q must be relative", subPath)
+	}
+	for _, element := range strings.Split(subPath, "/") {
+		if element == ".." {
+			return fmt.Errorf("%q must not contain ..", subPath)
+		}
+	}
+	return nil
+}
+
+// secretVolumes returns the names of the secret volumes the requirements mount.
+func secretVolumes(requirements []string, presets map[string]RequirementPreset) []string {
+	var secrets []string
+	for _, name := range requirements {
+		for _, volume := range presets[name].Volumes {
+			if volume.Secret != nil {
+				secrets = append(secrets, volume.Name)
+			}
+		}
+	}
+	return secrets
+}
+
+// requirementServiceAccounts returns the service accounts the requirements set, keyed by requirement.
+func requirementServiceAccounts(requirements []string, presets map[string]RequirementPreset) map[string]string {
+	accounts := map[string]string{}
+	for _, name := range requirements {
+		if sa := presets[name].ServiceAccountName; sa != "" {
+			accounts[name] = sa
+		}
+	}
+	return accounts
+}